@@ -1,17 +1,89 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/docker/go-connections/sockets"
 	"github.com/docker/go-plugins-helpers/network"
 	"github.com/mageshgv/docker-macvlan-noipam/driver"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// version is overridden at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 var (
-	logLevel = flag.String("log", "info", "log level")
-	logFile  = flag.String("logfile", "", "log file")
+	logLevel  = flag.String("log", "info", "log level")
+	logFile   = flag.String("logfile", "", "log file")
+	logStdout = flag.Bool("log-also-stdout", false, "also log to stdout when -logfile is set")
+	logMaxSz  = flag.Int("log-max-size", 0, "rotate -logfile once it reaches this many megabytes, no rotation when 0")
+	logMaxBk  = flag.Int("log-max-backups", 0, "rotated log files to keep with -log-max-size, all when 0")
+	logMaxAg  = flag.Int("log-max-age", 0, "days to keep rotated log files with -log-max-size, forever when 0")
+	adminAddr = flag.String("admin-addr", "", "address of the admin api: a loopback tcp address, a unix:///path socket, or any tcp address with -tls-cert, disabled when empty")
+	workers   = flag.Int("workers", 0, "max concurrent driver operations, defaults to GOMAXPROCS")
+	noIPv6    = flag.Bool("disable-ipv6", false, "disable ipv6 on container interfaces of all networks")
+	storeRec  = flag.String("store-recover", "fail", "unreadable store policy: fail, or reset to back it up and start empty")
+	globalMac = flag.Bool("global-mac-uniqueness", false, "reject endpoint MACs used on any network, not only the same network")
+	peerSync  = flag.String("peer-sync", "", "admin /store-sync url of a primary to replicate the store from as a warm standby")
+	peerEvery = flag.Duration("peer-sync-interval", 30*time.Second, "how often a warm standby syncs from -peer-sync")
+	logReqs   = flag.Bool("log-requests", false, "dump plugin api requests and responses as json at debug level")
+	hookPath  = flag.String("hook-script", "", "script executed on endpoint create, delete, join and leave")
+	hookWait  = flag.Duration("hook-timeout", 10*time.Second, "max run time of a -hook-script invocation")
+	hookFail  = flag.Bool("hook-fail", false, "fail the operation when -hook-script exits non-zero")
+	ifnameTpl = flag.String("ifname-template", "", "host interface name template using {parent}, {network}, {endpoint} and {index}, the endpoint's stable index in its network that needs {network} without {endpoint}, random veth names when empty")
+	strictMTU = flag.Bool("strict-mtu", false, "reject a -o macvlan_mtu above the parent mtu, or without room for a vlan tag, instead of clamping or warning")
+	lenient   = flag.Bool("lenient-ipam", false, "ignore the ipv4 pool of networks created without --ipam-driver null")
+	storeSync = flag.Bool("store-sync", true, "write store updates to disk immediately, false batches them and may lose the last -store-flush-interval on a crash")
+	storeIntv = flag.Duration("store-flush-interval", time.Second, "how often batched store updates are written out with -store-sync=false")
+	restoreOK = flag.Bool("restore-as-success", false, "answer CreateNetwork for a network already restored from the store with success instead of a maskable error")
+	carrier   = flag.Bool("require-carrier", false, "fail endpoint creation when the parent interface has no carrier instead of warning")
+	parentPol = flag.String("parent-policy", "strict", "when networks may share a parent: strict, allow-vlan for different vlans on one physical parent, or shared")
+	defParent = flag.String("default-parent", "", "parent of networks created without -o parent instead of a dummy link, sharing it needs -parent-policy=shared")
+	defStrict = flag.Bool("no-dummy-fallback", false, "fail network creation when -default-parent is missing instead of falling back to a dummy link")
+	forceDel  = flag.Bool("force-parent-delete", false, "delete a driver created parent on network removal even while other interfaces are attached to it")
+	macFormat = flag.String("mac-format", "colon", "MAC format in api responses: colon, colon-upper, dash or dash-upper")
+	profDir   = flag.String("profile-dir", "", "directory of <name>.json network option defaults selected with -o profile=<name>")
+	reqModule = flag.Bool("require-macvlan-module", false, "exit at startup when the kernel can't create macvlan links")
+	reserved  = flag.String("reserved-parents", "", "comma separated interfaces, or prefixes ending in *, refused as parents besides lo, docker0 and docker_gwbridge")
+	grace     = flag.Duration("parent-delete-grace", 0, "delay before deleting a driver created vlan parent, reused by a network created on it meanwhile")
+	adminPing = flag.Bool("admin-ping", false, "enable the admin api reachability check run from inside container namespaces")
+	dummyLen  = flag.Int("dummy-id-len", 0, "network id characters in dummy parent names, 12 to 14 with the prefix shortened from dm- to dm or d, defaults to 12")
+	wireless  = flag.String("wireless-parent", "reject", "what to do with wireless parents, which can't carry multiple MACs: reject or warn")
+	tcpAddr   = flag.String("tcp-addr", "", "serve the plugin api over tls on this tcp address instead of the unix socket")
+	tlsCert   = flag.String("tls-cert", "", "certificate of -tcp-addr and a tcp -admin-addr, also presented to an https -peer-sync")
+	tlsKey    = flag.String("tls-key", "", "key of -tls-cert")
+	tlsCA     = flag.String("tls-ca", "", "ca bundle client certificates must be signed by, and the -peer-sync server certificate, required with -tls-cert")
+	ipv4Pools = flag.String("allowed-ipv4-pools", "0.0.0.0/0", "comma separated ipv4 pools CreateNetwork accepts as the placeholder pool of the null ipam driver")
+	showCaps  = flag.Bool("capabilities", false, "probe and print the macvlan modes and parent types this host supports, then exit")
+	autoHeal  = flag.Bool("auto-heal-endpoints", false, "recreate container interfaces deleted out of band while their container still runs")
+	statsd    = flag.String("statsd-addr", "", "udp address of a statsd server to push the /stats metrics to every 10s, disabled when empty")
+	maintain  = flag.Bool("maintenance", false, "start in maintenance mode, pausing automatic repairs of host links until turned off on the admin api")
+	restoreQ  = flag.Bool("restore-silent", false, "same as -restore-as-success, for docker versions that show the restore error to users")
+	manifest  = flag.String("networks-manifest", "", "json file of networks to create in the plugin store at startup when missing, not in docker, drift from it is reported")
+	sockMode  = flag.String("socket-mode", "", "octal file mode of the plugin unix socket, ex. 0660, the helper default when empty")
+	noGwSvc   = flag.Bool("disable-gateway-service", true, "default DisableGatewayService of joins without a gateway, -o disable_gateway_service overrides it and a gateway always enables the service")
+	auditSt   = flag.Bool("audit-store", false, "report store records without matching host state or network, then exit, run it while the plugin is stopped")
+	auditCln  = flag.Bool("audit-clean", false, "with -audit-store, delete the endpoint records whose network no longer exists")
+	strictOp  = flag.Bool("strict-options", false, "reject networks created with unknown -o options instead of ignoring them")
+	macGen    = flag.String("mac-generator", "libnetwork", "what generates the MACs of endpoints created without one: libnetwork or builtin")
+	asyncRst  = flag.Bool("async-restore", false, "serve the plugin api while the store is restored in the background, /readyz reports when it is done")
+	notReady  = flag.String("not-ready", "queue", "what plugin api calls do before the store is restored: queue, waiting up to 30s, or reject with a retryable error")
+	adminRW   = flag.Bool("admin-write", false, "enable the admin api calls that change driver or host state: drain, label, loglevel, mac, maintenance, manifest, resync and, with -allow-rehome, rehome")
+	rehome    = flag.Bool("allow-rehome", false, "allow POST /networks/{id}/rehome on the admin api to move a network and its containers to a new parent")
+	nlRcvBuf  = flag.Int("netlink-rcvbuf", 0, "netlink socket receive buffer size in bytes, above net.core.rmem_max needs CAP_NET_ADMIN")
 )
 
 func main() {
@@ -24,26 +96,271 @@ func main() {
 	log.SetLevel(level)
 
 	if *logFile != "" {
-		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-		if err != nil {
+		var f io.WriteCloser
+		if *logMaxSz > 0 {
+			// lumberjack opens the file on the first write and rotates it by size
+			f = &lumberjack.Logger{
+				Filename:   *logFile,
+				MaxSize:    *logMaxSz,
+				MaxBackups: *logMaxBk,
+				MaxAge:     *logMaxAg,
+			}
+		} else if f, err = os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666); err != nil {
 			log.WithError(err).Fatal("Failed to open log file for writing")
 		}
 		defer f.Close()
 
-		log.StandardLogger().Out = f
+		if *logStdout {
+			log.StandardLogger().Out = io.MultiWriter(os.Stdout, f)
+		} else {
+			log.StandardLogger().Out = f
+		}
+	}
+
+	if *showCaps {
+		if err := driver.WriteCapabilities(os.Stdout); err != nil {
+			log.WithError(err).Fatal("Failed to print capabilities")
+		}
+		return
+	}
+	if *auditSt {
+		if err := driver.AuditStore(os.Stdout, *auditCln); err != nil {
+			log.WithError(err).Fatal("Failed to audit the store")
+		}
+		return
+	}
+
+	if *storeRec != "fail" && *storeRec != "reset" {
+		log.Fatalf("Invalid -store-recover %q, expected fail or reset", *storeRec)
+	}
+
+	if *parentPol != "strict" && *parentPol != "allow-vlan" && *parentPol != "shared" {
+		log.Fatalf("Invalid -parent-policy %q, expected strict, allow-vlan or shared", *parentPol)
+	}
+
+	switch *macFormat {
+	case "colon", "colon-upper", "dash", "dash-upper":
+	default:
+		log.Fatalf("Invalid -mac-format %q, expected colon, colon-upper, dash or dash-upper", *macFormat)
+	}
+
+	if *wireless != "reject" && *wireless != "warn" {
+		log.Fatalf("Invalid -wireless-parent %q, expected reject or warn", *wireless)
+	}
+
+	var tlsConfig *tls.Config
+	if *tcpAddr != "" || *tlsCert != "" {
+		if tlsConfig, err = loadTLSConfig(*tlsCert, *tlsKey, *tlsCA); err != nil {
+			log.WithError(err).Fatal("Invalid tls configuration")
+		}
+	}
+
+	var socketMode os.FileMode
+	if *sockMode != "" && *tcpAddr != "" {
+		log.Fatal("-socket-mode applies to the unix socket, it can't be used with -tcp-addr")
+	}
+	if *sockMode != "" {
+		if socketMode, err = parseSocketMode(*sockMode); err != nil {
+			log.WithError(err).Fatal("Invalid -socket-mode")
+		}
+	}
+
+	if *peerSync != "" && *peerEvery <= 0 {
+		log.Fatalf("Invalid -peer-sync-interval %s, expected a positive duration", *peerEvery)
+	}
+
+	if !*storeSync && *storeIntv <= 0 {
+		log.Fatalf("Invalid -store-flush-interval %s, expected a positive duration", *storeIntv)
 	}
 
-	driver, err := driver.NewDriver()
+	if *hookPath != "" {
+		if _, err := os.Stat(*hookPath); err != nil {
+			log.WithError(err).Fatal("Failed to find -hook-script")
+		}
+	}
+
+	driver, err := driver.NewDriver(driver.Options{
+		Version:             version,
+		Workers:             *workers,
+		NetlinkRcvBuf:       *nlRcvBuf,
+		DisableIPv6:         *noIPv6,
+		StoreRecover:        *storeRec,
+		GlobalMacUniqueness: *globalMac,
+		PeerSync:            *peerSync,
+		PeerSyncInterval:    *peerEvery,
+		LogRequests:         *logReqs,
+		HookScript:          *hookPath,
+		HookTimeout:         *hookWait,
+		HookFail:            *hookFail,
+		IfnameTemplate:      *ifnameTpl,
+		StrictMTU:           *strictMTU,
+		LenientIPAM:         *lenient,
+		StoreSync:           *storeSync,
+		StoreFlushInterval:  *storeIntv,
+		RestoreAsSuccess:    *restoreOK || *restoreQ,
+		RequireCarrier:      *carrier,
+		ParentPolicy:        *parentPol,
+		DefaultParent:       *defParent,
+		NoDummyFallback:     *defStrict,
+		ForceParentDelete:   *forceDel,
+		MacFormat:           *macFormat,
+		ProfileDir:          *profDir,
+		RequireMacvlan:      *reqModule,
+		ReservedParents:     splitList(*reserved),
+		ParentDeleteGrace:   *grace,
+		AdminPing:           *adminPing,
+		DummyIDLen:          *dummyLen,
+		WirelessParent:      *wireless,
+		AllowedPools:        splitList(*ipv4Pools),
+		AutoHealEndpoints:   *autoHeal,
+		StatsdAddr:          *statsd,
+		Maintenance:         *maintain,
+		NetworksManifest:    *manifest,
+		GatewayService:      !*noGwSvc,
+		StrictOptions:       *strictOp,
+		MacGenerator:        *macGen,
+		AsyncRestore:        *asyncRst,
+		NotReady:            *notReady,
+		AllowRehome:         *rehome,
+		AdminWrite:          *adminRW,
+		PeerSyncTLS:         tlsConfig,
+	})
 	if err != nil {
 		log.WithError(err).Fatal("Failed to create plugin")
 	}
 
-	handler := network.NewHandler(driver)
+	if *adminAddr != "" {
+		l, err := driver.ListenAdmin(*adminAddr, tlsConfig)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid -admin-addr")
+		}
+		go func() {
+			if err := driver.ServeAdmin(l); err != nil {
+				log.WithError(err).Error("Admin api stopped")
+			}
+		}()
+	}
+
+	if !*storeSync {
+		// write out batched store updates before a stop signal terminates the plugin
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+		go func() {
+			sig := <-sigCh
+			log.Infof("Received %s, flushing the store", sig)
+			driver.FlushStore()
+			os.Exit(0)
+		}()
+	}
+
+	handler := network.NewHandler(driver.PluginDriver())
 	log.Infof("Registering docker plugin")
-	err = handler.ServeUnix("macvlan-noipam", 1000) // Revisit user and gid
+	if *tcpAddr != "" {
+		// the daemon dir is ignored on unix, the spec file goes to /etc/docker/plugins
+		err = handler.ServeTCP("macvlan-noipam", *tcpAddr, "", tlsConfig)
+		if err != nil {
+			log.Errorf("Failed to handle docker tcp api: %s", err)
+		}
+		return
+	}
+	if socketMode != 0 {
+		err = serveUnixMode(handler, "macvlan-noipam", 1000, socketMode)
+	} else {
+		err = handler.ServeUnix("macvlan-noipam", 1000) // Revisit user and gid
+	}
 	if err != nil {
 		log.Errorf("Failed to handle docker unix api: %s", err)
 	}
 
 	// Any cleanups ?
 }
+
+// splitList parses a comma separated flag value, skipping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// pluginSockDir is where docker discovers plugin sockets, as in the helper's ServeUnix
+const pluginSockDir = "/run/docker/plugins"
+
+// parseSocketMode validates an octal -socket-mode, the owner needs read and
+// write access and nobody execute access
+func parseSocketMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an octal file mode: %v", value, err)
+	}
+	if mode&^0777 != 0 {
+		return 0, fmt.Errorf("%q has bits beyond the permission bits 0777", value)
+	}
+	if mode&0600 != 0600 {
+		return 0, fmt.Errorf("%q does not give the owner read and write access", value)
+	}
+	if mode&0111 != 0 {
+		return 0, fmt.Errorf("%q sets execute bits, which mean nothing on a socket", value)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// serveUnixMode serves the plugin api like ServeUnix, with the socket file
+// chmodded to mode before the first request is accepted
+func serveUnixMode(handler *network.Handler, name string, gid int, mode os.FileMode) error {
+	if err := os.MkdirAll(pluginSockDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(pluginSockDir, name+".sock")
+	l, err := sockets.NewUnixSocket(path, gid)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to set the mode of %s: %v", path, err)
+	}
+	log.Debugf("Plugin socket %s has mode %#o", path, mode)
+
+	return handler.Serve(l)
+}
+
+// loadTLSConfig builds the tls config of -tcp-addr and a tcp -admin-addr,
+// verifying client certificates against caFile. The plugin and admin apis
+// control host networking, over tcp they are never served to clients without
+// a certificate. The same config is the -peer-sync client config.
+func loadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("-tls-cert and -tls-key are both required")
+	}
+	if caFile == "" {
+		return nil, fmt.Errorf("-tls-ca is required with -tls-cert, clients must present a certificate it signed")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load -tls-cert %s and -tls-key %s: %v", certFile, keyFile, err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read -tls-ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in -tls-ca %s", caFile)
+	}
+	config.ClientCAs = pool
+	config.RootCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return config, nil
+}
@@ -0,0 +1,628 @@
+package driver
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/libnetwork/types"
+	"github.com/sirupsen/logrus"
+)
+
+// adminConfig is the read-only view of the driver-wide defaults served on /config
+type adminConfig struct {
+	Version     string `json:"version"`
+	Type        string `json:"type"`
+	Scope       string `json:"scope"`
+	DefaultMode string `json:"default_mode"`
+	// AutoParent is whether a network created without -o parent may get a dummy parent
+	AutoParent      bool   `json:"auto_parent"`
+	DefaultParent   string `json:"default_parent,omitempty"`
+	NoDummyFallback bool   `json:"no_dummy_fallback"`
+	ParentPolicy    string `json:"parent_policy"`
+	Workers         int    `json:"workers"`
+	StrictOptions   bool   `json:"strict_options"`
+	StrictMTU       bool   `json:"strict_mtu"`
+	RequireCarrier  bool   `json:"require_carrier"`
+	GlobalMac       bool   `json:"global_mac_uniqueness"`
+	StoreSync       bool   `json:"store_sync"`
+	GatewayService  bool   `json:"gateway_service"`
+	MacGenerator    string `json:"mac_generator"`
+	MacFormat       string `json:"mac_format"`
+	AsyncRestore    bool   `json:"async_restore"`
+	NotReady        string `json:"not_ready"`
+	PeerSync        string `json:"peer_sync,omitempty"`
+	AdminWrite      bool   `json:"admin_write"`
+	// Store is the data store backend and how the startup restore went
+	Store *storeInfo `json:"store"`
+}
+
+// ListenAdmin opens the admin api listener. A unix:///path address is a unix
+// socket only root can connect to, a tcp address must be loopback unless
+// tlsConfig is set, the admin api serves the whole store.
+func (d *driver) ListenAdmin(addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix://"); path != addr {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			// left behind by a previous run
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to set the mode of %s: %v", path, err)
+		}
+		return l, nil
+	}
+	if tlsConfig == nil {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin api address %s: %v", addr, err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("admin api address %s is not a loopback address, use a unix:// socket or serve it with -tls-cert", addr)
+		}
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	return l, nil
+}
+
+// ServeAdmin serves the operator facing admin api on a ListenAdmin listener
+func (d *driver) ServeAdmin(l net.Listener) error {
+	logrus.Infof("Serving admin api on %s", l.Addr())
+	return http.Serve(l, d.adminHandler())
+}
+
+// adminHandler returns the mux routing all admin api paths
+func (d *driver) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", d.handleConfig)
+	mux.HandleFunc("/endpoints/", d.handleEndpoint)
+	mux.HandleFunc("/networks/", d.handleNetwork)
+	mux.HandleFunc("/workers", d.handleWorkers)
+	mux.HandleFunc("/store-sync", d.handleStoreSync)
+	mux.HandleFunc("/can-create", d.handleCanCreate)
+	mux.HandleFunc("/links", d.handleLinks)
+	mux.HandleFunc("/stats", d.handleStats)
+	mux.HandleFunc("/loglevel", d.handleLogLevel)
+	mux.HandleFunc("/parents", d.handleParents)
+	mux.HandleFunc("/parents/", d.handleParent)
+	mux.HandleFunc("/capabilities", d.handleCapabilities)
+	mux.HandleFunc("/network-stats", d.handleNetworkStats)
+	mux.HandleFunc("/maintenance", d.handleMaintenance)
+	mux.HandleFunc("/manifest", d.handleManifest)
+	mux.HandleFunc("/readyz", d.handleReadyz)
+
+	return mux
+}
+
+func (d *driver) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	writeJSON(w, http.StatusOK, &adminConfig{
+		Version: d.opts.Version,
+		Type:    networkType,
+		Scope:   driverScope,
+		// validateNetworkConfig defaults -o macvlan_mode to bridge
+		DefaultMode: modeBridge,
+		// a missing -default-parent falls back to a dummy unless -no-dummy-fallback
+		AutoParent:      d.opts.DefaultParent == "" || !d.opts.NoDummyFallback,
+		DefaultParent:   d.opts.DefaultParent,
+		NoDummyFallback: d.opts.NoDummyFallback,
+		ParentPolicy:    d.opts.ParentPolicy,
+		Workers:         d.workers.stats().Workers,
+		StrictOptions:   d.opts.StrictOptions,
+		StrictMTU:       d.opts.StrictMTU,
+		RequireCarrier:  d.opts.RequireCarrier,
+		GlobalMac:       d.opts.GlobalMacUniqueness,
+		StoreSync:       d.opts.StoreSync,
+		GatewayService:  d.opts.GatewayService,
+		MacGenerator:    d.opts.MacGenerator,
+		MacFormat:       d.opts.MacFormat,
+		AsyncRestore:    d.opts.AsyncRestore,
+		NotReady:        d.opts.NotReady,
+		PeerSync:        d.opts.PeerSync,
+		AdminWrite:      d.opts.AdminWrite,
+		Store:           d.storeInfo(),
+	})
+}
+
+func (d *driver) handleWorkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	writeJSON(w, http.StatusOK, d.workers.stats())
+}
+
+func (d *driver) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	writeJSON(w, http.StatusOK, d.stats())
+}
+
+// handleLogLevel reports the log level on GET and changes it on POST {"level":"debug"}
+func (d *driver) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !d.allowChange(w) {
+			return
+		}
+		var req struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "failed to decode request body: %v", err)
+			return
+		}
+		level, err := logrus.ParseLevel(req.Level)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		logrus.SetLevel(level)
+		logrus.Warnf("Log level changed to %s through the admin api", level)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": logrus.GetLevel().String()})
+}
+
+// handleManifest reports the startup reconcile of -networks-manifest on GET,
+// a POST reconciles the manifest again
+func (d *driver) handleManifest(w http.ResponseWriter, r *http.Request) {
+	if d.opts.NetworksManifest == "" {
+		writeError(w, http.StatusNotFound, "no -networks-manifest configured")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !d.allowChange(w) {
+			return
+		}
+		result, err := d.applyManifest(d.opts.NetworksManifest)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		d.Lock()
+		d.manifest = result
+		d.Unlock()
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	d.Lock()
+	result := d.manifest
+	d.Unlock()
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleMaintenance reports maintenance mode on GET and toggles it on POST {"maintenance":true}
+func (d *driver) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !d.allowChange(w) {
+			return
+		}
+		var req maintenanceState
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "failed to decode request body: %v", err)
+			return
+		}
+		d.setMaintenance(req.Maintenance)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	writeJSON(w, http.StatusOK, &maintenanceState{Maintenance: d.inMaintenance()})
+}
+
+func (d *driver) handleStoreSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	snap, err := d.snapshotStore()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, snap)
+}
+
+// handleLinks lists the host links created by the driver, flagging orphans
+func (d *driver) handleLinks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	links, err := d.driverLinks()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list host links: %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, links)
+}
+
+// canCreateResult is the /can-create pre-flight verdict
+type canCreateResult struct {
+	OK     bool   `json:"ok"`
+	Parent string `json:"parent"`
+	Mode   string `json:"mode"`
+	Reason string `json:"reason,omitempty"`
+	// Code is the failure category of Reason, ex. parent_conflict
+	Code string `json:"code,omitempty"`
+}
+
+// handleCanCreate answers whether CreateNetwork would accept ?parent=&mode=&id=
+func (d *driver) handleCanCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	query := r.URL.Query()
+	config := &configuration{ID: query.Get("id")}
+	if err := config.fromOptions(map[string]string{
+		parentOpt:     query.Get("parent"),
+		driverModeOpt: query.Get("mode"),
+	}); err != nil {
+		writeJSON(w, http.StatusOK, &canCreateResult{Reason: err.Error(), Code: codeInvalidOption})
+		return
+	}
+	result := &canCreateResult{OK: true}
+	if err := d.canCreateNetwork(config); err != nil {
+		result.OK = false
+		result.Reason = err.Error()
+		result.Code = errorCode(err)
+	}
+	result.Parent = config.Parent
+	result.Mode = config.MacvlanMode
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleNetwork routes /networks/{id}/{action} requests
+func (d *driver) handleNetwork(w http.ResponseWriter, r *http.Request) {
+	nid, action := splitResourcePath(r.URL.Path, "/networks/")
+	if r.Method == http.MethodPost && !d.allowChange(w) {
+		return
+	}
+	switch {
+	case nid != "" && action == "resync" && r.Method == http.MethodPost:
+		result, err := d.resyncNetwork(nid)
+		if err != nil {
+			writeError(w, errorStatus(err), "%v", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	case nid != "" && action == "rehome" && r.Method == http.MethodPost:
+		var req struct {
+			Parent string `json:"parent"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "failed to decode request body: %v", err)
+			return
+		}
+		result, err := d.rehomeNetwork(nid, req.Parent)
+		if err != nil {
+			writeError(w, errorStatus(err), "%v", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	case nid != "" && action == "label" && r.Method == http.MethodGet:
+		n, err := d.getNetwork(nid)
+		if err != nil {
+			writeError(w, errorStatus(err), "%v", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &networkLabel{ID: n.id, Label: n.config.Label})
+	case nid != "" && action == "label" && r.Method == http.MethodPost:
+		var req struct {
+			Label string `json:"label"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "failed to decode request body: %v", err)
+			return
+		}
+		result, err := d.setNetworkLabel(nid, req.Label)
+		if err != nil {
+			writeError(w, errorStatus(err), "%v", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	default:
+		writeError(w, http.StatusNotFound, "no admin api route for %s %s", r.Method, r.URL.Path)
+	}
+}
+
+// requireReady answers 503 to an admin api change made while -async-restore is
+// still restoring the store, and tells whether the change can go ahead
+func (d *driver) requireReady(w http.ResponseWriter) bool {
+	if d.ready.isSet() {
+		return true
+	}
+	writeError(w, http.StatusServiceUnavailable, "%s driver is restoring its state, retry once /readyz is ready", networkType)
+
+	return false
+}
+
+// allowChange answers 403 to an admin api change unless -admin-write is set
+// and this is not a -peer-sync warm standby, then waits for the restore like
+// requireReady
+func (d *driver) allowChange(w http.ResponseWriter) bool {
+	if !d.opts.AdminWrite {
+		writeError(w, http.StatusForbidden, "admin api changes are disabled, start the plugin with -admin-write")
+		return false
+	}
+	if d.opts.PeerSync != "" {
+		writeError(w, http.StatusForbidden, "%s driver is a warm standby of %s, changes are made on the primary", networkType, d.opts.PeerSync)
+		return false
+	}
+
+	return d.requireReady(w)
+}
+
+// handleReadyz answers 200 once the store is restored and 503 before
+func (d *driver) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	status := http.StatusOK
+	ready := d.ready.isSet()
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, &struct {
+		Ready bool `json:"ready"`
+	}{ready})
+}
+
+// handleNetworkStats reports the rx and tx totals of each network's endpoints
+func (d *driver) handleNetworkStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	writeJSON(w, http.StatusOK, d.networkStats())
+}
+
+// handleCapabilities reports the kernel modules and supported macvlan modes
+// probed at startup, ?refresh=true probes again, briefly adding and removing
+// dummy, macvlan and vlan links. A refresh doesn't change the startup probe
+// network create checks modes against.
+func (d *driver) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if r.URL.Query().Get("refresh") == "true" {
+		writeJSON(w, http.StatusOK, probeHost())
+		return
+	}
+	writeJSON(w, http.StatusOK, d.caps)
+}
+
+// handleParents lists the draining parents
+func (d *driver) handleParents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	writeJSON(w, http.StatusOK, d.drainedParents())
+}
+
+// handleParent routes /parents/{name}/{action} requests, drain and undrain
+// toggle maintenance and a GET reports the state and what still uses the parent
+func (d *driver) handleParent(w http.ResponseWriter, r *http.Request) {
+	parent, action := splitResourcePath(r.URL.Path, "/parents/")
+	if r.Method == http.MethodPost && !d.allowChange(w) {
+		return
+	}
+	switch {
+	case parent != "" && action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, d.drainState(parent))
+	case parent != "" && action == "drain" && r.Method == http.MethodPost:
+		d.setDrain(parent, true)
+		writeJSON(w, http.StatusOK, d.drainState(parent))
+	case parent != "" && action == "undrain" && r.Method == http.MethodPost:
+		d.setDrain(parent, false)
+		writeJSON(w, http.StatusOK, d.drainState(parent))
+	default:
+		writeError(w, http.StatusNotFound, "no admin api route for %s %s", r.Method, r.URL.Path)
+	}
+}
+
+// handleEndpoint routes /endpoints/{id}/{action} requests
+func (d *driver) handleEndpoint(w http.ResponseWriter, r *http.Request) {
+	eid, action := splitResourcePath(r.URL.Path, "/endpoints/")
+	switch {
+	case eid != "" && action == "mac" && r.Method == http.MethodPost:
+		d.handleEndpointMac(w, r, eid)
+	case eid != "" && action == "" && r.Method == http.MethodGet:
+		d.handleEndpointGet(w, eid)
+	case eid != "" && action == "ping" && r.Method == http.MethodPost:
+		d.handleEndpointPing(w, r, eid)
+	case eid != "" && action == "stats" && r.Method == http.MethodGet:
+		d.handleEndpointStats(w, eid)
+	default:
+		writeError(w, http.StatusNotFound, "no admin api route for %s %s", r.Method, r.URL.Path)
+	}
+}
+
+// endpointView is the admin api view of an endpoint
+type endpointView struct {
+	ID            string   `json:"id"`
+	NetworkID     string   `json:"network_id"`
+	MacAddress    string   `json:"mac"`
+	SrcName       string   `json:"src_name,omitempty"`
+	AuxNames      []string `json:"aux_names,omitempty"`
+	SandboxKey    string   `json:"sandbox_key,omitempty"`
+	SandboxID     string   `json:"sandbox_id,omitempty"`
+	SandboxGone   bool     `json:"sandbox_gone,omitempty"`
+	ContainerName string   `json:"container_name,omitempty"`
+	Ifindex       int      `json:"ifindex,omitempty"`
+	JoinedAt      string   `json:"joined_at,omitempty"`
+	LeftAt        string   `json:"left_at,omitempty"`
+	// Attached is how long the endpoint has been joined
+	Attached string `json:"attached,omitempty"`
+}
+
+func (d *driver) handleEndpointGet(w http.ResponseWriter, eid string) {
+	_, ep := d.findEndpoint(eid)
+	if ep == nil {
+		writeError(w, http.StatusNotFound, "endpoint id %s not found", eid)
+		return
+	}
+	view := &endpointView{
+		ID:            ep.id,
+		NetworkID:     ep.nid,
+		MacAddress:    d.formatMac(ep.mac),
+		SrcName:       ep.srcName,
+		AuxNames:      ep.auxNames,
+		SandboxKey:    ep.sandboxKey,
+		SandboxID:     ep.sandboxID(),
+		SandboxGone:   ep.sandboxGone(),
+		ContainerName: ep.containerName,
+	}
+	index, err := endpointIfindex(ep)
+	if err != nil {
+		logrus.Debugf("Failed to read the ifindex of endpoint %.7s: %v", ep.id, err)
+	}
+	view.Ifindex = index
+	if !ep.joinedAt.IsZero() {
+		view.JoinedAt = ep.joinedAt.Format(time.RFC3339)
+		if ep.leftAt.IsZero() {
+			view.Attached = time.Since(ep.joinedAt).Round(time.Second).String()
+		}
+	}
+	if !ep.leftAt.IsZero() {
+		view.LeftAt = ep.leftAt.Format(time.RFC3339)
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+func (d *driver) handleEndpointMac(w http.ResponseWriter, r *http.Request, eid string) {
+	if !d.allowChange(w) {
+		return
+	}
+	var req struct {
+		MacAddress string `json:"mac"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "failed to decode request body: %v", err)
+		return
+	}
+	mac, err := net.ParseMAC(req.MacAddress)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid MAC address %q: %v", req.MacAddress, err)
+		return
+	}
+	if err := d.setEndpointMac(eid, mac); err != nil {
+		writeError(w, errorStatus(err), "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"endpoint_id": eid, "mac": d.formatMac(mac)})
+}
+
+func (d *driver) handleEndpointPing(w http.ResponseWriter, r *http.Request, eid string) {
+	var req struct {
+		Target string `json:"target"`
+		Port   int    `json:"port"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "failed to decode request body: %v", err)
+		return
+	}
+	if req.Port < 0 || req.Port > 65535 {
+		writeError(w, http.StatusBadRequest, "invalid port %d", req.Port)
+		return
+	}
+	result, err := d.pingEndpoint(eid, req.Target, req.Port)
+	if err != nil {
+		writeError(w, errorStatus(err), "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (d *driver) handleEndpointStats(w http.ResponseWriter, eid string) {
+	_, ep := d.findEndpoint(eid)
+	if ep == nil {
+		writeError(w, http.StatusNotFound, "endpoint id %s not found", eid)
+		return
+	}
+	stats, err := endpointQdiscStats(ep)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if stats == nil {
+		writeError(w, http.StatusNotFound, "endpoint %.7s has no rate limiting qdisc", eid)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// splitResourcePath splits /prefix/{id}/{action} into id and action
+func splitResourcePath(path, prefix string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// errorStatus maps libnetwork error types to http status codes
+func errorStatus(err error) int {
+	if e, ok := err.(*createError); ok {
+		err = e.err
+	}
+	switch err.(type) {
+	case types.BadRequestError:
+		return http.StatusBadRequest
+	case types.NotFoundError:
+		return http.StatusNotFound
+	case types.ForbiddenError:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeJSON encodes an admin api response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Warnf("Failed to encode admin api response: %v", err)
+	}
+}
+
+// writeError encodes an admin api error body
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
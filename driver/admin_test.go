@@ -0,0 +1,85 @@
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminChangesWaitForRestore(t *testing.T) {
+	d := newTestDriver(Options{NetworksManifest: "/nonexistent", AdminWrite: true}, &configuration{ID: "n1", Parent: "eth0", MacvlanMode: modeBridge})
+	d.ready = newReadiness()
+	handler := d.adminHandler()
+
+	for _, path := range []string{"/networks/n1/resync", "/networks/n1/rehome", "/endpoints/e1/mac", "/maintenance", "/manifest"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"maintenance":true,"parent":"eth1"}`)))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("POST %s before the restore: got %d, want %d", path, rec.Code, http.StatusServiceUnavailable)
+		}
+	}
+	if d.inMaintenance() {
+		t.Error("maintenance was changed before the restore")
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/maintenance", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /maintenance before the restore: got %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestAdminChangesNeedAdminWrite(t *testing.T) {
+	d := newTestDriver(Options{NetworksManifest: "/nonexistent"}, &configuration{ID: "n1", Parent: "eth0", MacvlanMode: modeBridge})
+	handler := d.adminHandler()
+
+	for _, path := range []string{"/networks/n1/label", "/networks/n1/resync", "/parents/eth0/drain", "/endpoints/e1/mac", "/loglevel", "/maintenance", "/manifest"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"label":"x","level":"debug","maintenance":true}`)))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("POST %s without AdminWrite: got %d, want %d", path, rec.Code, http.StatusForbidden)
+		}
+	}
+	if d.inMaintenance() || len(d.drainedParents()) > 0 {
+		t.Error("the driver state was changed without AdminWrite")
+	}
+}
+
+func TestListenAdminNeedsLoopback(t *testing.T) {
+	d := newTestDriver(Options{})
+	if l, err := d.ListenAdmin("0.0.0.0:0", nil); err == nil {
+		l.Close()
+		t.Error("a non-loopback admin address without tls was accepted")
+	}
+	l, err := d.ListenAdmin("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("loopback admin address: %v", err)
+	}
+	l.Close()
+}
+
+func TestAdminConfigReflectsOptions(t *testing.T) {
+	for _, tc := range []struct {
+		opts       Options
+		autoParent bool
+	}{
+		{Options{}, true},
+		{Options{DefaultParent: "eth1"}, true},
+		{Options{DefaultParent: "eth1", NoDummyFallback: true, ParentPolicy: parentPolicyShared, Workers: 3}, false},
+	} {
+		rec := httptest.NewRecorder()
+		newTestDriver(tc.opts).adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+		var config adminConfig
+		if err := json.NewDecoder(rec.Body).Decode(&config); err != nil {
+			t.Fatal(err)
+		}
+		if config.AutoParent != tc.autoParent || config.DefaultParent != tc.opts.DefaultParent || config.ParentPolicy != tc.opts.ParentPolicy {
+			t.Errorf("options %+v: got auto_parent %v, default_parent %q and parent_policy %q", tc.opts, config.AutoParent, config.DefaultParent, config.ParentPolicy)
+		}
+		if tc.opts.Workers > 0 && config.Workers != tc.opts.Workers {
+			t.Errorf("got %d workers, want %d", config.Workers, tc.opts.Workers)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// auditFinding is one store record -audit-store found without matching state
+type auditFinding struct {
+	kind   string
+	id     string
+	detail string
+	// ep is set for orphaned endpoints, the only records a clean deletes
+	ep *endpoint
+}
+
+// AuditStore reads the driver store without restoring it and writes a report
+// of the records that have no matching host state: endpoints of a deleted
+// network, networks whose user supplied parent is gone and endpoints joined to
+// a sandbox that no longer exists. With clean the orphaned endpoints are
+// deleted, the other findings are left for docker to remove. The plugin must
+// not be running as boltdb allows a single process to open the store.
+func AuditStore(w io.Writer, clean bool) error {
+	ds, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	d := &driver{store: ds}
+
+	configs, err := d.listNetworkConfigs()
+	if err != nil {
+		return err
+	}
+	eps, err := d.listEndpoints()
+	if err != nil {
+		return err
+	}
+
+	var findings []*auditFinding
+	networks := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		networks[config.ID] = true
+		// links the driver created are recreated on restore
+		if !config.CreatedSlaveLink && !parentExists(config.Parent) {
+			findings = append(findings, &auditFinding{
+				kind:   "network",
+				id:     config.ID,
+				detail: fmt.Sprintf("parent %s does not exist", config.Parent),
+			})
+		}
+	}
+	for _, ep := range eps {
+		switch {
+		case !networks[ep.nid]:
+			findings = append(findings, &auditFinding{
+				kind:   "endpoint",
+				id:     ep.id,
+				detail: fmt.Sprintf("network %s is not in the store", ep.nid),
+				ep:     ep,
+			})
+		case ep.sandboxGone():
+			findings = append(findings, &auditFinding{
+				kind:   "endpoint",
+				id:     ep.id,
+				detail: fmt.Sprintf("sandbox %s no longer exists", ep.sandboxKey),
+			})
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].kind != findings[j].kind {
+			return findings[i].kind > findings[j].kind
+		}
+		return findings[i].id < findings[j].id
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RECORD\tID\tPROBLEM\tACTION")
+	for _, f := range findings {
+		action := "none"
+		if f.ep != nil {
+			action = "delete with -audit-clean"
+			if clean {
+				if err := d.storeDeleteNow(f.ep); err != nil {
+					action = fmt.Sprintf("delete failed: %v", err)
+				} else {
+					action = "deleted"
+				}
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f.kind, f.id, f.detail, action)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%d networks, %d endpoints, %d findings\n", len(configs), len(eps), len(findings))
+
+	return err
+}
@@ -0,0 +1,125 @@
+package driver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/libnetwork/netutils"
+	"github.com/docker/libnetwork/ns"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
+)
+
+// healInterval is how often -auto-heal-endpoints compares the store with the
+// sandboxes, a child joined more recently may not have been moved by docker yet
+const healInterval = 30 * time.Second
+
+// runAutoHeal periodically recreates endpoint interfaces deleted out of band
+func (d *driver) runAutoHeal(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.healEndpoints(interval)
+	}
+}
+
+// healEndpoints recreates the missing children of joined endpoints whose
+// sandbox still exists, endpoints joined within settle are left to docker
+func (d *driver) healEndpoints(settle time.Duration) {
+	if d.inMaintenance() {
+		logrus.Debugf("Skipping the endpoint auto heal in maintenance mode")
+		return
+	}
+	for _, n := range d.getNetworks() {
+		for _, ep := range n.getEndpoints() {
+			d.healIfMissing(n, ep, settle)
+		}
+	}
+}
+
+// healIfMissing recreates the child of one endpoint when it is missing from
+// its sandbox. The endpoint is held for the check and the repair, so a Join,
+// Leave or admin change runs before or after it, and an endpoint that is
+// leaving is skipped.
+func (d *driver) healIfMissing(n *network, ep *endpoint, settle time.Duration) {
+	ep.Lock()
+	defer ep.Unlock()
+	if ep.leaving || ep.sandboxKey == "" || len(ep.mac) == 0 || ep.sandboxGone() || time.Since(ep.joinedAt) < settle {
+		return
+	}
+	// docker has not moved the child yet
+	if parentExists(ep.srcName) {
+		return
+	}
+	_, _, release, err := endpointLink(ep)
+	if err == nil {
+		release()
+		return
+	}
+	logrus.Warnf("Interface of endpoint %.7s is missing from sandbox %s, recreating it", ep.id, ep.sandboxKey)
+	if err := d.healEndpoint(n, ep); err != nil {
+		logrus.Errorf("Failed to recreate the interface of endpoint %.7s: %v", ep.id, err)
+		return
+	}
+	logrus.Infof("Recreated interface %s of endpoint %.7s in sandbox %s", ep.srcName, ep.id, ep.sandboxKey)
+}
+
+// healEndpoint creates a child like Join does, with the stored MAC, and moves
+// it into the sandbox under the first free container interface name. The
+// caller holds the endpoint.
+func (d *driver) healEndpoint(n *network, ep *endpoint) error {
+	mtu, err := d.childMTU(n.config)
+	if err != nil {
+		return err
+	}
+	name, err := netutils.GenerateIfaceName(ns.NlHandle(), vethPrefix, vethLen)
+	if err != nil {
+		return fmt.Errorf("error generating an interface name: %s", err)
+	}
+	if _, err := createMacVlanQueues(name, n.config.Parent, n.config.MacvlanMode, mtu, n.config.RxQueues, n.config.TxQueues); err != nil {
+		return err
+	}
+	if err := setLinkMac(name, ep.mac); err != nil {
+		delLink(name)
+		return err
+	}
+	if len(n.config.IfaceFlags) > 0 {
+		if err := setLinkFlags(name, n.config.IfaceFlags); err != nil {
+			delLink(name)
+			return err
+		}
+	}
+	sandboxName, err := freeSandboxName(ep.sandboxKey, n.config.dstPrefix())
+	if err != nil {
+		delLink(name)
+		return err
+	}
+	nsh, err := netns.GetFromPath(ep.sandboxKey)
+	if err != nil {
+		delLink(name)
+		return fmt.Errorf("failed to open sandbox %s: %v", ep.sandboxKey, err)
+	}
+	defer nsh.Close()
+	if err := moveLinkToSandbox(name, sandboxName, nsh, ep.sandboxKey); err != nil {
+		delLink(name)
+		return err
+	}
+	ep.srcName = name
+
+	return d.storeUpdate(ep)
+}
+
+// freeSandboxName returns the first prefix<n> name not used in the sandbox
+func freeSandboxName(sandboxKey, prefix string) (string, error) {
+	h, err := sandboxHandle(sandboxKey)
+	if err != nil {
+		return "", err
+	}
+	defer h.Delete()
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("%s%d", prefix, i)
+		if _, err := h.LinkByName(name); err != nil {
+			return name, nil
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package driver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	networkapi "github.com/docker/go-plugins-helpers/network"
+	"github.com/sirupsen/logrus"
+)
+
+// joinedTestEndpoint adds an endpoint joined to a sandbox that exists but
+// holds no interface, on a parent missing from the host
+func joinedTestEndpoint(t *testing.T) (*driver, *network, *endpoint) {
+	sandbox := filepath.Join(t.TempDir(), "sandbox")
+	if err := ioutil.WriteFile(sandbox, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "mvtest-none0", MacvlanMode: modeBridge, LeaveAction: leaveDelete})
+	n, _ := d.getNetwork("n1")
+	mac, _ := net.ParseMAC("02:42:0a:00:00:05")
+	ep := &endpoint{id: "e1", nid: "n1", mac: mac, srcName: "mvtest-child0", sandboxKey: sandbox, joinedAt: time.Now().Add(-time.Hour)}
+	n.addEndpoint(ep)
+
+	return d, n, ep
+}
+
+func TestHealSkipsLeavingEndpoint(t *testing.T) {
+	d, n, ep := joinedTestEndpoint(t)
+	var logs bytes.Buffer
+	logrus.SetOutput(&logs)
+	defer logrus.SetOutput(ioutil.Discard)
+
+	// docker already took the interface out, Leave has started but not finished
+	ep.leaving = true
+	d.healIfMissing(n, ep, time.Second)
+	if strings.Contains(logs.String(), "recreating it") {
+		t.Errorf("auto heal recreated the interface of a leaving endpoint: %s", logs.String())
+	}
+
+	ep.leaving = false
+	d.healIfMissing(n, ep, time.Second)
+	if !strings.Contains(logs.String(), "recreating it") {
+		t.Errorf("auto heal skipped a joined endpoint missing its interface: %s", logs.String())
+	}
+}
+
+// TestHealLeaveRace is meant for go test -race, auto heal and Leave on one
+// endpoint must not touch its fields at the same time
+func TestHealLeaveRace(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	d, n, ep := joinedTestEndpoint(t)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			d.healEndpoints(time.Second)
+		}
+	}()
+	if err := d.Leave(&networkapi.LeaveRequest{NetworkID: n.id, EndpointID: ep.id}); err != nil {
+		t.Fatalf("Leave: %v", err)
+	}
+	wg.Wait()
+
+	ep.Lock()
+	defer ep.Unlock()
+	if ep.sandboxKey != "" || !ep.leaving {
+		t.Errorf("endpoint still joined to %q after Leave", ep.sandboxKey)
+	}
+}
@@ -0,0 +1,132 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/libnetwork/netutils"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/types"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// auxParentsOpt lists extra parents, each giving every endpoint of the network
+// an auxiliary macvlan interface, passed with docker network create -o
+const auxParentsOpt = "aux_parents"
+
+// auxSuffix is inserted between the container prefix and index of auxiliary interfaces
+const auxSuffix = "aux"
+
+// parseAuxParents validates a comma separated -o aux_parents value
+func parseAuxParents(value string) ([]string, error) {
+	var parents []string
+	for _, parent := range strings.Split(value, ",") {
+		parent = strings.TrimSpace(parent)
+		if parent == "" {
+			continue
+		}
+		if parent == "lo" {
+			return nil, fmt.Errorf("loopback interface is not a valid auxiliary parent")
+		}
+		parents = append(parents, parent)
+	}
+
+	return parents, nil
+}
+
+// auxIfaceName is the container side name of the i-th auxiliary interface.
+// The plugin protocol hands docker a single interface per endpoint, the
+// driver moves and names the auxiliary ones in the sandbox itself.
+func auxIfaceName(config *configuration, i int) string {
+	return fmt.Sprintf("%s%s%d", config.dstPrefix(), auxSuffix, i)
+}
+
+// joinAuxIfaces creates a macvlan child on every auxiliary parent of the
+// network and moves it into the sandbox, removing them all on failure
+func (d *driver) joinAuxIfaces(n *network, ep *endpoint, sandboxKey string) error {
+	if len(n.config.AuxParents) == 0 {
+		return nil
+	}
+	nsh, err := netns.GetFromPath(sandboxKey)
+	if err != nil {
+		return fmt.Errorf("failed to open sandbox %s: %v", sandboxKey, err)
+	}
+	defer nsh.Close()
+	var names []string
+	for i, parent := range n.config.AuxParents {
+		name, err := netutils.GenerateIfaceName(ns.NlHandle(), vethPrefix, vethLen)
+		if err != nil {
+			d.leaveAuxIfaces(names, sandboxKey)
+			return fmt.Errorf("error generating an interface name: %s", err)
+		}
+		if _, err := createMacVlan(name, parent, n.config.MacvlanMode, 0); err != nil {
+			d.leaveAuxIfaces(names, sandboxKey)
+			return types.BadRequestErrorf("failed to create the auxiliary interface on %s: %v", parent, err)
+		}
+		if err := moveLinkToSandbox(name, auxIfaceName(n.config, i), nsh, sandboxKey); err != nil {
+			delLink(name)
+			d.leaveAuxIfaces(names, sandboxKey)
+			return err
+		}
+		names = append(names, auxIfaceName(n.config, i))
+	}
+	ep.auxNames = names
+	logrus.Debugf("Joined endpoint %.7s with auxiliary interfaces %s", ep.id, strings.Join(names, ", "))
+
+	return nil
+}
+
+// moveLinkToSandbox moves a host link into the sandbox, renaming it and bringing it up there
+func moveLinkToSandbox(name, sandboxName string, nsh netns.NsHandle, sandboxKey string) error {
+	link, err := ns.NlHandle().LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %v", name, err)
+	}
+	if err := ns.NlHandle().LinkSetNsFd(link, int(nsh)); err != nil {
+		return fmt.Errorf("failed to move interface %s into sandbox %s: %v", name, sandboxKey, err)
+	}
+	h, err := sandboxHandle(sandboxKey)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	link, err = h.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s in sandbox %s: %v", name, sandboxKey, err)
+	}
+	if err := h.LinkSetName(link, sandboxName); err != nil {
+		h.LinkDel(link)
+		return fmt.Errorf("failed to rename interface %s to %s: %v", name, sandboxName, err)
+	}
+	if err := h.LinkSetUp(link); err != nil {
+		h.LinkDel(link)
+		return fmt.Errorf("failed to bring up interface %s: %v", sandboxName, err)
+	}
+
+	return nil
+}
+
+// leaveAuxIfaces deletes auxiliary interfaces from the sandbox, a sandbox that
+// is already gone took them with it
+func (d *driver) leaveAuxIfaces(names []string, sandboxKey string) {
+	if len(names) == 0 {
+		return
+	}
+	h, err := sandboxHandle(sandboxKey)
+	if err != nil {
+		logrus.Debugf("Auxiliary interfaces left with their sandbox: %v", err)
+		return
+	}
+	defer h.Delete()
+	for _, name := range names {
+		var link netlink.Link
+		if link, err = h.LinkByName(name); err != nil {
+			continue
+		}
+		if err := h.LinkDel(link); err != nil {
+			logrus.Warnf("Failed to delete auxiliary interface %s in sandbox %s: %v", name, sandboxKey, err)
+		}
+	}
+}
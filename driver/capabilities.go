@@ -0,0 +1,245 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/libnetwork/types"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// capability is whether the host supports one way of creating networks
+type capability struct {
+	Name      string `json:"name"`
+	Supported bool   `json:"supported"`
+	// Reason is why an unsupported capability failed its probe
+	Reason string `json:"reason,omitempty"`
+	// inconclusive is set when the probe could not run, the host may support it
+	inconclusive bool
+}
+
+// probeCapabilities tries each macvlan mode and a vlan sub-interface on a
+// throwaway dummy parent, the links are deleted again before returning
+func probeCapabilities() []*capability {
+	var caps []*capability
+	probeName := fmt.Sprintf("%scap%d", dummyPrefix, os.Getpid()%100000)
+	if err := createDummyLink(probeName, ""); err != nil {
+		reason := fmt.Sprintf("dummy link probe failed: %v", err)
+		for _, mode := range []string{modeBridge, modePrivate, modeVepa, modePassthru, "vlan"} {
+			caps = append(caps, &capability{Name: mode, Reason: reason, inconclusive: true})
+		}
+		return caps
+	}
+	defer delLink(probeName)
+	for i, mode := range []string{modeBridge, modePrivate, modeVepa, modePassthru} {
+		c := &capability{Name: mode}
+		if err := requireKernel(modeFeatures[mode]); err != nil {
+			c.Reason = err.Error()
+			caps = append(caps, c)
+			continue
+		}
+		child := fmt.Sprintf("%sm%d", probeName, i)
+		if _, err := createMacVlan(child, probeName, mode, 0); err != nil {
+			c.Reason = err.Error()
+		} else {
+			c.Supported = true
+			delLink(child)
+		}
+		caps = append(caps, c)
+	}
+	c := &capability{Name: "vlan"}
+	if err := createVlanLink(probeName + ".2"); err != nil {
+		c.Reason = err.Error()
+	} else {
+		c.Supported = true
+		delLink(probeName + ".2")
+	}
+	caps = append(caps, c)
+	logrus.Debugf("Probed %d host capabilities", len(caps))
+
+	return caps
+}
+
+// capabilityModules are the kernel modules reported with the capabilities
+var capabilityModules = []string{"macvlan", "ipvlan", "macvtap", "8021q", "dummy"}
+
+// kernel module states
+const (
+	moduleStateLoaded    = "loaded"    // in /sys/module
+	moduleStateBuiltin   = "builtin"   // compiled into the kernel
+	moduleStateAvailable = "available" // installed, loaded on first use
+	moduleStateMissing   = "missing"   // not found, the features it provides fail
+)
+
+// hostCapabilities is what the host supports, probed once at startup and
+// served on /capabilities
+type hostCapabilities struct {
+	Kernel       string            `json:"kernel,omitempty"`
+	Modules      map[string]string `json:"modules"`
+	Capabilities []*capability     `json:"capabilities"`
+	ProbedAt     string            `json:"probed_at"`
+}
+
+// probeHost reads the kernel version and module states and probes the
+// macvlan modes and vlan support
+func probeHost() *hostCapabilities {
+	host := &hostCapabilities{
+		Modules:      moduleStates(capabilityModules),
+		Capabilities: probeCapabilities(),
+		ProbedAt:     time.Now().UTC().Format(time.RFC3339),
+	}
+	if hostKernel != nil {
+		host.Kernel = hostKernel.String()
+	}
+
+	return host
+}
+
+// summary renders the capabilities on one line for the startup log
+func (host *hostCapabilities) summary() string {
+	var modules, supported []string
+	for _, name := range capabilityModules {
+		modules = append(modules, name+"="+host.Modules[name])
+	}
+	for _, c := range host.Capabilities {
+		if c.Supported {
+			supported = append(supported, c.Name)
+		}
+	}
+	kernel := host.Kernel
+	if kernel == "" {
+		kernel = "unknown"
+	}
+
+	return fmt.Sprintf("kernel %s, modules %s, supported %s", kernel, strings.Join(modules, " "), strings.Join(supported, ","))
+}
+
+// modes returns the reason each unsupported macvlan mode failed the probe
+// keyed by mode, nil when the probe could not run
+func (host *hostCapabilities) modes() map[string]string {
+	modes := make(map[string]string)
+	for _, c := range host.Capabilities {
+		if c.Name == "vlan" {
+			continue
+		}
+		if c.inconclusive {
+			logrus.Warnf("Could not probe the supported macvlan modes, only the kernel version is checked: %s", c.Reason)
+			return nil
+		}
+		modes[c.Name] = c.Reason
+	}
+
+	return modes
+}
+
+// macvlanError returns why the probe could not create a bridge mode macvlan
+// child, nil when the kernel supports macvlan links
+func (host *hostCapabilities) macvlanError() error {
+	for _, c := range host.Capabilities {
+		if c.Name == modeBridge {
+			if c.Supported {
+				return nil
+			}
+			return fmt.Errorf("%s", c.Reason)
+		}
+	}
+
+	return fmt.Errorf("macvlan links were not probed")
+}
+
+// moduleStates looks the modules up in /sys/module and the modules.builtin
+// and modules.dep lists of the running kernel
+func moduleStates(names []string) map[string]string {
+	var uts unix.Utsname
+	release := ""
+	if err := unix.Uname(&uts); err == nil {
+		release = unix.ByteSliceToString(uts.Release[:])
+	}
+	builtin := moduleList(filepath.Join("/lib/modules", release, "modules.builtin"))
+	installed := moduleList(filepath.Join("/lib/modules", release, "modules.dep"))
+	states := make(map[string]string, len(names))
+	for _, name := range names {
+		switch {
+		case moduleLoaded(name):
+			states[name] = moduleStateLoaded
+		case builtin[name]:
+			states[name] = moduleStateBuiltin
+		case installed[name]:
+			states[name] = moduleStateAvailable
+		default:
+			states[name] = moduleStateMissing
+		}
+	}
+
+	return states
+}
+
+// moduleList reads the module names of a modules.builtin or modules.dep file,
+// a missing file lists none
+func moduleList(file string) map[string]bool {
+	modules := make(map[string]bool)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return modules
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// modules.dep lines are path: deps, modules.builtin lines a path
+		path := strings.SplitN(line, ":", 2)[0]
+		base := filepath.Base(path)
+		if i := strings.Index(base, ".ko"); i > 0 {
+			modules[strings.Replace(base[:i], "-", "_", -1)] = true
+		}
+	}
+
+	return modules
+}
+
+// requireMode fails with the probed reason and the modes the kernel supports
+// when mode was refused by the startup probe
+func (d *driver) requireMode(mode string) error {
+	reason, ok := d.modes[mode]
+	if !ok || reason == "" {
+		return nil
+	}
+	var supported []string
+	for _, m := range []string{modeBridge, modePrivate, modeVepa, modePassthru} {
+		if r, ok := d.modes[m]; ok && r == "" {
+			supported = append(supported, m)
+		}
+	}
+	if len(supported) == 0 {
+		supported = []string{"none"}
+	}
+
+	return types.NotImplementedErrorf("macvlan mode %s is not supported by the running kernel, supported modes: %s (probe failed: %s)",
+		mode, strings.Join(supported, ", "), reason)
+}
+
+// WriteCapabilities probes the host and prints the kernel modules and which
+// macvlan modes and parent types it supports, for the -capabilities flag
+func WriteCapabilities(w io.Writer) error {
+	readKernelVersion()
+	host := probeHost()
+	if host.Kernel != "" {
+		fmt.Fprintf(w, "kernel %s\n", host.Kernel)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODULE\tSTATE")
+	for _, name := range capabilityModules {
+		fmt.Fprintf(tw, "%s\t%s\n", name, host.Modules[name])
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "CAPABILITY\tSUPPORTED\tREASON")
+	for _, c := range host.Capabilities {
+		fmt.Fprintf(tw, "%s\t%t\t%s\n", c.Name, c.Supported, c.Reason)
+	}
+
+	return tw.Flush()
+}
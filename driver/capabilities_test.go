@@ -0,0 +1,22 @@
+package driver
+
+import "testing"
+
+func TestMacvlanError(t *testing.T) {
+	host := &hostCapabilities{Capabilities: []*capability{
+		{Name: modeBridge, Supported: true},
+		{Name: modePassthru, Reason: "kernel too old"},
+	}}
+	if err := host.macvlanError(); err != nil {
+		t.Errorf("supported bridge mode reported: %v", err)
+	}
+
+	host.Capabilities[0] = &capability{Name: modeBridge, Reason: "dummy link probe failed: operation not supported", inconclusive: true}
+	if err := host.macvlanError(); err == nil || err.Error() != host.Capabilities[0].Reason {
+		t.Errorf("got %v, want the probe reason", err)
+	}
+
+	if err := (&hostCapabilities{}).macvlanError(); err == nil {
+		t.Error("host that was never probed reported macvlan support")
+	}
+}
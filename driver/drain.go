@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/libnetwork/types"
+	"github.com/sirupsen/logrus"
+)
+
+// drainSet holds the parents marked for maintenance, new endpoints are
+// refused on them while existing ones keep working
+type drainSet struct {
+	sync.Mutex
+	since map[string]time.Time
+}
+
+func newDrainSet() *drainSet {
+	return &drainSet{since: make(map[string]time.Time)}
+}
+
+// parentDrain is the admin api view of a parent's drain state
+type parentDrain struct {
+	Parent    string   `json:"parent"`
+	Draining  bool     `json:"draining"`
+	Since     string   `json:"since,omitempty"`
+	Networks  []string `json:"networks"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// setDrain marks or unmarks a parent as draining
+func (d *driver) setDrain(parent string, drain bool) {
+	d.drains.Lock()
+	defer d.drains.Unlock()
+	if !drain {
+		delete(d.drains.since, parent)
+		logrus.Infof("Parent %s is no longer draining", parent)
+		return
+	}
+	if _, ok := d.drains.since[parent]; !ok {
+		d.drains.since[parent] = time.Now()
+		logrus.Infof("Parent %s is draining, new endpoints are refused on it", parent)
+	}
+}
+
+// checkDrain refuses new endpoints on a draining parent
+func (d *driver) checkDrain(parent string) error {
+	d.drains.Lock()
+	defer d.drains.Unlock()
+	if since, ok := d.drains.since[parent]; ok {
+		return types.ForbiddenErrorf("parent interface %s is draining for maintenance since %s", parent, since.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// drainState reports whether a parent drains and what still uses it
+func (d *driver) drainState(parent string) *parentDrain {
+	state := &parentDrain{Parent: parent, Networks: []string{}, Endpoints: []string{}}
+	d.drains.Lock()
+	if since, ok := d.drains.since[parent]; ok {
+		state.Draining = true
+		state.Since = since.Format(time.RFC3339)
+	}
+	d.drains.Unlock()
+	for _, n := range d.getNetworks() {
+		if n.config.Parent != parent {
+			continue
+		}
+		state.Networks = append(state.Networks, n.id)
+		for _, ep := range n.getEndpoints() {
+			state.Endpoints = append(state.Endpoints, ep.id)
+		}
+	}
+	sort.Strings(state.Networks)
+	sort.Strings(state.Endpoints)
+
+	return state
+}
+
+// drainedParents lists the draining parents
+func (d *driver) drainedParents() []*parentDrain {
+	d.drains.Lock()
+	parents := make([]string, 0, len(d.drains.since))
+	for parent := range d.drains.since {
+		parents = append(parents, parent)
+	}
+	d.drains.Unlock()
+	sort.Strings(parents)
+	states := make([]*parentDrain, 0, len(parents))
+	for _, parent := range parents {
+		states = append(states, d.drainState(parent))
+	}
+
+	return states
+}
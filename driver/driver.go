@@ -1,15 +1,23 @@
 package driver
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/docker/pkg/stringid"
 	networkapi "github.com/docker/go-plugins-helpers/network"
 	"github.com/docker/libnetwork/datastore"
 	"github.com/docker/libnetwork/netlabel"
-	"github.com/docker/libnetwork/netutils"
 	"github.com/docker/libnetwork/ns"
 	"github.com/docker/libnetwork/options"
 	"github.com/docker/libnetwork/osl"
@@ -31,13 +39,176 @@ const (
 	modeBridge          = "bridge"    // macvlan mode bridge
 	modePassthru        = "passthru"  // macvlan mode passthrough
 	parentOpt           = "parent"    // parent interface -o parent
+	parentAuto          = "auto"      // -o parent=auto picks the interface of the default route
 	modeOpt             = "_mode"     // macvlan mode ux opt suffix
+	driverScope         = datastore.LocalScope
 )
 
+// network driver options, passed with docker network create -o
+const (
+	disableIPv6Opt = "disable_ipv6"   // disable ipv6 on the container interfaces
+	gatewayOpt     = "gateway"        // container gateway, auto, none or an ipv4 address
+	gatewayAuto    = "auto"           // use the parent's address as the gateway
+	gatewayNone    = "none"           // explicitly no gateway, the same as unset
+	ifaceFlagsOpt  = "iface_flags"    // comma separated link flags set on the macvlan child
+	mtuOpt         = "macvlan_mtu"    // mtu of the macvlan children
+	dstPrefixOpt   = "dst_prefix"     // container interface name prefix, docker appends an index
+	promiscOpt     = "parent_promisc" // put the parent in promiscuous mode while the network exists
+	detachOnlyOpt  = "detach_only"    // network delete forgets the network but leaves its links on the host
+	proxyARPOpt    = "proxy_arp"      // enable proxy arp on the parent while the network exists
+	proxyNDPOpt    = "proxy_ndp"      // enable proxy ndp on the parent while the network exists
+	requireMacOpt  = "require_mac"    // fail endpoint creation without a user supplied MAC
+	stableMacOpt   = "stable_mac"     // set the stored MAC on the macvlan child on every join
+	macAllowOpt    = "mac_allowlist"  // comma separated MACs endpoints may use, generated MACs are refused
+	scopeOpt       = "scope"          // intended scope of the network, it must match the driver scope
+	leaveActionOpt = "leave_action"   // what Leave does with the host side child, delete, down or keep
+	leaveDelete    = "delete"         // delete the child on leave, recreated by the next join
+	leaveDown      = "down"           // keep the child on the host, set down until the next join
+	leaveKeep      = "keep"           // keep the child on the host as it is
+
+	gwServiceOpt = "disable_gateway_service" // override -disable-gateway-service for the network
+)
+
+// parent conflict policies, set with -parent-policy
+const (
+	parentPolicyStrict    = "strict"     // a parent is used by a single network
+	parentPolicyAllowVlan = "allow-vlan" // a physical parent may be shared on different vlans
+	parentPolicyShared    = "shared"     // any parent but a passthru one may be shared
+)
+
+// types of the parent links the driver creates, recorded with the owning network
+const (
+	parentLinkDummy = "dummy" // dummy parent of a network created without -o parent
+	parentLinkVlan  = "vlan"  // iface.vlan sub-interface
+)
+
+// endpoint driver options, passed with docker network connect --driver-opt
+const (
+	containerNameOpt = "container_name" // container name used as the host interface alias
+	srcNameOpt       = "src_name"       // fixed host interface name of the macvlan child, for debugging
+)
+
+// Options carries the driver-wide settings taken from the plugin command line
+type Options struct {
+	// Version is the plugin build version reported by the admin endpoint
+	Version string
+	// Workers bounds concurrent plugin api calls, GOMAXPROCS when not positive
+	Workers int
+	// NetlinkRcvBuf is the netlink socket receive buffer size in bytes, kernel default when zero
+	NetlinkRcvBuf int
+	// DisableIPv6 disables ipv6 on the container interfaces of every network
+	DisableIPv6 bool
+	// StoreRecover is the unreadable store policy, fail or reset
+	StoreRecover string
+	// GlobalMacUniqueness checks endpoint MACs across all networks instead of per network
+	GlobalMacUniqueness bool
+	// PeerSync is the /store-sync url of a primary, this instance runs as a warm standby when set
+	PeerSync string
+	// PeerSyncInterval is how often the standby pulls the primary's snapshot
+	PeerSyncInterval time.Duration
+	// LogRequests dumps plugin api requests and responses as json at debug level
+	LogRequests bool
+	// HookScript is executed on endpoint create, delete, join and leave when set
+	HookScript string
+	// HookTimeout bounds a single hook script run
+	HookTimeout time.Duration
+	// HookFail fails the operation when the hook script exits non-zero
+	HookFail bool
+	// IfnameTemplate names host macvlan children from {parent}, {network} and {endpoint}, random when empty
+	IfnameTemplate string
+	// StrictMTU fails instead of clamping when -o macvlan_mtu exceeds the parent mtu,
+	// and instead of warning when it leaves no room for a vlan tag
+	StrictMTU bool
+	// LenientIPAM ignores an ipv4 pool from the default ipam driver instead of rejecting the network
+	LenientIPAM bool
+	// StoreSync writes every store update to disk immediately, batched when false
+	StoreSync bool
+	// StoreFlushInterval is how often batched store updates are written out
+	StoreFlushInterval time.Duration
+	// RestoreAsSuccess answers CreateNetwork for an already restored network with success instead of a maskable error
+	RestoreAsSuccess bool
+	// RequireCarrier fails CreateEndpoint when the parent has no carrier instead of warning
+	RequireCarrier bool
+	// ParentPolicy decides when networks may share a parent, strict, allow-vlan or shared
+	ParentPolicy string
+	// DefaultParent is the parent of networks created without -o parent, a dummy link when empty
+	DefaultParent string
+	// NoDummyFallback fails network creation when DefaultParent is missing instead of using a dummy link
+	NoDummyFallback bool
+	// ForceParentDelete deletes a driver created parent even while other interfaces are attached to it
+	ForceParentDelete bool
+	// MacFormat is the MAC representation in api responses, colon, colon-upper, dash or dash-upper
+	MacFormat string
+	// ProfileDir holds the <name>.json network profiles selected with -o profile
+	ProfileDir string
+	// RequireMacvlan fails startup when the kernel can't create macvlan links
+	RequireMacvlan bool
+	// ReservedParents are interface names, or prefixes ending in *, refused as parents on top of lo and docker's bridges
+	ReservedParents []string
+	// ParentDeleteGrace delays deleting driver created vlan parents so a quickly recreated network reuses them
+	ParentDeleteGrace time.Duration
+	// AdminPing enables the privileged POST /endpoints/{id}/ping reachability check
+	AdminPing bool
+	// DummyIDLen is how many network id characters name a dummy parent, 12 to 14, 12 when zero
+	DummyIDLen int
+	// WirelessParent is reject or warn, what to do with a wireless parent
+	WirelessParent string
+	// AllowedPools are the ipv4 pools accepted from the ipam driver, 0.0.0.0/0 when empty
+	AllowedPools []string
+	// AutoHealEndpoints recreates joined endpoint interfaces deleted out of band
+	AutoHealEndpoints bool
+	// StatsdAddr is the udp address of a statsd server the metrics are pushed to
+	StatsdAddr string
+	// Maintenance starts the driver with background link repairs paused
+	Maintenance bool
+	// NetworksManifest is a json file of networks created at startup when missing
+	NetworksManifest string
+	// GatewayService lets docker give containers without a gateway the gateway
+	// service by default, -o disable_gateway_service overrides it per network
+	GatewayService bool
+	// StrictOptions fails network creation on unknown -o keys instead of ignoring them
+	StrictOptions bool
+	// MacGenerator is libnetwork or builtin, what generates endpoint MACs
+	MacGenerator string
+	// AsyncRestore serves the plugin api while the store is restored in the background
+	AsyncRestore bool
+	// NotReady is queue or reject, what plugin api calls do before the restore completes
+	NotReady string
+	// AllowRehome enables moving the endpoints of a network to a new parent on the admin api
+	AllowRehome bool
+	// AdminWrite enables the admin api calls that change driver or host state, ex. drain, label and mac
+	AdminWrite bool
+	// PeerSyncTLS is the client tls config of an https PeerSync url
+	PeerSyncTLS *tls.Config
+}
+
 type driver struct {
 	sync.Mutex
 	networks networkTable
 	store    datastore.DataStore
+	opts     Options
+	workers  *workerPool
+	// batchMu guards batch, swapped by batchStoreWrites while the restore runs
+	batchMu sync.Mutex
+	batch   *storeBatch
+	// macMu makes a MAC uniqueness check and the endpoint add or MAC change it allows atomic
+	macMu    sync.Mutex
+	started  time.Time
+	counters opCounters
+	drains   *drainSet
+	grace    *parentGrace
+	netStats *netStatsCache
+	latency  *opLatencies
+	manifest *manifestResult
+	// caps is the startup probe of the host, modes why each macvlan mode failed it, empty when supported
+	caps  *hostCapabilities
+	modes map[string]string
+	// restore records how the store was restored at startup
+	restore restoreStatus
+	// ready is set once the startup restore completed
+	ready *readiness
+	// maintenance is 1 while background link repairs are paused
+	maintenance int32
 }
 
 type endpointTable map[string]*endpoint
@@ -45,12 +216,23 @@ type endpointTable map[string]*endpoint
 type networkTable map[string]*network
 
 type endpoint struct {
-	id       string
-	nid      string
-	mac      net.HardwareAddr
-	srcName  string
+	id            string
+	nid           string
+	mac           net.HardwareAddr
+	srcName       string
+	auxNames      []string
+	childIndex    int
+	sandboxKey    string
+	containerName string
+	joinedAt      time.Time
+	leftAt        time.Time
+	// leaving is set by Leave and cleared by the next Join, auto heal skips the endpoint
+	leaving  bool
 	dbIndex  uint64
 	dbExists bool
+	// the link and sandbox fields are changed under the endpoint lock, Join,
+	// Leave, auto heal and the admin actions on one endpoint don't interleave
+	sync.Mutex
 }
 
 type network struct {
@@ -59,28 +241,127 @@ type network struct {
 	endpoints endpointTable
 	driver    *driver
 	config    *configuration
+	// rate is the -o endpoint_rate bucket, created on the first endpoint
+	rate *tokenBucket
 	sync.Mutex
 }
 
-func NewDriver() (*driver, error) {
+func NewDriver(opts Options) (*driver, error) {
 	d := &driver{
 		networks: make(networkTable),
+		opts:     opts,
+		workers:  newWorkerPool(opts.Workers),
+		started:  time.Now(),
+		drains:   newDrainSet(),
+		grace:    newParentGrace(),
+		netStats: &netStatsCache{},
+		latency:  &opLatencies{ops: make(map[string]*opLatency)},
+		ready:    newReadiness(),
 	}
-	err := d.initStore()
-	logrus.Errorf("%s", err)
-
-	if d.store == nil {
-		logrus.Error("Store not initialized")
-	} else {
-		logrus.Info("Store is initialized")
+	if opts.IfnameTemplate != "" {
+		if err := validateIfnameTemplate(opts.IfnameTemplate); err != nil {
+			return nil, err
+		}
+	}
+	readKernelVersion()
+	d.caps = probeHost()
+	logrus.Infof("Host capabilities: %s", d.caps.summary())
+	d.modes = d.caps.modes()
+	for _, pool := range opts.AllowedPools {
+		if _, _, err := net.ParseCIDR(pool); err != nil {
+			return nil, fmt.Errorf("invalid allowed ipv4 pool %q: %v", pool, err)
+		}
+	}
+	if opts.DummyIDLen != 0 {
+		if opts.DummyIDLen < minDummyIDLen || opts.DummyIDLen > maxDummyIDLen {
+			return nil, fmt.Errorf("invalid dummy id length %d, expected %d to %d to fit the kernel interface name limit",
+				opts.DummyIDLen, minDummyIDLen, maxDummyIDLen)
+		}
+		dummyIDLen = opts.DummyIDLen
+	}
+	if opts.ProfileDir != "" {
+		if err := loadProfiles(opts.ProfileDir); err != nil {
+			return nil, err
+		}
+	}
+	if err := setMacGenerator(opts.MacGenerator); err != nil {
+		return nil, err
+	}
+	if err := validateNotReady(opts.NotReady); err != nil {
+		return nil, err
+	}
+	// a hook given no time to run would fail every endpoint call
+	if opts.HookScript != "" && opts.HookTimeout <= 0 {
+		return nil, fmt.Errorf("invalid hook timeout %s, it must be positive", opts.HookTimeout)
+	}
+	if opts.NetlinkRcvBuf > 0 {
+		netlinkRcvBufSize = opts.NetlinkRcvBuf
+		setNetlinkRcvBuf(ns.NlHandle())
+	}
+	if opts.RequireMacvlan {
+		if err := d.caps.macvlanError(); err != nil {
+			return nil, fmt.Errorf("kernel macvlan support is missing, load the macvlan module (modprobe macvlan): %v", err)
+		}
+		logrus.Info("Kernel macvlan support is available")
+	}
+	if opts.AsyncRestore {
+		go func() {
+			if err := d.restoreState(); err != nil {
+				logrus.WithError(err).Fatal("Failed to restore the macvlan driver state")
+			}
+		}()
+		return d, nil
+	}
+	if err := d.restoreState(); err != nil {
+		return nil, err
 	}
 
 	return d, nil
 }
 
+// restoreState restores the store and starts the background work that needs
+// it, the plugin api calls held back by the readiness gate proceed once it returns
+func (d *driver) restoreState() error {
+	opts := d.opts
+	// the restore below already holds back its link repairs in maintenance mode
+	d.setMaintenance(opts.Maintenance)
+	if err := d.initStore(); err != nil {
+		return err
+	}
+	logrus.Info("Store is initialized")
+	if opts.NetworksManifest != "" {
+		result, err := d.applyManifest(opts.NetworksManifest)
+		if err != nil {
+			return err
+		}
+		d.manifest = result
+	}
+	if !opts.StoreSync {
+		// batched writes trade durability for speed, a crash loses up to one interval
+		d.batchMu.Lock()
+		d.batch = newStoreBatch()
+		d.batchMu.Unlock()
+		go d.runStoreFlush(opts.StoreFlushInterval)
+		logrus.Warnf("Store writes are batched, flushed every %s", opts.StoreFlushInterval)
+	}
+	if opts.StatsdAddr != "" {
+		go d.runStatsd(opts.StatsdAddr, statsdInterval)
+	}
+	d.ready.set()
+	// link repairs start once the restore is complete, like the admin api changes
+	if opts.AutoHealEndpoints {
+		go d.runAutoHeal(healInterval)
+	}
+	if opts.PeerSync != "" {
+		go d.runPeerSync(opts.PeerSync, opts.PeerSyncInterval)
+	}
+
+	return nil
+}
+
 func (d *driver) GetCapabilities() (*networkapi.CapabilitiesResponse, error) {
 	logrus.Infof("Handling GetCapabilities")
-	return &networkapi.CapabilitiesResponse{Scope: "local"}, nil
+	return &networkapi.CapabilitiesResponse{Scope: driverScope}, nil
 }
 
 func (d *driver) AllocateNetwork(allocateNetworkRequest *networkapi.AllocateNetworkRequest) (*networkapi.AllocateNetworkResponse, error) {
@@ -93,59 +374,105 @@ func (d *driver) FreeNetwork(freeNetworkRequest *networkapi.FreeNetworkRequest)
 	return nil
 }
 
+// CreateNetwork creates a network, or reports a network with the same id already
+// restored from the store as a maskable error, a plain success with RestoreAsSuccess.
+// Only the message of a plugin error reaches docker, the maskable type is lost on
+// the wire, so docker versions that don't match the message surface "restoring
+// existing network" to users.
 func (d *driver) CreateNetwork(req *networkapi.CreateNetworkRequest) error {
-	logrus.Infof("Handling CreateNetwork %s", req)
+	logrus.Infof("Handling CreateNetwork %+v", req)
 	defer osl.InitOSContext()()
 
-	// reject a non null v4 network
-	if len(req.IPv4Data) != 0 && req.IPv4Data[0].Pool != "0.0.0.0/0" {
-		return fmt.Errorf("ipv4 pool is not empty")
+	// reject a non null v4 network, or ignore the pool docker assigned with -lenient-ipam
+	if len(req.IPv4Data) != 0 && !d.allowedPool(req.IPv4Data[0].Pool) {
+		if !d.opts.LenientIPAM {
+			return withCode(codeIPAMPool, fmt.Errorf("ipv4 pool %s is not empty, %s does no address management, create the network with --ipam-driver null",
+				req.IPv4Data[0].Pool, networkType))
+		}
+		logrus.Warnf("Ignoring ipv4 pool %s of network %s, %s does no address management, use --ipam-driver null",
+			req.IPv4Data[0].Pool, req.NetworkID, networkType)
 	}
 	// parse and validate the config and bind to networkConfiguration
 	config, err := parseNetworkOptions(req.NetworkID, req.Options)
 	if err != nil {
-		return err
+		return withCode(codeInvalidOption, err)
 	}
 	config.ID = req.NetworkID
+	if d.opts.StrictOptions && len(config.unknownOpts) > 0 {
+		return withCode(codeInvalidOption, types.BadRequestErrorf("unknown network options %s, refused by -strict-options",
+			strings.Join(config.unknownOpts, ", ")))
+	}
 
-	// verify the macvlan mode from -o macvlan_mode option
-	switch config.MacvlanMode {
-	case "", modeBridge:
-		// default to macvlan bridge mode if -o macvlan_mode is empty
-		config.MacvlanMode = modeBridge
-	case modePrivate:
-		config.MacvlanMode = modePrivate
-	case modePassthru:
-		config.MacvlanMode = modePassthru
-	case modeVepa:
-		config.MacvlanMode = modeVepa
-	default:
-		return fmt.Errorf("requested macvlan mode '%s' is not valid, 'bridge' mode is the macvlan driver default", config.MacvlanMode)
+	if err := d.validateNetworkConfig(config); err != nil {
+		return err
 	}
-	// loopback is not a valid parent link
-	if config.Parent == "lo" {
-		return fmt.Errorf("loopback interface is not a valid %s parent link", macvlanType)
+	// echo how the options were interpreted, whichever format docker passed them
+	// in, with the parent validation resolved
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		if b, err := json.Marshal(config); err == nil {
+			logrus.Debugf("Resolved configuration of network %s: %s", config.ID, b)
+		}
 	}
-	// if parent interface not specified, create a dummy type link to use named dummy+net_id
-	if config.Parent == "" {
-		config.Parent = getDummyName(stringid.TruncateID(config.ID))
+	// a restored network keeps its config, refuse options that would not take effect
+	if existing, err := d.getNetwork(config.ID); err == nil {
+		if diff := configDiff(existing.config, config); len(diff) > 0 {
+			return withCode(codeConfigMismatch, types.ForbiddenErrorf("network %s exists with different configuration: %s",
+				config.ID, strings.Join(diff, ", ")))
+		}
 	}
 	foundExisting, err := d.createNetwork(config)
 	if err != nil {
-		return err
+		return withCode(codeHostSetup, err)
 	}
 
 	if foundExisting {
+		// the network was already restored from the store, docker gets a maskable
+		// error it doesn't surface to users, or success with -restore-as-success
+		logrus.Infof("Network %.7s already exists on parent %s, keeping the restored network", config.ID, config.Parent)
+		if d.opts.RestoreAsSuccess {
+			return nil
+		}
 		return types.InternalMaskableErrorf("restoring existing network %s", config.ID)
 	}
+	if _, err := d.childMTU(config); err != nil {
+		d.deleteNetwork(config.ID)
+		if config.CreatedSlaveLink {
+			delParentLink(config)
+		}
+		return withCode(codeMTU, err)
+	}
+	if config.ParentPromisc {
+		if err := d.acquirePromisc(config); err != nil {
+			d.deleteNetwork(config.ID)
+			if config.CreatedSlaveLink {
+				delParentLink(config)
+			}
+			return withCode(codeHostSetup, err)
+		}
+	}
+	if err := d.acquireParentSysctls(config); err != nil {
+		d.releaseParentSysctls(config)
+		d.releasePromisc(config)
+		d.deleteNetwork(config.ID)
+		if config.CreatedSlaveLink {
+			delParentLink(config)
+		}
+		return withCode(codeHostSetup, err)
+	}
 
 	// update persistent db, rollback on fail
 	err = d.storeUpdate(config)
 	if err != nil {
+		d.releaseParentSysctls(config)
+		d.releasePromisc(config)
 		d.deleteNetwork(config.ID)
+		if config.CreatedSlaveLink {
+			delParentLink(config)
+		}
 		logrus.Debugf("encountered an error rolling back a network create for %s : %v", config.ID, err)
-		return err
+		return withCode(codeStore, err)
 	}
+	atomic.AddInt64(&d.counters.networksCreated, 1)
 
 	return nil
 }
@@ -153,38 +480,29 @@ func (d *driver) CreateNetwork(req *networkapi.CreateNetworkRequest) error {
 func (d *driver) DeleteNetwork(req *networkapi.DeleteNetworkRequest) error {
 	logrus.Infof("Handling DeleteNetwork %s", req)
 	defer osl.InitOSContext()()
-	n := d.network(req.NetworkID)
-	if n == nil {
-		return fmt.Errorf("network id %s not found", req.NetworkID)
-	}
-	// if the driver created the slave interface, delete it, otherwise leave it
-	if ok := n.config.CreatedSlaveLink; ok {
-		// if the interface exists, only delete if it matches iface.vlan or dummy.net_id naming
-		if ok := parentExists(n.config.Parent); ok {
-			// only delete the link if it is named the net_id
-			if n.config.Parent == getDummyName(stringid.TruncateID(req.NetworkID)) {
-				err := delDummyLink(n.config.Parent)
-				if err != nil {
-					logrus.Debugf("link %s was not deleted, continuing the delete network operation: %v",
-						n.config.Parent, err)
-				}
-			} else {
-				// only delete the link if it matches iface.vlan naming
-				err := delVlanLink(n.config.Parent)
-				if err != nil {
-					logrus.Debugf("link %s was not deleted, continuing the delete network operation: %v",
-						n.config.Parent, err)
-				}
-			}
+	n, err := d.getNetwork(req.NetworkID)
+	if err != nil {
+		if _, ok := err.(types.NotFoundError); !ok {
+			return err
 		}
+		// a retry after a partial failure, the links are gone but records may remain
+		logrus.Debugf("Network %s already removed, finishing store cleanup", req.NetworkID)
+		return d.storeDeleteNetwork(req.NetworkID)
 	}
-	for _, ep := range n.endpoints {
-		if link, err := ns.NlHandle().LinkByName(ep.srcName); err == nil {
-			if err := ns.NlHandle().LinkDel(link); err != nil {
-				logrus.WithError(err).Warnf("Failed to delete interface (%s)'s link on endpoint (%s) delete", ep.srcName, ep.id)
-			}
+	eps := n.getEndpoints()
+	var leftover error
+	if n.config.DetachOnly {
+		// nothing the driver created is removed, and nothing will clean it up later
+		logrus.Warnf("Detaching network %.7s, leaving parent %s and %d endpoint interfaces on the host",
+			req.NetworkID, n.config.Parent, len(eps))
+	} else {
+		if err := d.teardownLinks(n, eps); err != nil {
+			return err
 		}
-
+		leftover = d.verifyTeardown(n, eps)
+	}
+	// the store records are removed serially to keep the store consistent
+	for _, ep := range eps {
 		if err := d.storeDelete(ep); err != nil {
 			logrus.Warnf("Failed to remove macvlan endpoint %.7s from store: %v", ep.id, err)
 		}
@@ -192,10 +510,60 @@ func (d *driver) DeleteNetwork(req *networkapi.DeleteNetworkRequest) error {
 	// delete the *network
 	d.deleteNetwork(req.NetworkID)
 	// delete the network record from persistent cache
-	err := d.storeDelete(n.config)
+	err = d.storeDelete(n.config)
 	if err != nil {
 		return fmt.Errorf("error deleting deleting id %s from datastore: %v", req.NetworkID, err)
 	}
+	atomic.AddInt64(&d.counters.networksDeleted, 1)
+	atomic.AddInt64(&d.counters.endpointsDeleted, int64(len(eps)))
+
+	// the network is gone from the driver either way, the links left behind show on /links
+	return leftover
+}
+
+// teardownLinks deletes a network's macvlan children in parallel, then its parent
+// and the parent settings the driver made. A driver created parent that has
+// children other than the network's own fails the delete before anything is
+// removed, unless ForceParentDelete is set.
+func (d *driver) teardownLinks(n *network, eps []*endpoint) error {
+	var heir *configuration
+	if n.config.CreatedSlaveLink {
+		if users := d.parentUsers(n.config); len(users) > 0 {
+			heir = users[0].config
+		} else if !d.opts.ForceParentDelete {
+			children, err := foreignChildren(n.config.Parent, eps)
+			if err != nil {
+				return err
+			}
+			if len(children) > 0 {
+				logrus.Warnf("Not deleting network %.7s, interfaces %s are still attached to its parent %s",
+					n.id, strings.Join(children, ", "), n.config.Parent)
+				return types.ForbiddenErrorf("parent interface %s still has interfaces %s attached, remove them or restart with -force-parent-delete",
+					n.config.Parent, strings.Join(children, ", "))
+			}
+		}
+	}
+	if err := deleteEndpointLinks(eps); err != nil {
+		logrus.Warnf("Network %.7s teardown: %v", n.id, err)
+	}
+	d.releasePromisc(n.config)
+	d.releaseParentSysctls(n.config)
+	// if the driver created the slave interface, delete it, otherwise leave it.
+	// A parent still shared by another network is handed over to that network.
+	if n.config.CreatedSlaveLink {
+		if heir != nil {
+			// the heir's id doesn't name the link, it deletes it by the recorded type
+			heir.CreatedSlaveLink = true
+			heir.CreatedLinkType = n.config.parentLinkType()
+			if err := d.storeUpdate(heir); err != nil {
+				logrus.Warnf("Failed to hand parent %s over to network %.7s: %v", heir.Parent, heir.ID, err)
+			}
+			logrus.Infof("Keeping parent %s, still used by network %.7s", heir.Parent, heir.ID)
+			return nil
+		}
+		d.deleteParentLater(n.config)
+	}
+
 	return nil
 }
 
@@ -210,25 +578,62 @@ func (d *driver) CreateEndpoint(req *networkapi.CreateEndpointRequest) (*network
 	if err != nil {
 		return nil, fmt.Errorf("network id %q not found", req.NetworkID)
 	}
+	// docker sends the requested MAC in its text form, empty when none was requested
+	var requestedMac net.HardwareAddr
+	if req.Interface != nil && req.Interface.MacAddress != "" {
+		if requestedMac, err = net.ParseMAC(req.Interface.MacAddress); err != nil {
+			return nil, types.BadRequestErrorf("invalid MAC address %q for endpoint %.7s: %v", req.Interface.MacAddress, req.EndpointID, err)
+		}
+	}
 	ep := &endpoint{
 		id:  req.EndpointID,
 		nid: req.NetworkID,
-		mac: net.HardwareAddr(req.Interface.MacAddress),
+		mac: requestedMac,
 	}
-
-	if ep.mac == nil {
-		ep.mac = netutils.GenerateMACFromIP(nil)
+	if name, ok := req.Options[containerNameOpt].(string); ok {
+		ep.containerName = name
 	}
 
-	if err := d.storeUpdate(ep); err != nil {
-		return nil, fmt.Errorf("failed to save macvlan endpoint %.7s to store: %v", ep.id, err)
+	if ep.mac, err = endpointMac(n.config, ep.mac); err != nil {
+		return nil, err
+	}
+	// a duplicate is refused before the hook runs, addUniqueEndpoint checks again
+	if err := d.checkMacUnique(n, ep.id, ep.mac); err != nil {
+		return nil, err
+	}
+	if err := d.checkDrain(n.config.Parent); err != nil {
+		return nil, err
+	}
+	if err := d.checkCarrier(n.config.Parent); err != nil {
+		return nil, err
+	}
+	if err := n.checkEndpointRate(); err != nil {
+		return nil, err
+	}
+	created := false
+	defer func() {
+		// only created endpoints count against -o endpoint_rate
+		if !created {
+			n.returnEndpointRate()
+		}
+	}()
+	if err := d.runHook(hookCreateEndpoint, ep); err != nil {
+		return nil, err
 	}
 
-	n.addEndpoint(ep)
+	if err := d.addUniqueEndpoint(n, ep); err != nil {
+		// the create hook already ran, the delete hook undoes it
+		if err := d.runHook(hookDeleteEndpoint, ep); err != nil {
+			logrus.Warn(err)
+		}
+		return nil, err
+	}
+	created = true
+	atomic.AddInt64(&d.counters.endpointsCreated, 1)
 
 	return &networkapi.CreateEndpointResponse{
 		Interface: &networkapi.EndpointInterface{
-			MacAddress: ep.mac.String(),
+			MacAddress: d.formatMac(ep.mac),
 		},
 	}, nil
 }
@@ -248,6 +653,9 @@ func (d *driver) DeleteEndpoint(req *networkapi.DeleteEndpointRequest) error {
 	if ep == nil {
 		return fmt.Errorf("endpoint id %q not found", req.EndpointID)
 	}
+	if err := d.runHook(hookDeleteEndpoint, ep); err != nil {
+		return err
+	}
 	if link, err := ns.NlHandle().LinkByName(ep.srcName); err == nil {
 		if err := ns.NlHandle().LinkDel(link); err != nil {
 			logrus.WithError(err).Warnf("Failed to delete interface (%s)'s link on endpoint (%s) delete", ep.srcName, ep.id)
@@ -259,13 +667,67 @@ func (d *driver) DeleteEndpoint(req *networkapi.DeleteEndpointRequest) error {
 	}
 
 	n.deleteEndpoint(ep.id)
+	atomic.AddInt64(&d.counters.endpointsDeleted, 1)
 
 	return nil
 }
 
-func (d *driver) EndpointInfo(infoRequest *networkapi.InfoRequest) (*networkapi.InfoResponse, error) {
+// EndpointInfo reports the endpoint in docker inspect. The keys are stable:
+// mode, scope and parent always, ifindex, host_ifname, requested_parent, sandbox_id,
+// sandbox_gone, container_name, network_label, joined_at and left_at when known, and tc_* with
+// a rate limiting qdisc. host_ifname is the name of the child created on the
+// host, docker renames it once moved into the sandbox.
+func (d *driver) EndpointInfo(req *networkapi.InfoRequest) (*networkapi.InfoResponse, error) {
 	logrus.Infof("Handling EndpointInfo")
-	return nil, nil
+	n, err := d.getNetwork(req.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	ep := n.endpoint(req.EndpointID)
+	if ep == nil {
+		return nil, fmt.Errorf("could not find endpoint with id %s", req.EndpointID)
+	}
+	value := make(map[string]string)
+	if index, err := endpointIfindex(ep); err != nil {
+		logrus.Debugf("Failed to read the ifindex of endpoint %.7s: %v", ep.id, err)
+	} else if index != 0 {
+		value["ifindex"] = strconv.Itoa(index)
+	}
+	value["mode"] = n.config.MacvlanMode
+	value["scope"] = n.config.Scope
+	value["parent"] = n.config.Parent
+	if ep.srcName != "" {
+		value["host_ifname"] = ep.srcName
+	}
+	if id := ep.sandboxID(); id != "" {
+		value["sandbox_id"] = id
+		if ep.sandboxGone() {
+			value["sandbox_gone"] = "true"
+		}
+	}
+	if ep.containerName != "" {
+		value["container_name"] = ep.containerName
+	}
+	if n.config.Label != "" {
+		value["network_label"] = n.config.Label
+	}
+	if n.config.RequestedParent != n.config.Parent {
+		value["requested_parent"] = n.config.RequestedParent
+	}
+	if !ep.joinedAt.IsZero() {
+		value["joined_at"] = ep.joinedAt.Format(time.RFC3339)
+	}
+	if !ep.leftAt.IsZero() {
+		value["left_at"] = ep.leftAt.Format(time.RFC3339)
+	}
+	// tc counters are only reported when a rate limiting qdisc is attached
+	if stats, err := endpointQdiscStats(ep); err != nil {
+		logrus.Debugf("Failed to read qdisc stats of endpoint %.7s: %v", ep.id, err)
+	} else if stats != nil {
+		stats.infoValues(value)
+	}
+
+	return &networkapi.InfoResponse{Value: value}, nil
 }
 
 func (d *driver) Join(req *networkapi.JoinRequest) (*networkapi.JoinResponse, error) {
@@ -280,22 +742,90 @@ func (d *driver) Join(req *networkapi.JoinRequest) (*networkapi.JoinResponse, er
 	if endpoint == nil {
 		return nil, fmt.Errorf("could not find endpoint with id %s", req.EndpointID)
 	}
-	// generate a name for the iface that will be renamed to eth0 in the sbox
-	containerIfName, err := netutils.GenerateIfaceName(ns.NlHandle(), vethPrefix, vethLen)
-	if err != nil {
-		return nil, fmt.Errorf("error generating an interface name: %s", err)
+	endpoint.Lock()
+	defer endpoint.Unlock()
+	if err := validateSandboxKey(req.SandboxKey); err != nil {
+		return nil, types.BadRequestErrorf("invalid sandbox for endpoint %.7s: %v", req.EndpointID, err)
 	}
-	// create the netlink macvlan interface
-	vethName, err := createMacVlan(containerIfName, n.config.Parent, n.config.MacvlanMode)
-	if err != nil {
-		return nil, err
+	var (
+		vethName string
+		created  bool
+	)
+	if n.config.LeaveAction != leaveDelete && endpoint.srcName != "" && parentExists(endpoint.srcName) {
+		// the child kept on the host by the last leave is joined again, it
+		// already holds its name
+		logrus.Debugf("Reusing interface %s kept by -o %s=%s for endpoint %.7s", endpoint.srcName, leaveActionOpt, n.config.LeaveAction, endpoint.id)
+		vethName = endpoint.srcName
+	} else {
+		// pick a name for the iface that will be renamed to eth0 in the sbox
+		srcName, _ := req.Options[srcNameOpt].(string)
+		containerIfName, err := d.hostIfaceName(n, endpoint, srcName)
+		if err != nil {
+			return nil, err
+		}
+		// create the netlink macvlan interface
+		mtu, err := d.childMTU(n.config)
+		if err != nil {
+			return nil, err
+		}
+		if vethName, err = createMacVlanQueues(containerIfName, n.config.Parent, n.config.MacvlanMode, mtu,
+			n.config.RxQueues, n.config.TxQueues); err != nil {
+			return nil, err
+		}
+		created = true
+	}
+	// docker fails the join on any error from here on, don't leave the links
+	// it made or the endpoint state auto heal would act on
+	joined := false
+	defer func() {
+		if joined {
+			return
+		}
+		d.leaveAuxIfaces(endpoint.auxNames, req.SandboxKey)
+		if created {
+			delLink(vethName)
+			endpoint.srcName = ""
+		}
+		endpoint.sandboxKey, endpoint.auxNames = "", nil
+	}()
+	if n.config.RpsCpus != "" {
+		setRpsCpus(vethName, n.config.RpsCpus)
 	}
 	// bind the generated iface name to the endpoint
 	endpoint.srcName = vethName
+	endpoint.sandboxKey = req.SandboxKey
+	endpoint.leaving = false
+	if name, ok := req.Options[containerNameOpt].(string); ok && name != "" {
+		endpoint.containerName = name
+	}
+	// tag the host interface so ip link shows which container it belongs to
+	if err := setLinkAlias(vethName, endpoint.alias()); err != nil {
+		logrus.Warnf("Failed to set the alias of interface %s for endpoint %.7s: %v", vethName, endpoint.id, err)
+	}
+	if len(n.config.IfaceFlags) > 0 {
+		if err := setLinkFlags(vethName, n.config.IfaceFlags); err != nil {
+			return nil, err
+		}
+	}
+	// the child is recreated on every join, pin the stored mac on it
+	if n.config.StableMac && endpoint.mac != nil {
+		if err := setLinkMac(vethName, endpoint.mac); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.joinAuxIfaces(n, endpoint, req.SandboxKey); err != nil {
+		return nil, err
+	}
+	if err := d.runHook(hookJoin, endpoint); err != nil {
+		return nil, err
+	}
 	ep := n.endpoint(req.EndpointID)
 	if ep == nil {
 		return nil, fmt.Errorf("could not find endpoint with id %s", req.EndpointID)
 	}
+	// a re-join restarts the attachment time
+	ep.joinedAt = time.Now()
+	ep.leftAt = time.Time{}
 
 	/*iNames := jinfo.InterfaceName()
 	err = iNames.SetNames(vethName, containerVethPrefix)
@@ -305,14 +835,44 @@ func (d *driver) Join(req *networkapi.JoinRequest) (*networkapi.JoinResponse, er
 	if err := d.storeUpdate(ep); err != nil {
 		return nil, fmt.Errorf("failed to save macvlan endpoint %.7s to store: %v", ep.id, err)
 	}
+	joined = true
+	// ipv6 device settings reset when docker moves the link, apply them in the
+	// sandbox once the join can no longer fail and roll the child back
+	if d.opts.DisableIPv6 || n.config.DisableIPv6 {
+		go disableSandboxIPv6(req.SandboxKey, endpoint.mac)
+	}
+	if n.config.hasQoS() {
+		go applySandboxQoS(req.SandboxKey, endpoint.mac, n.config)
+	}
+	d.checkDstPrefix(n, ep)
+	logrus.Infof("Endpoint %.7s joined with host interface %s on parent %s", ep.id, vethName, n.config.Parent)
 
-	return &networkapi.JoinResponse{
+	resp := &networkapi.JoinResponse{
 		InterfaceName: networkapi.InterfaceName{
 			SrcName:   vethName,
-			DstPrefix: containerVethPrefix,
+			DstPrefix: n.config.dstPrefix(),
 		},
-		DisableGatewayService: true,
-	}, nil
+		DisableGatewayService: d.disableGatewayService(n.config),
+	}
+	// a gateway always needs the gateway service, whatever the defaults say
+	switch n.config.Gateway {
+	case "", gatewayNone:
+	case gatewayAuto:
+		gw, err := parentIPv4(n.config.Parent)
+		if err != nil {
+			logrus.Warnf("No gateway for endpoint %.7s, failed to read the address of parent %s: %v", ep.id, n.config.Parent, err)
+		} else if gw != nil {
+			resp.Gateway = gw.String()
+			resp.DisableGatewayService = false
+		} else {
+			logrus.Debugf("Parent %s has no ipv4 address, no gateway for endpoint %.7s", n.config.Parent, ep.id)
+		}
+	default:
+		resp.Gateway = n.config.Gateway
+		resp.DisableGatewayService = false
+	}
+
+	return resp, nil
 }
 
 func (d *driver) Leave(req *networkapi.LeaveRequest) error {
@@ -330,10 +890,70 @@ func (d *driver) Leave(req *networkapi.LeaveRequest) error {
 	if endpoint == nil {
 		return fmt.Errorf("could not find endpoint with id %s", req.EndpointID)
 	}
+	endpoint.Lock()
+	defer endpoint.Unlock()
+	endpoint.leaving = true
+	if err := d.runHook(hookLeave, endpoint); err != nil {
+		return err
+	}
+	// docker moves the child out of the sandbox back to the host after the
+	// driver leave, -o leave_action applies to it once it is there
+	if endpoint.srcName != "" {
+		if parentExists(endpoint.srcName) {
+			if network.config.LeaveAction == leaveDelete {
+				logrus.Warnf("Interface %s of endpoint %.7s was not moved into its sandbox, deleting it", endpoint.srcName, endpoint.id)
+			}
+			applyLeaveAction(network.config, endpoint)
+		} else if _, _, release, err := endpointLink(endpoint); err == nil {
+			release()
+			go leaveActionOnReturn(network.config, endpoint, endpoint.srcName)
+		}
+	}
+	d.leaveAuxIfaces(endpoint.auxNames, endpoint.sandboxKey)
+	endpoint.auxNames = nil
+	endpoint.sandboxKey = ""
+	endpoint.leftAt = time.Now()
+	if err := d.storeUpdate(endpoint); err != nil {
+		logrus.Warnf("Failed to save the leave time of macvlan endpoint %.7s to store: %v", endpoint.id, err)
+	}
 
 	return nil
 }
 
+// applyLeaveAction deletes the child of a left endpoint from the host unless
+// -o leave_action keeps it for the next join
+func applyLeaveAction(config *configuration, ep *endpoint) {
+	if config.hasQoS() && config.LeaveAction != leaveDelete {
+		clearQoS(ep.srcName)
+	}
+	switch config.LeaveAction {
+	case leaveDown:
+		if err := setLinkDown(ep.srcName); err != nil {
+			logrus.Warnf("Failed to set interface %s of endpoint %.7s down on leave: %v", ep.srcName, ep.id, err)
+		}
+	case leaveKeep:
+	default:
+		delLink(ep.srcName)
+		logrus.Debugf("Deleted interface %s of left endpoint %.7s", ep.srcName, ep.id)
+	}
+}
+
+// leaveActionOnReturn waits for docker to move the child of a left endpoint
+// back to the host and applies -o leave_action to it, unless the endpoint
+// joined again meanwhile
+func leaveActionOnReturn(config *configuration, ep *endpoint, name string) {
+	if !waitHostLink(name) {
+		logrus.Debugf("Interface %s of endpoint %.7s did not come back to the host after leave", name, ep.id)
+		return
+	}
+	ep.Lock()
+	defer ep.Unlock()
+	if !ep.leaving || ep.srcName != name {
+		return
+	}
+	applyLeaveAction(config, ep)
+}
+
 func (d *driver) DiscoverNew(discoveryNotification *networkapi.DiscoveryNotification) error {
 	logrus.Infof("Handling DiscoverNew")
 	return nil
@@ -362,43 +982,464 @@ func (d *driver) IsBuiltIn() bool {
 	return false
 }
 
-// createNetwork is used by new network callbacks and persistent network cache
-func (d *driver) createNetwork(config *configuration) (bool, error) {
-	foundExisting := false
+// validateNetworkConfig applies defaults to a parsed network configuration and
+// checks it, shared by CreateNetwork and the /can-create pre-flight
+func (d *driver) validateNetworkConfig(config *configuration) error {
+	// verify the macvlan mode from -o macvlan_mode option
+	switch config.MacvlanMode {
+	case "", modeBridge:
+		// default to macvlan bridge mode if -o macvlan_mode is empty
+		config.MacvlanMode = modeBridge
+	case modePrivate:
+		config.MacvlanMode = modePrivate
+	case modePassthru:
+		config.MacvlanMode = modePassthru
+	case modeVepa:
+		config.MacvlanMode = modeVepa
+	default:
+		return withCode(codeInvalidMode, fmt.Errorf("requested macvlan mode '%s' is not valid, 'bridge' mode is the macvlan driver default", config.MacvlanMode))
+	}
+	if err := requireKernel(modeFeatures[config.MacvlanMode]); err != nil {
+		return withCode(codeKernelUnsupported, err)
+	}
+	if err := d.requireMode(config.MacvlanMode); err != nil {
+		return withCode(codeKernelUnsupported, err)
+	}
+	// the plugin protocol only has a driver wide scope, a network can't differ from it
+	if config.Scope == "" {
+		config.Scope = driverScope
+	} else if config.Scope != driverScope {
+		return withCode(codeInvalidOption, types.BadRequestErrorf("network scope %s does not match the %s scope of the %s driver",
+			config.Scope, driverScope, networkType))
+	}
+	if config.LeaveAction == "" {
+		config.LeaveAction = leaveDelete
+	}
+	// keep the -o parent value, config.Parent becomes the interface actually used
+	config.RequestedParent = config.Parent
+	if config.Parent == parentAuto && !config.Internal {
+		parent, err := defaultRouteParent()
+		if err != nil {
+			return withCode(codeParentMissing, types.BadRequestErrorf("failed to resolve -o parent=auto: %v", err))
+		}
+		config.Parent = parent
+	}
+	// loopback is not a valid parent link
+	if config.Parent == "lo" {
+		return withCode(codeParentReserved, fmt.Errorf("loopback interface is not a valid %s parent link", macvlanType))
+	}
+	// internal networks are isolated on a dummy parent so they never reach the external LAN
+	if config.Internal {
+		if config.Parent != "" {
+			logrus.Warnf("Ignoring -o parent=%s for internal network %s, internal networks use an isolated dummy parent",
+				config.Parent, config.ID)
+		}
+		config.Parent = ""
+	}
+	// use -default-parent when -o parent is omitted and it exists
+	if config.Parent == "" && !config.Internal && d.opts.DefaultParent != "" {
+		if parentExists(d.opts.DefaultParent) {
+			config.Parent = d.opts.DefaultParent
+		} else if d.opts.NoDummyFallback {
+			return withCode(codeParentMissing, types.BadRequestErrorf("default parent interface %s was not found on the host", d.opts.DefaultParent))
+		} else {
+			logrus.Warnf("Default parent interface %s was not found, network %.7s gets a dummy parent", d.opts.DefaultParent, config.ID)
+		}
+	}
+	// if parent interface not specified, create a dummy type link to use named dummy+net_id
+	if config.Parent == "" {
+		config.Parent = dummyNameFor(config.ID)
+	}
+	if config.Parent != config.RequestedParent {
+		logrus.Infof("Network %.7s resolved parent %q to %s", config.ID, config.RequestedParent, config.Parent)
+	}
+	if err := d.checkReservedParent(config.Parent); err != nil {
+		return withCode(codeParentReserved, err)
+	}
+	if err := d.checkWireless(config.Parent); err != nil {
+		return withCode(codeParentInvalid, err)
+	}
+	// a missing iface.vlan parent is created by the driver, its name must parse
+	if strings.Contains(config.Parent, ".") && !parentExists(config.Parent) {
+		_, vid, err := parseVlan(config.Parent)
+		if err != nil {
+			return withCode(codeParentMissing, err)
+		}
+		if vid > 4094 || vid < 1 {
+			return withCode(codeParentInvalid, fmt.Errorf("vlan id must be between 1-4094, received: %d", vid))
+		}
+	}
+	if err := d.checkVlanMTU(config); err != nil {
+		return withCode(codeMTU, err)
+	}
+	for _, parent := range config.AuxParents {
+		if err := d.checkReservedParent(parent); err != nil {
+			return withCode(codeParentReserved, err)
+		}
+		if !parentExists(parent) {
+			return withCode(codeParentMissing, fmt.Errorf("auxiliary parent %s does not exist", parent))
+		}
+	}
+
+	return nil
+}
+
+// defaultAllowedPool is the pool the null ipam driver hands out
+const defaultAllowedPool = "0.0.0.0/0"
+
+// allowedPool tells whether an ipv4 pool is the null ipam placeholder or one
+// of the -allowed-ipv4-pools, comparing the networks so 10.0.0.1/8 is 10.0.0.0/8
+func (d *driver) allowedPool(pool string) bool {
+	allowed := d.opts.AllowedPools
+	if len(allowed) == 0 {
+		allowed = []string{defaultAllowedPool}
+	}
+	_, poolNet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		if _, allowedNet, err := net.ParseCIDR(a); err == nil && allowedNet.String() == poolNet.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// defaultReservedParents are never valid parents, -reserved-parents adds more
+var defaultReservedParents = []string{"lo", "docker0", "docker_gwbridge"}
+
+// checkReservedParent rejects reserved parents and the macvlan children the
+// driver created for endpoints. A reserved name ending in * matches a prefix.
+func (d *driver) checkReservedParent(parent string) error {
+	reserved := append(append([]string{}, defaultReservedParents...), d.opts.ReservedParents...)
+	for _, name := range reserved {
+		if name == parent || (strings.HasSuffix(name, "*") && strings.HasPrefix(parent, strings.TrimSuffix(name, "*"))) {
+			return types.BadRequestErrorf("interface %s is reserved and is not a valid %s parent link", parent, macvlanType)
+		}
+	}
+	for _, n := range d.getNetworks() {
+		for _, ep := range n.getEndpoints() {
+			if ep.srcName == parent {
+				return types.BadRequestErrorf("interface %s is the macvlan child of endpoint %.7s and is not a valid %s parent link",
+					parent, ep.id, macvlanType)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkCarrier warns when the parent has no carrier, failing with RequireCarrier
+func (d *driver) checkCarrier(parent string) error {
+	carrier, err := parentCarrier(parent)
+	if err != nil {
+		return err
+	}
+	if carrier {
+		return nil
+	}
+	if d.opts.RequireCarrier {
+		return types.ForbiddenErrorf("parent interface %s has no carrier, check its cable or link partner", parent)
+	}
+	logrus.Warnf("Parent interface %s has no carrier, containers on it will have no connectivity until it comes up", parent)
+
+	return nil
+}
+
+// checkWireless rejects, or with -wireless-parent=warn only warns about, a
+// wireless parent or the wireless interface under a vlan parent
+func (d *driver) checkWireless(parent string) error {
+	iface := parent
+	if !parentExists(parent) {
+		base, _, err := parseVlan(parent)
+		if err != nil {
+			return nil
+		}
+		iface = base
+	}
+	if !isWireless(iface) {
+		return nil
+	}
+	if d.opts.WirelessParent == "warn" {
+		logrus.Warnf("Parent interface %s is wireless, most access points drop frames from the extra MACs of macvlan children", iface)
+		return nil
+	}
+
+	return types.BadRequestErrorf("parent interface %s is wireless and can't carry the extra MACs of macvlan children, "+
+		"use a wired parent, an ipvlan network, or -wireless-parent=warn to try anyway", iface)
+}
+
+// dstPrefix returns the container interface name prefix of the network
+func (config *configuration) dstPrefix() string {
+	if config.DstPrefix != "" {
+		return config.DstPrefix
+	}
+
+	return containerVethPrefix
+}
+
+// checkDstPrefix warns when another network joined by the same sandbox hands
+// docker the same container interface prefix, docker then numbers the interfaces
+// in join order so their names are not stable across restarts
+func (d *driver) checkDstPrefix(n *network, ep *endpoint) {
+	prefix := n.config.dstPrefix()
+	for _, other := range d.getNetworks() {
+		if other.id == n.id || other.config.dstPrefix() != prefix {
+			continue
+		}
+		for _, oep := range other.getEndpoints() {
+			if oep.sandboxKey == ep.sandboxKey {
+				logrus.Warnf("Endpoint %.7s of network %.7s shares container interface prefix %q with endpoint %.7s of network %.7s in sandbox %s, set -o %s to tell them apart",
+					ep.id, n.id, prefix, oep.id, other.id, ep.sandboxKey, dstPrefixOpt)
+				return
+			}
+		}
+	}
+}
+
+// alias returns the human readable interface alias, the container name when known
+func (ep *endpoint) alias() string {
+	if ep.containerName != "" {
+		return ep.containerName
+	}
+
+	return ep.id
+}
+
+// sandboxID returns the id of the sandbox the endpoint is joined to, docker
+// names the namespace file of a sandbox after its id
+func (ep *endpoint) sandboxID() string {
+	if ep.sandboxKey == "" {
+		return ""
+	}
+
+	return filepath.Base(ep.sandboxKey)
+}
+
+// sandboxGone tells whether the endpoint is recorded as joined to a sandbox
+// that no longer exists, as after the container died while the plugin was down
+func (ep *endpoint) sandboxGone() bool {
+	if ep.sandboxKey == "" {
+		return false
+	}
+	_, err := os.Stat(ep.sandboxKey)
+
+	return os.IsNotExist(err)
+}
+
+// childMTU returns the mtu to create macvlan children with. The kernel refuses a
+// child mtu above the parent's, so an oversized -o macvlan_mtu is clamped with a
+// warning, or rejected with -strict-mtu.
+func (d *driver) childMTU(config *configuration) (int, error) {
+	if config.Mtu == 0 {
+		return 0, nil
+	}
+	parentLink, err := ns.NlHandle().LinkByName(config.Parent)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the mtu of parent %s: %v", config.Parent, err)
+	}
+	parentMTU := parentLink.Attrs().MTU
+	if config.Mtu <= parentMTU {
+		return config.Mtu, nil
+	}
+	if d.opts.StrictMTU {
+		return 0, types.BadRequestErrorf("requested macvlan mtu %d exceeds the mtu %d of parent %s", config.Mtu, parentMTU, config.Parent)
+	}
+	logrus.Warnf("Requested macvlan mtu %d exceeds the mtu %d of parent %s, frames would be dropped, using %d",
+		config.Mtu, parentMTU, config.Parent, parentMTU)
+
+	return parentMTU, nil
+}
+
+// checkVlanMTU warns about a -o macvlan_mtu that leaves no room for the 802.1Q
+// tag on the base interface of an iface.vlan parent, which only NICs without
+// vlan tag offload have to fit in their mtu. -strict-mtu rejects it.
+func (d *driver) checkVlanMTU(config *configuration) error {
+	if config.Mtu == 0 {
+		return nil
+	}
+	base, vid, err := parseVlan(config.Parent)
+	if err != nil || !parentExists(base) {
+		return nil
+	}
+	baseLink, err := ns.NlHandle().LinkByName(base)
+	if err != nil {
+		return fmt.Errorf("failed to read the mtu of %s: %v", base, err)
+	}
+	limit := baseLink.Attrs().MTU - vlanTagLen
+	if config.Mtu <= limit {
+		return nil
+	}
+	if d.opts.StrictMTU {
+		return types.BadRequestErrorf("requested macvlan mtu %d does not fit vlan %d on %s, the %d byte tag leaves at most %d of its mtu %d",
+			config.Mtu, vid, base, vlanTagLen, limit, baseLink.Attrs().MTU)
+	}
+	logrus.Warnf("Macvlan mtu %d leaves no room for the %d byte tag of vlan %d on %s with mtu %d, NICs without vlan offload drop full sized frames",
+		config.Mtu, vlanTagLen, vid, base, baseLink.Attrs().MTU)
+
+	return nil
+}
+
+// disableGatewayService resolves DisableGatewayService of a Join without a
+// gateway, the network's -o disable_gateway_service wins over the driver default
+func (d *driver) disableGatewayService(config *configuration) bool {
+	if config.DisableGwService != "" {
+		return config.DisableGwService == "true"
+	}
+
+	return !d.opts.GatewayService
+}
+
+// configDiff lists the user set options that differ between the stored and
+// requested config of a network, ignoring state the driver records itself
+func configDiff(stored, requested *configuration) []string {
+	// the parents are compared as requested, parent=auto and dummy parents
+	// resolve at create time and records written before the requested parent
+	// was kept only have the resolved one
+	storedParent := stored.RequestedParent
+	if stored.Parent == requested.Parent {
+		storedParent = requested.RequestedParent
+	}
+	fields := []struct {
+		name              string
+		stored, requested interface{}
+	}{
+		{parentOpt, storedParent, requested.RequestedParent},
+		{driverModeOpt, stored.MacvlanMode, requested.MacvlanMode},
+		{mtuOpt, stored.Mtu, requested.Mtu},
+		{"internal", stored.Internal, requested.Internal},
+		{disableIPv6Opt, stored.DisableIPv6, requested.DisableIPv6},
+		{gatewayOpt, stored.Gateway, requested.Gateway},
+		{ifaceFlagsOpt, stored.IfaceFlags, requested.IfaceFlags},
+		{dstPrefixOpt, stored.DstPrefix, requested.DstPrefix},
+		{promiscOpt, stored.ParentPromisc, requested.ParentPromisc},
+		{detachOnlyOpt, stored.DetachOnly, requested.DetachOnly},
+		{proxyARPOpt, stored.ProxyARP, requested.ProxyARP},
+		{proxyNDPOpt, stored.ProxyNDP, requested.ProxyNDP},
+		{requireMacOpt, stored.RequireMac, requested.RequireMac},
+		{stableMacOpt, stored.StableMac, requested.StableMac},
+		{macAllowOpt, stored.MacAllowlist, requested.MacAllowlist},
+		{scopeOpt, stored.Scope, requested.Scope},
+		{gwServiceOpt, stored.DisableGwService, requested.DisableGwService},
+		{leaveActionOpt, stored.LeaveAction, requested.LeaveAction},
+		{endpointRateOpt, stored.EndpointRate, requested.EndpointRate},
+		{priorityOpt, stored.Priority, requested.Priority},
+		{dscpOpt, stored.Dscp, requested.Dscp},
+		{auxParentsOpt, stored.AuxParents, requested.AuxParents},
+		{rxQueuesOpt, stored.RxQueues, requested.RxQueues},
+		{txQueuesOpt, stored.TxQueues, requested.TxQueues},
+		{rpsCpusOpt, stored.RpsCpus, requested.RpsCpus},
+	}
+	var diff []string
+	for _, f := range fields {
+		// compared formatted so a nil and an empty list are the same
+		if s, r := fmt.Sprint(f.stored), fmt.Sprint(f.requested); s != r {
+			diff = append(diff, fmt.Sprintf("%s %s, requested %s", f.name, s, r))
+		}
+	}
+
+	return diff
+}
+
+// findParentConflict reports whether the network already exists on its parent,
+// and fails when another network is using the parent
+func (d *driver) findParentConflict(config *configuration) (bool, error) {
 	networkList := d.getNetworks()
+	key := vlanKey(config.Parent)
 	for _, nw := range networkList {
-		if config.Parent == nw.config.Parent {
-			if config.ID != nw.config.ID {
-				return false, fmt.Errorf("network %s is already using parent interface %s",
-					getDummyName(stringid.TruncateID(nw.config.ID)), config.Parent)
+		if config.Parent != nw.config.Parent {
+			// allow-vlan also catches another link on the same physical parent and vlan
+			if d.opts.ParentPolicy != parentPolicyAllowVlan || config.ID == nw.config.ID || key != vlanKey(nw.config.Parent) {
+				continue
 			}
+		} else if config.ID == nw.config.ID {
 			logrus.Debugf("Create Network for the same ID %s\n", config.ID)
-			foundExisting = true
-			break
+			return true, nil
+		}
+		if err := d.parentShareable(config, nw.config); err != nil {
+			return false, withCode(codeParentConflict, err)
 		}
 	}
-	if !parentExists(config.Parent) {
-		// Create a dummy link if a dummy name is set for parent
-		if dummyName := getDummyName(stringid.TruncateID(config.ID)); dummyName == config.Parent {
-			err := createDummyLink(config.Parent, dummyName)
-			if err != nil {
-				return false, err
-			}
-			config.CreatedSlaveLink = true
-			// notify the user in logs that they have limited communications
-			logrus.Debugf("Empty -o parent= limit communications to other containers inside of network: %s",
-				config.Parent)
-		} else {
-			// if the subinterface parent_iface.vlan_id checks do not pass, return err.
-			//  a valid example is 'eth0.10' for a parent iface 'eth0' with a vlan id '10'
-			err := createVlanLink(config.Parent)
-			if err != nil {
-				return false, err
-			}
-			// if driver created the networks slave link, record it for future deletion
+
+	return false, nil
+}
+
+// parentShareable applies the -parent-policy to a parent already used by another network
+func (d *driver) parentShareable(config, other *configuration) error {
+	inUse := fmt.Errorf("network %s is already using parent interface %s",
+		getDummyName(stringid.TruncateID(other.ID)), other.Parent)
+	// the kernel allows a single macvlan on a passthru parent
+	if config.MacvlanMode == modePassthru || other.MacvlanMode == modePassthru {
+		return inUse
+	}
+	switch d.opts.ParentPolicy {
+	case parentPolicyShared:
+		return nil
+	case parentPolicyAllowVlan:
+		// the caller only asks for networks on the same physical parent and vlan
+		return fmt.Errorf("%v, -parent-policy=%s only shares a physical parent between different vlans", inUse, parentPolicyAllowVlan)
+	default:
+		return inUse
+	}
+}
+
+// parentUsers returns the other networks on the parent of config
+func (d *driver) parentUsers(config *configuration) []*network {
+	var users []*network
+	for _, nw := range d.getNetworks() {
+		if nw.id != config.ID && nw.config.Parent == config.Parent {
+			users = append(users, nw)
+		}
+	}
+
+	return users
+}
+
+// canCreateNetwork runs the CreateNetwork checks without touching the host or store
+func (d *driver) canCreateNetwork(config *configuration) error {
+	if err := d.validateNetworkConfig(config); err != nil {
+		return err
+	}
+	if _, err := d.findParentConflict(config); err != nil {
+		return err
+	}
+	if parentExists(config.Parent) {
+		link, err := ns.NlHandle().LinkByName(config.Parent)
+		if err != nil {
+			return err
+		}
+		return withCode(codeParentInvalid, validateMacvlanParent(link))
+	}
+	// a missing parent is created as a dummy or iface.vlan link
+	if isDummyNameFor(config.Parent, config.ID) {
+		return nil
+	}
+	// validateNetworkConfig checked the name of a missing iface.vlan parent
+	if !strings.Contains(config.Parent, ".") {
+		return withCode(codeParentMissing, fmt.Errorf("the requested parent interface %s was not found on the Docker host", config.Parent))
+	}
+
+	return nil
+}
+
+// createNetwork is used by new network callbacks and persistent network cache
+func (d *driver) createNetwork(config *configuration) (bool, error) {
+	foundExisting, err := d.findParentConflict(config)
+	if err != nil {
+		return false, err
+	}
+	// a parent left behind by a network deleted within -parent-delete-grace changes owner
+	if !foundExisting {
+		if linkType := d.reclaimParent(config.Parent); linkType != "" {
 			config.CreatedSlaveLink = true
+			config.CreatedLinkType = linkType
 		}
 	}
+	if err := createParentLink(config); err != nil {
+		return false, err
+	}
 	if !foundExisting {
 		n := &network{
 			id:        config.ID,
@@ -413,6 +1454,75 @@ func (d *driver) createNetwork(config *configuration) (bool, error) {
 	return foundExisting, nil
 }
 
+// createParentLink creates a missing parent, the dummy.net_id or iface.vlan link
+func createParentLink(config *configuration) error {
+	if parentExists(config.Parent) {
+		return nil
+	}
+	// Create a dummy link if a dummy name is set for parent
+	if dummyName := config.Parent; isDummyNameFor(dummyName, config.ID) {
+		err := createDummyLink(config.Parent, dummyName)
+		if err != nil {
+			return err
+		}
+		config.CreatedSlaveLink = true
+		config.CreatedLinkType = parentLinkDummy
+		// notify the user in logs that they have limited communications
+		logrus.Debugf("Empty -o parent= limit communications to other containers inside of network: %s",
+			config.Parent)
+		return nil
+	}
+	// if the subinterface parent_iface.vlan_id checks do not pass, return err.
+	//  a valid example is 'eth0.10' for a parent iface 'eth0' with a vlan id '10'
+	err := createVlanLink(config.Parent)
+	if err != nil {
+		return err
+	}
+	// if driver created the networks slave link, record it for future deletion
+	config.CreatedSlaveLink = true
+	config.CreatedLinkType = parentLinkVlan
+
+	return nil
+}
+
+// parentLinkType returns the type of the driver created parent, read from
+// its name for networks stored before the type was recorded
+func (config *configuration) parentLinkType() string {
+	if config.CreatedLinkType != "" {
+		return config.CreatedLinkType
+	}
+	if isDummyNameFor(config.Parent, config.ID) {
+		return parentLinkDummy
+	}
+	if strings.Contains(config.Parent, ".") {
+		return parentLinkVlan
+	}
+
+	return ""
+}
+
+// delParentLink removes a driver created parent, either the dummy.net_id or iface.vlan link
+func delParentLink(config *configuration) {
+	// if the interface exists, only delete if it matches iface.vlan or dummy.net_id naming
+	if ok := parentExists(config.Parent); !ok {
+		return
+	}
+	var err error
+	switch config.parentLinkType() {
+	case parentLinkDummy:
+		err = delDummyLink(config.Parent)
+	case parentLinkVlan:
+		// only delete the link if it matches iface.vlan naming
+		err = delVlanLink(config.Parent)
+	default:
+		err = fmt.Errorf("the driver has no record of creating it")
+	}
+	if err != nil {
+		logrus.Debugf("link %s was not deleted, continuing the delete network operation: %v",
+			config.Parent, err)
+	}
+}
+
 // parseNetworkOptions parses docker network options
 func parseNetworkOptions(id string, option options.Generic) (*configuration, error) {
 	var (
@@ -452,25 +1562,12 @@ func parseNetworkGenericOptions(data interface{}) (*configuration, error) {
 			config = opaqueConfig.(*configuration)
 		}
 	case map[string]interface{}:
-		logrus.Infof("It is map string interface %v", opt)
 		config = &configuration{}
+		labels := make(map[string]string, len(opt))
 		for label, value := range opt {
-			switch label {
-			case parentOpt: // parse driver option '-o parent'
-				config.Parent = value.(string)
-				/*if stringvalue, ok := value.(string); !ok {
-					logrus.Errorf("Value is not string for parent: %T", value)
-				} else {
-					config.Parent = stringvalue
-					logrus.Infof("Parent is %s", stringvalue)
-				}*/
-			case driverModeOpt:
-				// parse driver option '-o macvlan_mode'
-				config.MacvlanMode = value.(string)
-			default:
-				logrus.Errorf("Unmacthed option key %s", label)
-			}
+			labels[label] = fmt.Sprintf("%v", value)
 		}
+		err = config.fromOptions(labels)
 	default:
 		err = types.BadRequestErrorf("unrecognized network configuration format %T: %v", opt, opt)
 	}
@@ -480,6 +1577,10 @@ func parseNetworkGenericOptions(data interface{}) (*configuration, error) {
 
 // fromOptions binds the generic options to networkConfiguration to cache
 func (config *configuration) fromOptions(labels map[string]string) error {
+	labels, err := withProfile(labels)
+	if err != nil {
+		return err
+	}
 	for label, value := range labels {
 		switch label {
 		case parentOpt:
@@ -488,8 +1589,154 @@ func (config *configuration) fromOptions(labels map[string]string) error {
 		case driverModeOpt:
 			// parse driver option '-o macvlan_mode'
 			config.MacvlanMode = value
+		case disableIPv6Opt:
+			// parse driver option '-o disable_ipv6'
+			disable, err := strconv.ParseBool(value)
+			if err != nil {
+				return types.BadRequestErrorf("invalid value %q for -o %s, expected true or false", value, disableIPv6Opt)
+			}
+			config.DisableIPv6 = disable
+		case gatewayOpt:
+			// parse driver option '-o gateway'
+			if value != gatewayAuto && value != gatewayNone {
+				if ip := net.ParseIP(value); ip == nil || ip.To4() == nil {
+					return types.BadRequestErrorf("invalid value %q for -o %s, expected %s, %s or an ipv4 address",
+						value, gatewayOpt, gatewayAuto, gatewayNone)
+				}
+			}
+			config.Gateway = value
+		case mtuOpt:
+			// parse driver option '-o macvlan_mtu'
+			mtu, err := strconv.Atoi(value)
+			if err != nil || mtu < minMTU || mtu > maxMTU {
+				return types.BadRequestErrorf("invalid value %q for -o %s, expected a number between %d and %d", value, mtuOpt, minMTU, maxMTU)
+			}
+			config.Mtu = mtu
+		case ifaceFlagsOpt:
+			// parse driver option '-o iface_flags'
+			flags, err := parseIfaceFlags(value)
+			if err != nil {
+				return types.BadRequestErrorf("invalid value %q for -o %s: %v", value, ifaceFlagsOpt, err)
+			}
+			config.IfaceFlags = flags
+		case dstPrefixOpt:
+			// parse driver option '-o dst_prefix'
+			if err := validateDstPrefix(value); err != nil {
+				return types.BadRequestErrorf("invalid value %q for -o %s: %v", value, dstPrefixOpt, err)
+			}
+			config.DstPrefix = value
+		case promiscOpt:
+			// parse driver option '-o parent_promisc'
+			promisc, err := strconv.ParseBool(value)
+			if err != nil {
+				return types.BadRequestErrorf("invalid value %q for -o %s, expected true or false", value, promiscOpt)
+			}
+			config.ParentPromisc = promisc
+		case detachOnlyOpt:
+			// parse driver option '-o detach_only', the links outlive the network
+			// and must be removed by whoever takes them over
+			detach, err := strconv.ParseBool(value)
+			if err != nil {
+				return types.BadRequestErrorf("invalid value %q for -o %s, expected true or false", value, detachOnlyOpt)
+			}
+			config.DetachOnly = detach
+		case proxyARPOpt:
+			// parse driver option '-o proxy_arp'
+			proxy, err := strconv.ParseBool(value)
+			if err != nil {
+				return types.BadRequestErrorf("invalid value %q for -o %s, expected true or false", value, proxyARPOpt)
+			}
+			config.ProxyARP = proxy
+		case proxyNDPOpt:
+			// parse driver option '-o proxy_ndp'
+			proxy, err := strconv.ParseBool(value)
+			if err != nil {
+				return types.BadRequestErrorf("invalid value %q for -o %s, expected true or false", value, proxyNDPOpt)
+			}
+			config.ProxyNDP = proxy
+		case requireMacOpt:
+			// parse driver option '-o require_mac'
+			require, err := strconv.ParseBool(value)
+			if err != nil {
+				return types.BadRequestErrorf("invalid value %q for -o %s, expected true or false", value, requireMacOpt)
+			}
+			config.RequireMac = require
+		case stableMacOpt:
+			// parse driver option '-o stable_mac'
+			stable, err := strconv.ParseBool(value)
+			if err != nil {
+				return types.BadRequestErrorf("invalid value %q for -o %s, expected true or false", value, stableMacOpt)
+			}
+			config.StableMac = stable
+		case rxQueuesOpt:
+			// parse driver option '-o rx_queues'
+			if config.RxQueues, err = parseQueues(rxQueuesOpt, value); err != nil {
+				return types.BadRequestErrorf("%v", err)
+			}
+		case txQueuesOpt:
+			// parse driver option '-o tx_queues'
+			if config.TxQueues, err = parseQueues(txQueuesOpt, value); err != nil {
+				return types.BadRequestErrorf("%v", err)
+			}
+		case rpsCpusOpt:
+			// parse driver option '-o rps_cpus'
+			if config.RpsCpus, err = parseRpsCpus(value); err != nil {
+				return types.BadRequestErrorf("%v", err)
+			}
+		case gwServiceOpt:
+			// parse driver option '-o disable_gateway_service'
+			disable, err := strconv.ParseBool(value)
+			if err != nil {
+				return types.BadRequestErrorf("invalid value %q for -o %s, expected true or false", value, gwServiceOpt)
+			}
+			config.DisableGwService = strconv.FormatBool(disable)
+		case priorityOpt:
+			// parse driver option '-o priority'
+			if config.Priority, err = parsePriority(value); err != nil {
+				return types.BadRequestErrorf("%v", err)
+			}
+		case dscpOpt:
+			// parse driver option '-o dscp'
+			if config.Dscp, err = parseDscp(value); err != nil {
+				return types.BadRequestErrorf("%v", err)
+			}
+		case endpointRateOpt:
+			// parse driver option '-o endpoint_rate'
+			if config.EndpointRate, err = parseEndpointRate(value); err != nil {
+				return types.BadRequestErrorf("%v", err)
+			}
+		case leaveActionOpt:
+			// parse driver option '-o leave_action'
+			switch value {
+			case leaveDelete, leaveDown, leaveKeep:
+				config.LeaveAction = value
+			default:
+				return types.BadRequestErrorf("invalid value %q for -o %s, expected %s, %s or %s", value, leaveActionOpt, leaveDelete, leaveDown, leaveKeep)
+			}
+		case scopeOpt:
+			// parse driver option '-o scope'
+			if value != datastore.LocalScope && value != datastore.GlobalScope {
+				return types.BadRequestErrorf("invalid value %q for -o %s, expected %s or %s", value, scopeOpt, datastore.LocalScope, datastore.GlobalScope)
+			}
+			config.Scope = value
+		case macAllowOpt:
+			// parse driver option '-o mac_allowlist'
+			if config.MacAllowlist, err = parseMacAllowlist(value); err != nil {
+				return types.BadRequestErrorf("invalid value %q for -o %s: %v", value, macAllowOpt, err)
+			}
+		case auxParentsOpt:
+			// parse driver option '-o aux_parents'
+			parents, err := parseAuxParents(value)
+			if err != nil {
+				return types.BadRequestErrorf("invalid value %q for -o %s: %v", value, auxParentsOpt, err)
+			}
+			config.AuxParents = parents
+		default:
+			logrus.Warnf("Ignoring unknown network option -o %s", label)
+			config.unknownOpts = append(config.unknownOpts, label)
 		}
 	}
+	sort.Strings(config.unknownOpts)
 
 	return nil
 }
@@ -0,0 +1,461 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	networkapi "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/datastore"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/types"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// newTestDriver returns a driver without a store, host probe or background
+// work, holding the given networks
+func newTestDriver(opts Options, configs ...*configuration) *driver {
+	d := &driver{
+		networks: make(networkTable),
+		opts:     opts,
+		workers:  newWorkerPool(opts.Workers),
+		started:  time.Now(),
+		drains:   newDrainSet(),
+		grace:    newParentGrace(),
+		netStats: &netStatsCache{},
+		latency:  &opLatencies{ops: make(map[string]*opLatency)},
+		ready:    newReadiness(),
+	}
+	d.ready.set()
+	for _, config := range configs {
+		d.addNetwork(&network{id: config.ID, driver: d, endpoints: endpointTable{}, config: config})
+	}
+
+	return d
+}
+
+// withTestNetns moves the test into a new network namespace holding a dummy
+// parent link, it is skipped where macvlan links can't be created. The
+// namespace doubles as the sandbox, its path is returned.
+func withTestNetns(t testing.TB, parent string) string {
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Skipf("network namespaces are not available: %v", err)
+	}
+	testNs, err := netns.New()
+	if err != nil {
+		origin.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("network namespaces are not available: %v", err)
+	}
+	ns.Init()
+	t.Cleanup(func() {
+		netns.Set(origin)
+		ns.Init()
+		testNs.Close()
+		origin.Close()
+		runtime.UnlockOSThread()
+	})
+	h := ns.NlHandle()
+	if err := h.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: parent}}); err != nil {
+		t.Skipf("dummy links are not available: %v", err)
+	}
+	link, err := h.LinkByName(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.LinkSetUp(link); err != nil {
+		t.Fatal(err)
+	}
+	probe := &netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: "mvprobe0", ParentIndex: link.Attrs().Index}, Mode: netlink.MACVLAN_MODE_BRIDGE}
+	if err := h.LinkAdd(probe); err != nil {
+		t.Skipf("macvlan links are not available: %v", err)
+	}
+	h.LinkDel(probe)
+
+	return fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+}
+
+// macvlanLinks returns the names of the macvlan links in the current namespace
+func macvlanLinks(t testing.TB) []string {
+	links, err := ns.NlHandle().LinkList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, link := range links {
+		if link.Type() == "macvlan" {
+			names = append(names, link.Attrs().Name)
+		}
+	}
+
+	return names
+}
+
+// failingStore is a data store whose writes fail
+type failingStore struct {
+	datastore.DataStore
+}
+
+func (failingStore) PutObjectAtomic(datastore.KVObject) error {
+	return errors.New("store is read-only")
+}
+
+func TestJoinStoreFailureRollsBack(t *testing.T) {
+	sandbox := withTestNetns(t, "mvtest0")
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "mvtest0", MacvlanMode: modeBridge, LeaveAction: leaveDelete})
+	d.store = failingStore{}
+	n, _ := d.getNetwork("n1")
+	n.addEndpoint(&endpoint{id: "e1", nid: "n1", mac: generateMac()})
+
+	if _, err := d.Join(&networkapi.JoinRequest{NetworkID: "n1", EndpointID: "e1", SandboxKey: sandbox}); err == nil {
+		t.Fatal("Join succeeded with a failing store")
+	}
+	ep := n.endpoint("e1")
+	if ep.srcName != "" || ep.sandboxKey != "" || ep.auxNames != nil {
+		t.Errorf("failed Join left srcName %q, sandboxKey %q and aux interfaces %v", ep.srcName, ep.sandboxKey, ep.auxNames)
+	}
+	if links := macvlanLinks(t); len(links) > 0 {
+		t.Errorf("failed Join left macvlan links %v", links)
+	}
+
+	// a child kept by -o leave_action=keep was not created by the join, it stays
+	n.config.LeaveAction = leaveKeep
+	addTestChild(t, "mvtest0", "mvchild0")
+	ep.srcName = "mvchild0"
+	if _, err := d.Join(&networkapi.JoinRequest{NetworkID: "n1", EndpointID: "e1", SandboxKey: sandbox}); err == nil {
+		t.Fatal("Join succeeded with a failing store")
+	}
+	if !parentExists("mvchild0") || ep.srcName != "mvchild0" {
+		t.Errorf("failed Join of a kept child deleted it, srcName %q", ep.srcName)
+	}
+	if ep.sandboxKey != "" {
+		t.Errorf("failed Join left sandboxKey %q", ep.sandboxKey)
+	}
+}
+
+func TestInternalNetworkIgnoresParent(t *testing.T) {
+	d := newTestDriver(Options{})
+	config := &configuration{ID: "2f1c1e8a9b7d4c3e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e", Parent: "eth0", MacvlanMode: modeBridge, Internal: true}
+
+	if err := d.validateNetworkConfig(config); err != nil {
+		t.Fatalf("internal network rejected: %v", err)
+	}
+	if want := dummyNameFor(config.ID); config.Parent != want {
+		t.Errorf("internal network with -o parent=eth0 got parent %s, want the dummy parent %s", config.Parent, want)
+	}
+	if config.RequestedParent != "eth0" {
+		t.Errorf("requested parent %q was not kept", config.RequestedParent)
+	}
+}
+
+func TestConfigDiffRequestedParent(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		stored, requested *configuration
+		drift             bool
+	}{
+		{"auto moved", &configuration{Parent: "eth0", RequestedParent: parentAuto}, &configuration{Parent: "eth1", RequestedParent: parentAuto}, false},
+		{"dummy", &configuration{Parent: "dm-2f1c1e8a9b7d", RequestedParent: ""}, &configuration{Parent: "dm-2f1c1e8a9b7d", RequestedParent: ""}, false},
+		{"legacy record", &configuration{Parent: "dm-2f1c1e8a9b7d", RequestedParent: "dm-2f1c1e8a9b7d"}, &configuration{Parent: "dm-2f1c1e8a9b7d", RequestedParent: ""}, false},
+		{"parent changed", &configuration{Parent: "eth0", RequestedParent: "eth0"}, &configuration{Parent: "eth1", RequestedParent: "eth1"}, true},
+		{"mode changed", &configuration{Parent: "eth0", RequestedParent: "eth0", MacvlanMode: modeBridge}, &configuration{Parent: "eth0", RequestedParent: "eth0", MacvlanMode: modeVepa}, true},
+	} {
+		if diff := configDiff(tc.stored, tc.requested); (len(diff) > 0) != tc.drift {
+			t.Errorf("%s: got drift %v, want drift %t", tc.name, diff, tc.drift)
+		}
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	stored := &configuration{Parent: "eth0", RequestedParent: "eth0", MacvlanMode: modeBridge, Mtu: 1500,
+		AuxParents: []string{}, CreatedSlaveLink: true, ChildIndex: 4}
+	requested := &configuration{Parent: "eth0", RequestedParent: "eth0", MacvlanMode: modeBridge, Mtu: 1500}
+	// a nil and an empty list are the same, the state the driver records is ignored
+	if diff := configDiff(stored, requested); len(diff) > 0 {
+		t.Errorf("same options differ: %v", diff)
+	}
+
+	requested.Mtu = 9000
+	requested.LeaveAction = leaveKeep
+	diff := configDiff(stored, requested)
+	if len(diff) != 2 {
+		t.Fatalf("got %v, want the mtu and the leave action", diff)
+	}
+	if want := mtuOpt + " 1500, requested 9000"; diff[0] != want {
+		t.Errorf("got %q, want %q", diff[0], want)
+	}
+}
+
+func TestDeleteNetworkRemovesLinks(t *testing.T) {
+	withTestNetns(t, "mvtest0")
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "mvtest0", MacvlanMode: modeBridge,
+		CreatedSlaveLink: true, CreatedLinkType: parentLinkDummy})
+	n, _ := d.getNetwork("n1")
+	addTestChild(t, "mvtest0", "mvchild0")
+	n.addEndpoint(&endpoint{id: "e1", nid: "n1", srcName: "mvchild0"})
+
+	if err := d.DeleteNetwork(&networkapi.DeleteNetworkRequest{NetworkID: "n1"}); err != nil {
+		t.Fatal(err)
+	}
+	if parentExists("mvchild0") {
+		t.Error("DeleteNetwork left the endpoint link")
+	}
+	if parentExists("mvtest0") {
+		t.Error("DeleteNetwork left the driver created parent")
+	}
+	if _, err := d.getNetwork("n1"); err == nil {
+		t.Error("DeleteNetwork left the network")
+	}
+}
+
+func TestInternalNetworkSkipsDefaultParent(t *testing.T) {
+	d := newTestDriver(Options{DefaultParent: "eth0"})
+	config := &configuration{ID: "7d3a9e1b2c4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b", MacvlanMode: modeBridge, Internal: true}
+
+	if err := d.validateNetworkConfig(config); err != nil {
+		t.Fatalf("internal network rejected: %v", err)
+	}
+	if want := dummyNameFor(config.ID); config.Parent != want {
+		t.Errorf("internal network got parent %s with -default-parent set, want the dummy parent %s", config.Parent, want)
+	}
+}
+
+func TestJoinRejectsBadSandbox(t *testing.T) {
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "eth0", MacvlanMode: modeBridge, LeaveAction: leaveDelete})
+	n, _ := d.getNetwork("n1")
+	n.addEndpoint(&endpoint{id: "e1", nid: "n1", mac: generateMac()})
+
+	_, err := d.Join(&networkapi.JoinRequest{NetworkID: "n1", EndpointID: "e1", SandboxKey: "/nonexistent/netns"})
+	if _, ok := err.(types.BadRequestError); !ok {
+		t.Fatalf("got %v, want a bad request error", err)
+	}
+	if ep := n.endpoint("e1"); ep.srcName != "" || ep.sandboxKey != "" {
+		t.Errorf("rejected Join left srcName %q and sandboxKey %q", ep.srcName, ep.sandboxKey)
+	}
+}
+
+func TestLeaveDeletesUnmovedChild(t *testing.T) {
+	withTestNetns(t, "mvtest0")
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "mvtest0", MacvlanMode: modeBridge, LeaveAction: leaveDelete})
+	n, _ := d.getNetwork("n1")
+	// docker failed the join before moving the child into the sandbox
+	addTestChild(t, "mvtest0", "mvchild0")
+	n.addEndpoint(&endpoint{id: "e1", nid: "n1", srcName: "mvchild0"})
+
+	if err := d.Leave(&networkapi.LeaveRequest{NetworkID: "n1", EndpointID: "e1"}); err != nil {
+		t.Fatal(err)
+	}
+	if parentExists("mvchild0") {
+		t.Error("Leave left the child that was never moved into the sandbox")
+	}
+}
+
+func TestLeaveActionAfterChildReturns(t *testing.T) {
+	withTestNetns(t, "mvtest0")
+	host, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	sandbox, err := netns.New()
+	if err != nil {
+		t.Skipf("network namespaces are not available: %v", err)
+	}
+	defer sandbox.Close()
+	if err := netns.Set(host); err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "mvtest0", MacvlanMode: modeBridge, LeaveAction: leaveDelete})
+	n, _ := d.getNetwork("n1")
+	addTestChild(t, "mvtest0", "mvchild0")
+	child, err := ns.NlHandle().LinkByName("mvchild0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.NlHandle().LinkSetNsFd(child, int(sandbox)); err != nil {
+		t.Fatal(err)
+	}
+	n.addEndpoint(&endpoint{id: "e1", nid: "n1", srcName: "mvchild0", mac: child.Attrs().HardwareAddr,
+		sandboxKey: fmt.Sprintf("/proc/self/fd/%d", int(sandbox))})
+
+	// the driver leave runs while the child is still in the sandbox
+	if err := d.Leave(&networkapi.LeaveRequest{NetworkID: "n1", EndpointID: "e1"}); err != nil {
+		t.Fatal(err)
+	}
+	// then docker moves it back to the host
+	h, err := netlink.NewHandleAt(sandbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Delete()
+	if child, err = h.LinkByName("mvchild0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.LinkSetNsFd(child, int(host)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < sandboxWaitRetries && parentExists("mvchild0"); i++ {
+		time.Sleep(sandboxWaitInterval)
+	}
+	if parentExists("mvchild0") {
+		t.Error("the child returned to the host after leave was not deleted")
+	}
+}
+
+func TestCreateRestoredNetwork(t *testing.T) {
+	withTestNetns(t, "mvtest0")
+	const id = "5e0c7b2a9d8f4e1c3b6a5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a"
+	req := &networkapi.CreateNetworkRequest{
+		NetworkID: id,
+		Options:   map[string]interface{}{netlabel.GenericData: map[string]interface{}{parentOpt: "mvtest0"}},
+	}
+	for _, restoreAsSuccess := range []bool{false, true} {
+		d := newTestDriver(Options{RestoreAsSuccess: restoreAsSuccess})
+		// the network as the store restored it
+		restored, err := parseNetworkOptions(id, req.Options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored.ID = id
+		if err := d.validateNetworkConfig(restored); err != nil {
+			t.Fatal(err)
+		}
+		d.addNetwork(&network{id: id, driver: d, endpoints: endpointTable{}, config: restored})
+
+		err = d.CreateNetwork(req)
+		if restoreAsSuccess {
+			if err != nil {
+				t.Errorf("-restore-as-success: got %v, want success", err)
+			}
+		} else if _, ok := err.(types.MaskableError); !ok {
+			t.Errorf("got %v, want a maskable error", err)
+		}
+		if n, _ := d.getNetwork(id); n == nil || n.config != restored {
+			t.Error("CreateNetwork replaced the restored network")
+		}
+	}
+}
+
+func TestStableMacRejoin(t *testing.T) {
+	sandbox := withTestNetns(t, "mvtest0")
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "mvtest0", MacvlanMode: modeBridge, LeaveAction: leaveDelete, StableMac: true})
+	n, _ := d.getNetwork("n1")
+	mac := generateMac()
+	n.addEndpoint(&endpoint{id: "e1", nid: "n1", mac: mac})
+
+	for i := 0; i < 2; i++ {
+		resp, err := d.Join(&networkapi.JoinRequest{NetworkID: "n1", EndpointID: "e1", SandboxKey: sandbox})
+		if err != nil {
+			t.Fatalf("join %d: %v", i, err)
+		}
+		link, err := ns.NlHandle().LinkByName(resp.InterfaceName.SrcName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := link.Attrs().HardwareAddr; got.String() != mac.String() {
+			t.Errorf("join %d: child has MAC %s, want the stored %s", i, got, mac)
+		}
+		if err := d.Leave(&networkapi.LeaveRequest{NetworkID: "n1", EndpointID: "e1"}); err != nil {
+			t.Fatalf("leave %d: %v", i, err)
+		}
+	}
+}
+
+func TestValidateVlanParent(t *testing.T) {
+	d := newTestDriver(Options{})
+	for parent, code := range map[string]string{
+		"mvnone0.10": codeParentMissing,
+		"lo.5000":    codeParentInvalid,
+		"lo.0":       codeParentInvalid,
+	} {
+		config := &configuration{ID: "2f1c1e8a9b7d4c3e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e", Parent: parent, MacvlanMode: modeBridge}
+		if err := d.validateNetworkConfig(config); errorCode(err) != code {
+			t.Errorf("parent %s: got %v, want code %s", parent, err, code)
+		}
+	}
+}
+
+func TestJoinReusesKeptChildWithSrcName(t *testing.T) {
+	sandbox := withTestNetns(t, "mvtest0")
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "mvtest0", MacvlanMode: modeBridge, LeaveAction: leaveKeep})
+	n, _ := d.getNetwork("n1")
+	// the child the last leave kept on the host
+	addTestChild(t, "mvtest0", "mvchild0")
+	n.addEndpoint(&endpoint{id: "e1", nid: "n1", mac: generateMac(), srcName: "mvchild0"})
+
+	resp, err := d.Join(&networkapi.JoinRequest{NetworkID: "n1", EndpointID: "e1", SandboxKey: sandbox,
+		Options: map[string]interface{}{srcNameOpt: "mvchild0"}})
+	if err != nil {
+		t.Fatalf("rejoin with -o %s: %v", srcNameOpt, err)
+	}
+	if resp.InterfaceName.SrcName != "mvchild0" {
+		t.Errorf("rejoin used interface %s, want the kept mvchild0", resp.InterfaceName.SrcName)
+	}
+}
+
+func TestCreateEndpointStoreFailureRunsDeleteHook(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "hook.sh")
+	events := filepath.Join(dir, "events")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho $1 >> "+events+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDriver(Options{HookScript: script, HookTimeout: 10 * time.Second, HookFail: true},
+		&configuration{ID: "n1", Parent: "lo", MacvlanMode: modeBridge})
+	d.store = failingStore{}
+
+	if _, err := d.CreateEndpoint(&networkapi.CreateEndpointRequest{NetworkID: "n1", EndpointID: "e1"}); err == nil {
+		t.Fatal("CreateEndpoint succeeded with a failing store")
+	}
+	out, err := ioutil.ReadFile(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out), hookCreateEndpoint+"\n"+hookDeleteEndpoint+"\n"; got != want {
+		t.Errorf("hook events %q, want %q", got, want)
+	}
+}
+
+func TestFailedCreateEndpointReturnsRateToken(t *testing.T) {
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "lo", MacvlanMode: modeBridge, EndpointRate: "1/h"})
+	d.store = failingStore{}
+	for i := 0; i < 2; i++ {
+		_, err := d.CreateEndpoint(&networkapi.CreateEndpointRequest{NetworkID: "n1", EndpointID: fmt.Sprintf("e%d", i)})
+		if _, ok := err.(types.RetryError); ok || err == nil {
+			t.Fatalf("create %d with a failing store: got %v, want the store error", i, err)
+		}
+	}
+	d.store = nil
+	if _, err := d.CreateEndpoint(&networkapi.CreateEndpointRequest{NetworkID: "n1", EndpointID: "e2"}); err != nil {
+		t.Errorf("the first successful create was rate limited: %v", err)
+	}
+	if _, err := d.CreateEndpoint(&networkapi.CreateEndpointRequest{NetworkID: "n1", EndpointID: "e3"}); err == nil {
+		t.Error("a second create within the hour was not rate limited")
+	}
+}
+
+func TestCreateNetworkStoreFailureDeletesParent(t *testing.T) {
+	withTestNetns(t, "mvtest0")
+	d := newTestDriver(Options{})
+	d.store = failingStore{}
+	const id = "7a0c7b2a9d8f4e1c3b6a5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a"
+	req := &networkapi.CreateNetworkRequest{NetworkID: id, Options: map[string]interface{}{netlabel.GenericData: map[string]interface{}{}}}
+
+	if err := d.CreateNetwork(req); err == nil {
+		t.Fatal("CreateNetwork succeeded with a failing store")
+	}
+	if name := dummyNameFor(id); parentExists(name) {
+		t.Errorf("failed CreateNetwork left its dummy parent %s", name)
+	}
+}
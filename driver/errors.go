@@ -0,0 +1,59 @@
+package driver
+
+// network create failure codes, returned by CreateNetwork in a createError
+const (
+	codeIPAMPool          = "ipam_pool"          // the network has an ipv4 pool
+	codeInvalidOption     = "invalid_option"     // a -o option has a bad value
+	codeInvalidMode       = "invalid_mode"       // -o macvlan_mode is unknown
+	codeKernelUnsupported = "kernel_unsupported" // the kernel is too old for a feature
+	codeParentReserved    = "parent_reserved"    // the parent may not be used
+	codeParentMissing     = "parent_missing"     // the parent does not exist
+	codeParentConflict    = "parent_conflict"    // another network uses the parent
+	codeParentInvalid     = "parent_invalid"     // the kernel can't attach a macvlan to the parent
+	codeMTU               = "mtu"                // -o macvlan_mtu doesn't fit the parent
+	codeHostSetup         = "host_setup"         // creating or configuring a host link failed
+	codeStore             = "store"              // the network could not be persisted
+	codeConfigMismatch    = "config_mismatch"    // the network exists with other options
+)
+
+// createError is a network create failure with a code automation can branch
+// on, docker only sees the message
+type createError struct {
+	code string
+	err  error
+}
+
+func (e *createError) Error() string {
+	return e.err.Error()
+}
+
+// Code returns the failure category
+func (e *createError) Code() string {
+	return e.code
+}
+
+func (e *createError) Unwrap() error {
+	return e.err
+}
+
+// withCode tags err with a failure code, keeping the more precise code of an
+// error that already has one
+func withCode(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*createError); ok {
+		return err
+	}
+
+	return &createError{code: code, err: err}
+}
+
+// errorCode returns the failure code of err, empty when it has none
+func errorCode(err error) string {
+	if e, ok := err.(*createError); ok {
+		return e.code
+	}
+
+	return ""
+}
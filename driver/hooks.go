@@ -0,0 +1,52 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/sirupsen/logrus"
+)
+
+// endpoint lifecycle events passed to the -hook-script as its first argument
+const (
+	hookCreateEndpoint = "create-endpoint"
+	hookDeleteEndpoint = "delete-endpoint"
+	hookJoin           = "join"
+	hookLeave          = "leave"
+)
+
+// runHook execs the -hook-script for an endpoint event. A failing script only
+// fails the operation when -hook-fail is set, otherwise it is logged.
+func (d *driver) runHook(event string, ep *endpoint) error {
+	if d.opts.HookScript == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.opts.HookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, d.opts.HookScript, event)
+	cmd.Env = append(os.Environ(),
+		"MACVLAN_EVENT="+event,
+		"MACVLAN_NETWORK_ID="+ep.nid,
+		"MACVLAN_ENDPOINT_ID="+ep.id,
+		"MACVLAN_MAC="+ep.mac.String(),
+		"MACVLAN_SRC_NAME="+ep.srcName,
+	)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", d.opts.HookTimeout)
+	}
+	if err != nil {
+		err = fmt.Errorf("hook %s %s for endpoint %.7s failed: %v: %s", d.opts.HookScript, event, ep.id, err, out)
+		if d.opts.HookFail {
+			return err
+		}
+		logrus.Warn(err)
+		return nil
+	}
+	logrus.Debugf("Hook %s %s for endpoint %.7s succeeded: %s", d.opts.HookScript, event, ep.id, out)
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/docker/libnetwork/netutils"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxIfaceNameLen = 15 // IFNAMSIZ less the terminating nul
+	shortIDLen      = 7  // id length used in generated interface names
+
+	ifnameTokenParent   = "{parent}"
+	ifnameTokenEndpoint = "{endpoint}"
+	ifnameTokenNetwork  = "{network}"
+	ifnameTokenIndex    = "{index}"
+)
+
+var ifnameTokenPattern = regexp.MustCompile(`\{[^}]*\}`)
+
+// validateIfnameTemplate rejects unknown tokens in an -ifname-template, and
+// templates that can give two endpoints the same name
+func validateIfnameTemplate(tmpl string) error {
+	for _, token := range ifnameTokenPattern.FindAllString(tmpl, -1) {
+		switch token {
+		case ifnameTokenParent, ifnameTokenEndpoint, ifnameTokenNetwork, ifnameTokenIndex:
+		default:
+			return fmt.Errorf("unknown token %s in interface name template %q, supported tokens are %s, %s, %s and %s",
+				token, tmpl, ifnameTokenParent, ifnameTokenEndpoint, ifnameTokenNetwork, ifnameTokenIndex)
+		}
+	}
+	if !strings.Contains(tmpl, ifnameTokenEndpoint) && !strings.Contains(tmpl, ifnameTokenIndex) {
+		return fmt.Errorf("interface name template %q must contain %s or %s to keep names unique", tmpl, ifnameTokenEndpoint, ifnameTokenIndex)
+	}
+	// indexes count per network, two networks both have an index 1
+	if !strings.Contains(tmpl, ifnameTokenEndpoint) && !strings.Contains(tmpl, ifnameTokenNetwork) {
+		return fmt.Errorf("interface name template %q must contain %s with %s to keep names unique across networks", tmpl, ifnameTokenNetwork, ifnameTokenIndex)
+	}
+
+	return nil
+}
+
+// expandIfnameTemplate substitutes the parent name, short network and endpoint
+// ids and the endpoint's index in its network
+func expandIfnameTemplate(tmpl, parent, nid, eid string, index int) string {
+	return strings.NewReplacer(
+		ifnameTokenParent, parent,
+		ifnameTokenNetwork, shortID(nid),
+		ifnameTokenEndpoint, shortID(eid),
+		ifnameTokenIndex, strconv.Itoa(index),
+	).Replace(tmpl)
+}
+
+// childIndex returns the index of an endpoint in its network, giving the
+// endpoint the next one of the network's counter on first use. The counter is
+// persisted with the network so indexes are not reused across restarts.
+func (d *driver) childIndex(n *network, ep *endpoint) int {
+	if ep.childIndex != 0 {
+		return ep.childIndex
+	}
+	n.Lock()
+	n.config.ChildIndex++
+	ep.childIndex = n.config.ChildIndex
+	n.Unlock()
+	if err := d.storeUpdate(n.config); err != nil {
+		logrus.Warnf("Failed to save the endpoint index counter of network %.7s: %v", n.id, err)
+	}
+
+	return ep.childIndex
+}
+
+func shortID(id string) string {
+	if len(id) > shortIDLen {
+		return id[:shortIDLen]
+	}
+
+	return id
+}
+
+// validateIfaceName checks a requested host interface name is usable and free
+func validateIfaceName(name string) error {
+	if name == "" || len(name) > maxIfaceNameLen {
+		return fmt.Errorf("interface name %q must be 1-%d characters long", name, maxIfaceNameLen)
+	}
+	if strings.ContainsAny(name, "/: \t\n") {
+		return fmt.Errorf("interface name %q contains characters the kernel does not allow", name)
+	}
+	if parentExists(name) {
+		return fmt.Errorf("interface name %q is already in use on the Docker host", name)
+	}
+
+	return nil
+}
+
+// validateDstPrefix checks a container interface prefix leaves room for the
+// index docker appends and can't be mistaken for part of it
+func validateDstPrefix(prefix string) error {
+	if prefix == "" || len(prefix) > maxIfaceNameLen-3 {
+		return fmt.Errorf("prefix must be 1-%d characters long", maxIfaceNameLen-3)
+	}
+	for _, c := range prefix {
+		if !unicode.IsLetter(c) || c > unicode.MaxASCII {
+			return fmt.Errorf("prefix must only contain ascii letters")
+		}
+	}
+
+	return nil
+}
+
+// hostIfaceName picks the host side name of an endpoint's macvlan child, the
+// -o src_name requested at join, from -ifname-template when set or randomly
+// generated otherwise
+func (d *driver) hostIfaceName(n *network, ep *endpoint, requested string) (string, error) {
+	if requested != "" {
+		if err := validateIfaceName(requested); err != nil {
+			return "", types.BadRequestErrorf("invalid -o %s: %v", srcNameOpt, err)
+		}
+		return requested, nil
+	}
+	if d.opts.IfnameTemplate == "" {
+		name, err := netutils.GenerateIfaceName(ns.NlHandle(), vethPrefix, vethLen)
+		if err != nil {
+			return "", fmt.Errorf("error generating an interface name: %s", err)
+		}
+		return name, nil
+	}
+	index := 0
+	if strings.Contains(d.opts.IfnameTemplate, ifnameTokenIndex) {
+		index = d.childIndex(n, ep)
+	}
+	name := expandIfnameTemplate(d.opts.IfnameTemplate, n.config.Parent, n.id, ep.id, index)
+	if err := validateIfaceName(name); err != nil {
+		if index == 0 {
+			return "", fmt.Errorf("invalid interface name from template %q: %v", d.opts.IfnameTemplate, err)
+		}
+		// an indexed name can outgrow the length limit or meet a leftover link
+		generated, genErr := netutils.GenerateIfaceName(ns.NlHandle(), vethPrefix, vethLen)
+		if genErr != nil {
+			return "", fmt.Errorf("error generating an interface name: %s", genErr)
+		}
+		logrus.Warnf("Interface name %q of endpoint %.7s is unusable, using %s: %v", name, ep.id, generated, err)
+		return generated, nil
+	}
+
+	return name, nil
+}
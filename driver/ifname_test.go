@@ -0,0 +1,65 @@
+package driver
+
+import "testing"
+
+func TestValidateIfnameTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		tmpl string
+		ok   bool
+	}{
+		{"mv-{endpoint}", true},
+		{"{parent}.{endpoint}", true},
+		{"mv{network}-{index}", true},
+		{"{endpoint}{index}", true},
+		{"{parent}-{index}", false},
+		{"mv{index}", false},
+		{"mv-{network}", false},
+		{"macvlan", false},
+		{"mv-{endpoint}-{name}", false},
+	} {
+		err := validateIfnameTemplate(tc.tmpl)
+		if tc.ok && err != nil {
+			t.Errorf("%q rejected: %v", tc.tmpl, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%q accepted", tc.tmpl)
+		}
+	}
+}
+
+func TestExpandIfnameTemplate(t *testing.T) {
+	name := expandIfnameTemplate("{parent}{network}{index}", "eth0", "9a8b7c6d5e4f", "0123456789ab", 3)
+	if want := "eth09a8b7c63"; name != want {
+		t.Errorf("got %q, want %q", name, want)
+	}
+}
+
+func TestChildIndexAfterRestore(t *testing.T) {
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "eth0", MacvlanMode: modeBridge, ChildIndex: 2})
+	// the endpoint was saved with an index whose counter write failed
+	d.restoreEndpoint(&endpoint{id: "e1", nid: "n1", childIndex: 5})
+	d.restoreEndpoint(&endpoint{id: "e2", nid: "n1", childIndex: 1})
+	n, _ := d.getNetwork("n1")
+	if n.config.ChildIndex != 5 {
+		t.Fatalf("restored counter %d, want 5", n.config.ChildIndex)
+	}
+
+	if index := d.childIndex(n, &endpoint{id: "e3", nid: "n1"}); index != 6 {
+		t.Errorf("new endpoint got index %d, want 6", index)
+	}
+	if index := d.childIndex(n, n.endpoint("e1")); index != 5 {
+		t.Errorf("restored endpoint got index %d, want its own 5", index)
+	}
+}
+
+func TestValidateDstPrefix(t *testing.T) {
+	for _, prefix := range []string{"eth", "mv", "abcdefghijkl"} {
+		if err := validateDstPrefix(prefix); err != nil {
+			t.Errorf("%q rejected: %v", prefix, err)
+		}
+	}
+	for _, prefix := range []string{"", "abcdefghijklm", "eth0", "mv-", "mv_", "été"} {
+		if err := validateDstPrefix(prefix); err == nil {
+			t.Errorf("%q accepted", prefix)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package driver
+
+import (
+	"github.com/docker/docker/pkg/parsers/kernel"
+	"github.com/docker/libnetwork/types"
+	"github.com/sirupsen/logrus"
+)
+
+// kernelFeature is a driver feature only available from a minimum kernel version
+type kernelFeature struct {
+	name string
+	min  kernel.VersionInfo
+}
+
+var (
+	featureMacvlan       = kernelFeature{"macvlan bridge, private and vepa modes", kernel.VersionInfo{Kernel: 2, Major: 6, Minor: 33}}
+	featurePassthru      = kernelFeature{"macvlan passthru mode", kernel.VersionInfo{Kernel: 2, Major: 6, Minor: 38}}
+	featureVlanFiltering = kernelFeature{"bridge vlan filtering", kernel.VersionInfo{Kernel: 3, Major: 8}}
+)
+
+// modeFeatures maps macvlan modes to the kernel feature they need
+var modeFeatures = map[string]kernelFeature{
+	modeBridge:   featureMacvlan,
+	modePrivate:  featureMacvlan,
+	modeVepa:     featureMacvlan,
+	modePassthru: featurePassthru,
+}
+
+// hostKernel is the running kernel version read once at startup, nil when unknown
+var hostKernel *kernel.VersionInfo
+
+// readKernelVersion caches the running kernel version, features are not
+// checked when it can't be read
+func readKernelVersion() {
+	v, err := kernel.GetKernelVersion()
+	if err != nil {
+		logrus.Warnf("Failed to read the kernel version, kernel feature checks are disabled: %v", err)
+		return
+	}
+	hostKernel = v
+	logrus.Debugf("Running on kernel %s", v)
+}
+
+// requireKernel fails with the version a feature needs when the running kernel is older
+func requireKernel(f kernelFeature) error {
+	if hostKernel == nil || kernel.CompareKernelVersion(*hostKernel, f.min) >= 0 {
+		return nil
+	}
+
+	return types.NotImplementedErrorf("%s requires kernel %d.%d.%d or later, this host runs %s",
+		f.name, f.min.Kernel, f.min.Major, f.min.Minor, hostKernel)
+}
@@ -0,0 +1,50 @@
+package driver
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/docker/libnetwork/types"
+	"github.com/sirupsen/logrus"
+)
+
+// maxLabelLen is the longest network label accepted on the admin api
+const maxLabelLen = 64
+
+// labelPattern matches a readable network label, ex. vlan20-storage
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// labelMu serializes label updates so concurrent writes persist in order
+var labelMu sync.Mutex
+
+// networkLabel is the readable label of a network, served on /networks/{id}/label
+type networkLabel struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+}
+
+// setNetworkLabel stores a readable label on a network, an empty label clears
+// it. It is metadata only, the network's links are left untouched.
+func (d *driver) setNetworkLabel(nid, label string) (*networkLabel, error) {
+	if len(label) > maxLabelLen {
+		return nil, types.BadRequestErrorf("network label is %d characters, at most %d are allowed", len(label), maxLabelLen)
+	}
+	if label != "" && !labelPattern.MatchString(label) {
+		return nil, types.BadRequestErrorf("invalid network label %q, expected letters, digits, '.', '_' or '-' starting with a letter or digit", label)
+	}
+	n, err := d.getNetwork(nid)
+	if err != nil {
+		return nil, err
+	}
+	labelMu.Lock()
+	defer labelMu.Unlock()
+	previous := n.config.Label
+	n.config.Label = label
+	if err := d.storeUpdate(n.config); err != nil {
+		n.config.Label = previous
+		return nil, types.InternalErrorf("failed to save the label of network %.7s: %v", nid, err)
+	}
+	logrus.Infof("Labeled network %.7s %q", nid, label)
+
+	return &networkLabel{ID: n.id, Label: label}, nil
+}
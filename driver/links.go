@@ -0,0 +1,130 @@
+package driver
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/docker/libnetwork/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// link roles reported on /links
+const (
+	linkRoleParent = "parent"
+	linkRoleChild  = "child"
+)
+
+// linkRecord is one host interface created by the driver, with the store
+// record it belongs to. Orphaned links exist on the host but not in the store.
+type linkRecord struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Role      string `json:"role"`
+	NetworkID string `json:"network_id,omitempty"`
+	Endpoint  string `json:"endpoint_id,omitempty"`
+	Parent    string `json:"parent,omitempty"`
+	// Location is host, sandbox for joined children, or missing
+	Location string `json:"location"`
+	Orphaned bool   `json:"orphaned"`
+}
+
+// driverLinks cross references host links with the networks and endpoints
+// in the driver state. Joined children live in the container namespace and
+// are reported from the store only.
+func (d *driver) driverLinks() ([]*linkRecord, error) {
+	hostLinks, err := ns.NlHandle().LinkList()
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]netlink.Link, len(hostLinks))
+	byIndex := make(map[int]netlink.Link, len(hostLinks))
+	for _, link := range hostLinks {
+		byName[link.Attrs().Name] = link
+		byIndex[link.Attrs().Index] = link
+	}
+
+	var records []*linkRecord
+	known := make(map[string]bool)
+	parents := make(map[int]bool)
+	for _, n := range d.getNetworks() {
+		if link, ok := byName[n.config.Parent]; ok {
+			parents[link.Attrs().Index] = true
+		}
+		if n.config.CreatedSlaveLink {
+			rec := &linkRecord{
+				Name:      n.config.Parent,
+				Role:      linkRoleParent,
+				NetworkID: n.id,
+				Location:  "missing",
+			}
+			if link, ok := byName[n.config.Parent]; ok {
+				rec.Kind = link.Type()
+				rec.Location = "host"
+			}
+			known[rec.Name] = true
+			records = append(records, rec)
+		}
+		for _, ep := range n.getEndpoints() {
+			if ep.srcName == "" {
+				continue
+			}
+			rec := &linkRecord{
+				Name:      ep.srcName,
+				Kind:      "macvlan",
+				Role:      linkRoleChild,
+				NetworkID: n.id,
+				Endpoint:  ep.id,
+				Parent:    n.config.Parent,
+				Location:  "missing",
+			}
+			if _, ok := byName[ep.srcName]; ok {
+				rec.Location = "host"
+			} else if ep.sandboxKey != "" && !ep.sandboxGone() {
+				rec.Location = "sandbox"
+			}
+			known[rec.Name] = true
+			records = append(records, rec)
+		}
+	}
+
+	for _, link := range hostLinks {
+		attrs := link.Attrs()
+		if known[attrs.Name] || !d.looksDriverCreated(link, parents) {
+			continue
+		}
+		rec := &linkRecord{
+			Name:     attrs.Name,
+			Kind:     link.Type(),
+			Role:     linkRoleChild,
+			Location: "host",
+			Orphaned: true,
+		}
+		if link.Type() == "dummy" {
+			rec.Role = linkRoleParent
+		}
+		if parent, ok := byIndex[attrs.ParentIndex]; ok {
+			rec.Parent = parent.Attrs().Name
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+
+	return records, nil
+}
+
+// looksDriverCreated tells whether a host link carries the driver's naming or
+// hangs off a parent used by one of the networks
+func (d *driver) looksDriverCreated(link netlink.Link, parents map[int]bool) bool {
+	name := link.Attrs().Name
+	switch link.Type() {
+	case "dummy":
+		return strings.HasPrefix(name, dummyPrefix) || isDummyName(name)
+	case "macvlan":
+		if parents[link.Attrs().ParentIndex] {
+			return true
+		}
+		return d.opts.IfnameTemplate == "" && strings.HasPrefix(name, vethPrefix)
+	}
+
+	return false
+}
@@ -0,0 +1,54 @@
+package driver
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/docker/libnetwork/netutils"
+)
+
+// mac generators, set with -mac-generator
+const (
+	macGenLibnetwork = "libnetwork" // libnetwork's netutils.GenerateMACFromIP
+	macGenBuiltin    = "builtin"    // the driver's own random generator
+)
+
+// generateMac makes the MAC of an endpoint created without one
+var generateMac = libnetworkMac
+
+// libnetworkMac is the default generator, a random 02:42 prefixed MAC
+func libnetworkMac() net.HardwareAddr {
+	return netutils.GenerateMACFromIP(nil)
+}
+
+// newMacGenerator returns a generator reading from src, docker's 02:42 prefix
+// followed by four random bytes so the MACs look like the default ones. A
+// fixed src makes the generated sequence reproducible. A failing src panics,
+// crypto/rand only fails when the host has no usable entropy source and a
+// silently weaker generator would hide it.
+func newMacGenerator(src io.Reader) func() net.HardwareAddr {
+	return func() net.HardwareAddr {
+		mac := net.HardwareAddr{0x02, 0x42, 0, 0, 0, 0}
+		if _, err := io.ReadFull(src, mac[2:]); err != nil {
+			panic(fmt.Sprintf("MAC generator random source failed: %v", err))
+		}
+
+		return mac
+	}
+}
+
+// setMacGenerator selects the -mac-generator, libnetwork when empty
+func setMacGenerator(name string) error {
+	switch name {
+	case "", macGenLibnetwork:
+		generateMac = libnetworkMac
+	case macGenBuiltin:
+		generateMac = newMacGenerator(rand.Reader)
+	default:
+		return fmt.Errorf("invalid MAC generator %q, expected %s or %s", name, macGenLibnetwork, macGenBuiltin)
+	}
+
+	return nil
+}
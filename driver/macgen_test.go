@@ -0,0 +1,53 @@
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestMacGeneratorDeterministic(t *testing.T) {
+	seed := []byte{0x0a, 0x00, 0x00, 0x01, 0x0a, 0x00, 0x00, 0x02}
+	want := []string{"02:42:0a:00:00:01", "02:42:0a:00:00:02"}
+	for run := 0; run < 2; run++ {
+		gen := newMacGenerator(bytes.NewReader(seed))
+		for i, w := range want {
+			if mac := gen().String(); mac != w {
+				t.Errorf("run %d, MAC %d: got %s, want %s", run, i, mac, w)
+			}
+		}
+	}
+}
+
+func TestMacGeneratorPrefix(t *testing.T) {
+	gen := newMacGenerator(bytes.NewReader(bytes.Repeat([]byte{0xff}, 40)))
+	for i := 0; i < 10; i++ {
+		mac := gen()
+		if len(mac) != 6 || mac[0] != 0x02 || mac[1] != 0x42 {
+			t.Fatalf("MAC %s is not a 02:42 MAC", mac)
+		}
+	}
+}
+
+func TestMacGeneratorSourceFailure(t *testing.T) {
+	for name, src := range map[string]io.Reader{
+		// the short source fails on the second MAC
+		"short":  bytes.NewReader([]byte{0x0a, 0x00, 0x00, 0x01, 0x0a}),
+		"failed": iotest.ErrReader(errors.New("source failed")),
+	} {
+		gen := newMacGenerator(src)
+		if name == "short" {
+			gen()
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s source: the generator returned a MAC instead of panicking", name)
+				}
+			}()
+			gen()
+		}()
+	}
+}
@@ -0,0 +1,248 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/types"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// endpointLink locates the live macvlan child of an endpoint, inside the
+// container namespace once joined or on the host otherwise. The returned
+// release func must be called when done with the handle.
+func endpointLink(ep *endpoint) (*netlink.Handle, netlink.Link, func(), error) {
+	if ep.sandboxKey == "" {
+		link, err := ns.NlHandle().LinkByName(ep.srcName)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to find interface %s of endpoint %.7s: %v", ep.srcName, ep.id, err)
+		}
+		return ns.NlHandle(), link, func() {}, nil
+	}
+	h, err := sandboxHandle(ep.sandboxKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// the child is renamed inside the container, match it by its hardware address
+	links, err := h.LinkList()
+	if err != nil {
+		h.Delete()
+		return nil, nil, nil, fmt.Errorf("failed to list interfaces in sandbox %s: %v", ep.sandboxKey, err)
+	}
+	for _, link := range links {
+		if bytes.Equal(link.Attrs().HardwareAddr, ep.mac) {
+			return h, link, h.Delete, nil
+		}
+	}
+	h.Delete()
+
+	return nil, nil, nil, fmt.Errorf("no interface with MAC %s found in sandbox %s for endpoint %.7s", ep.mac, ep.sandboxKey, ep.id)
+}
+
+// endpointIfindex returns the kernel ifindex of the endpoint's macvlan child,
+// zero before Join created it
+func endpointIfindex(ep *endpoint) (int, error) {
+	if ep.srcName == "" {
+		return 0, nil
+	}
+	_, link, release, err := endpointLink(ep)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	return link.Attrs().Index, nil
+}
+
+// MAC address formats, selected with -mac-format
+const (
+	macFormatColon      = "colon"       // aa:bb:cc:dd:ee:ff
+	macFormatColonUpper = "colon-upper" // AA:BB:CC:DD:EE:FF
+	macFormatDash       = "dash"        // aa-bb-cc-dd-ee-ff
+	macFormatDashUpper  = "dash-upper"  // AA-BB-CC-DD-EE-FF
+)
+
+// formatMac renders a MAC in the -mac-format of api responses, the store
+// always keeps the colon form
+func (d *driver) formatMac(mac net.HardwareAddr) string {
+	s := mac.String()
+	switch d.opts.MacFormat {
+	case macFormatColonUpper:
+		return strings.ToUpper(s)
+	case macFormatDash:
+		return strings.Replace(s, ":", "-", -1)
+	case macFormatDashUpper:
+		return strings.ToUpper(strings.Replace(s, ":", "-", -1))
+	default:
+		return s
+	}
+}
+
+// endpointMac applies the MAC policy of the network's macvlan mode. A passthru
+// child inherits the parent's MAC, and setting another one changes the parent's
+// too, so the parent's MAC is reported. The other modes get a generated MAC,
+// unless the network requires externally managed MACs.
+func endpointMac(config *configuration, requested net.HardwareAddr) (net.HardwareAddr, error) {
+	if requested == nil && config.RequireMac {
+		return nil, types.BadRequestErrorf("network %.7s is created with -o %s=true, connect the container with --mac-address",
+			config.ID, requireMacOpt)
+	}
+	if err := checkMacAllowed(config, requested); err != nil {
+		return nil, err
+	}
+	if config.MacvlanMode != modePassthru {
+		if requested == nil {
+			return generateMac(), nil
+		}
+		return requested, nil
+	}
+	parentLink, err := ns.NlHandle().LinkByName(config.Parent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the MAC of passthru parent %s: %v", config.Parent, err)
+	}
+	parentMac := parentLink.Attrs().HardwareAddr
+	if requested == nil {
+		return parentMac, nil
+	}
+	if !bytes.Equal(requested, parentMac) {
+		logrus.Warnf("MAC %s requested on passthru network %.7s also replaces the MAC %s of parent %s",
+			requested, config.ID, parentMac, config.Parent)
+	}
+
+	return requested, nil
+}
+
+// parseMacAllowlist parses a comma separated -o mac_allowlist into the
+// canonical lowercase MAC form
+func parseMacAllowlist(value string) ([]string, error) {
+	var macs []string
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return nil, err
+		}
+		macs = append(macs, mac.String())
+	}
+	if len(macs) == 0 {
+		return nil, fmt.Errorf("the allowlist is empty")
+	}
+
+	return macs, nil
+}
+
+// checkMacAllowed rejects a MAC outside the network's -o mac_allowlist, and a
+// missing one since a generated MAC can't be in the list
+func checkMacAllowed(config *configuration, mac net.HardwareAddr) error {
+	if len(config.MacAllowlist) == 0 {
+		return nil
+	}
+	if mac == nil {
+		return types.BadRequestErrorf("network %.7s only allows the MACs in its -o %s, connect the container with --mac-address",
+			config.ID, macAllowOpt)
+	}
+	for _, allowed := range config.MacAllowlist {
+		if allowed == mac.String() {
+			return nil
+		}
+	}
+
+	return types.ForbiddenErrorf("MAC %s is not in the -o %s of network %.7s", mac, macAllowOpt, config.ID)
+}
+
+// checkMacUnique rejects a MAC already used by another endpoint of the network,
+// or of any network when -global-mac-uniqueness is set
+func (d *driver) checkMacUnique(n *network, eid string, mac net.HardwareAddr) error {
+	networks := []*network{n}
+	if d.opts.GlobalMacUniqueness {
+		networks = d.getNetworks()
+	}
+	for _, nw := range networks {
+		for _, other := range nw.getEndpoints() {
+			if other.id != eid && bytes.Equal(other.mac, mac) {
+				return types.ForbiddenErrorf("MAC address %s is already used by endpoint %.7s on network %.7s", mac, other.id, nw.id)
+			}
+		}
+	}
+
+	return nil
+}
+
+// addUniqueEndpoint saves and adds an endpoint after checking its MAC again, a
+// concurrent create or MAC change may have taken it since CreateEndpoint checked
+func (d *driver) addUniqueEndpoint(n *network, ep *endpoint) error {
+	d.macMu.Lock()
+	defer d.macMu.Unlock()
+	if err := d.checkMacUnique(n, ep.id, ep.mac); err != nil {
+		return err
+	}
+	if err := d.storeUpdate(ep); err != nil {
+		return fmt.Errorf("failed to save macvlan endpoint %.7s to store: %v", ep.id, err)
+	}
+	n.addEndpoint(ep)
+
+	return nil
+}
+
+// setEndpointMac validates a new MAC, applies it to the live interface and
+// persists it. The interface gets its old MAC back when the store write fails.
+func (d *driver) setEndpointMac(eid string, mac net.HardwareAddr) error {
+	n, ep := d.findEndpoint(eid)
+	if ep == nil {
+		return types.NotFoundErrorf("endpoint id %s not found", eid)
+	}
+	if n.config.MacvlanMode == modePassthru {
+		return types.ForbiddenErrorf("endpoint %.7s is on passthru network %.7s, its MAC is the MAC of parent %s",
+			ep.id, n.id, n.config.Parent)
+	}
+	if len(mac) != 6 {
+		return types.BadRequestErrorf("invalid MAC address %s, an ethernet address is required", mac)
+	}
+	ep.Lock()
+	defer ep.Unlock()
+	if mac[0]&0x01 != 0 {
+		return types.BadRequestErrorf("invalid MAC address %s, multicast addresses can not be assigned", mac)
+	}
+	if err := checkMacAllowed(n.config, mac); err != nil {
+		return err
+	}
+	d.macMu.Lock()
+	defer d.macMu.Unlock()
+	if err := d.checkMacUnique(n, ep.id, mac); err != nil {
+		return err
+	}
+	old := ep.mac
+	var undo func()
+	if ep.srcName != "" {
+		h, link, release, err := endpointLink(ep)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if err := h.LinkSetHardwareAddr(link, mac); err != nil {
+			return fmt.Errorf("failed to set MAC %s on interface %s: %v", mac, link.Attrs().Name, err)
+		}
+		undo = func() {
+			if err := h.LinkSetHardwareAddr(link, old); err != nil {
+				logrus.Warnf("Failed to set MAC %s back on interface %s: %v", old, link.Attrs().Name, err)
+			}
+		}
+	}
+	ep.mac = mac
+	if err := d.storeUpdate(ep); err != nil {
+		ep.mac = old
+		if undo != nil {
+			undo()
+		}
+		return fmt.Errorf("failed to save macvlan endpoint %.7s to store: %v", ep.id, err)
+	}
+	logrus.Infof("Changed MAC of endpoint %.7s from %s to %s", ep.id, old, mac)
+
+	return nil
+}
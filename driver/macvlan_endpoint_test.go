@@ -0,0 +1,123 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	networkapi "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/types"
+)
+
+func TestEndpointMac(t *testing.T) {
+	requested, _ := net.ParseMAC("02:42:0a:00:00:05")
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatalf("loopback interface: %v", err)
+	}
+	for _, mode := range []string{modePrivate, modeVepa, modeBridge, modePassthru} {
+		config := &configuration{ID: "n1", Parent: "lo", MacvlanMode: mode}
+
+		mac, err := endpointMac(config, requested)
+		if err != nil {
+			t.Fatalf("%s: requested MAC: %v", mode, err)
+		}
+		if !bytes.Equal(mac, requested) {
+			t.Errorf("%s: requested MAC %s became %s", mode, requested, mac)
+		}
+
+		mac, err = endpointMac(config, nil)
+		if err != nil {
+			t.Fatalf("%s: no MAC: %v", mode, err)
+		}
+		if mode == modePassthru {
+			// passthru children take the MAC of the parent
+			if !bytes.Equal(mac, lo.HardwareAddr) {
+				t.Errorf("%s: got %s, want the parent MAC %s", mode, mac, lo.HardwareAddr)
+			}
+			continue
+		}
+		if len(mac) != 6 || mac[0] != 0x02 || mac[1] != 0x42 {
+			t.Errorf("%s: generated MAC %s is not a 02:42 MAC", mode, mac)
+		}
+	}
+}
+
+func TestEndpointMacRequireMac(t *testing.T) {
+	config := &configuration{ID: "n1", Parent: "eth0", MacvlanMode: modeBridge, RequireMac: true}
+	if _, err := endpointMac(config, nil); err == nil {
+		t.Fatal("endpoint without a MAC accepted with require_mac")
+	} else if _, ok := err.(types.BadRequestError); !ok {
+		t.Errorf("got %T, want a bad request error", err)
+	}
+
+	requested, _ := net.ParseMAC("02:42:0a:00:00:05")
+	if _, err := endpointMac(config, requested); err != nil {
+		t.Errorf("endpoint with a MAC rejected with require_mac: %v", err)
+	}
+}
+
+func TestParseMacAllowlist(t *testing.T) {
+	macs, err := parseMacAllowlist(" 02:42:0A:00:00:05, ,02-42-0a-00-00-06")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(macs) != 2 || macs[0] != "02:42:0a:00:00:05" || macs[1] != "02:42:0a:00:00:06" {
+		t.Errorf("got %v, want the canonical MACs", macs)
+	}
+	for _, value := range []string{"", " , ", "02:42:0a:00:00:05,02:42"} {
+		if _, err := parseMacAllowlist(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
+
+func TestSetEndpointMac(t *testing.T) {
+	d := newTestDriver(Options{},
+		&configuration{ID: "n1", Parent: "eth0", MacvlanMode: modeBridge},
+		&configuration{ID: "n2", Parent: "eth1", MacvlanMode: modePassthru})
+	d.store = failingStore{}
+	old, _ := net.ParseMAC("02:42:0a:00:00:05")
+	mac, _ := net.ParseMAC("02:42:0a:00:00:06")
+	n1, _ := d.getNetwork("n1")
+	n1.addEndpoint(&endpoint{id: "e1", nid: "n1", mac: old})
+	n2, _ := d.getNetwork("n2")
+	n2.addEndpoint(&endpoint{id: "e2", nid: "n2", mac: old})
+
+	if err := d.setEndpointMac("e1", mac); err == nil {
+		t.Error("MAC change succeeded with a failing store")
+	}
+	if got := n1.endpoint("e1").mac; !bytes.Equal(got, old) {
+		t.Errorf("failed MAC change left MAC %s, want %s", got, old)
+	}
+	if _, ok := d.setEndpointMac("e2", mac).(types.ForbiddenError); !ok {
+		t.Error("MAC change on a passthru network was not refused")
+	}
+}
+
+func TestConcurrentCreatesKeepMacsUnique(t *testing.T) {
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "lo", MacvlanMode: modeBridge})
+	const creates = 20
+	var (
+		wg      sync.WaitGroup
+		created int32
+	)
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := d.CreateEndpoint(&networkapi.CreateEndpointRequest{NetworkID: "n1", EndpointID: fmt.Sprintf("e%d", i),
+				Interface: &networkapi.EndpointInterface{MacAddress: "02:42:0a:00:00:05"}})
+			if err == nil {
+				atomic.AddInt32(&created, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Errorf("%d concurrent creates with one MAC succeeded, want 1", created)
+	}
+}
@@ -1,21 +1,65 @@
 package driver
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/docker/docker/pkg/stringid"
 	"github.com/docker/libnetwork/ns"
 	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	dummyPrefix = "dm-" // macvlan prefix for dummy parent interface
+	maxAliasLen = 255   // IFALIASZ less the terminating nul
+	minMTU      = 68    // smallest mtu ipv4 allows
+	maxMTU      = 65535 // largest mtu a netdevice supports
+	vlanTagLen  = 4     // bytes an 802.1Q tag adds to a frame
+
+	sandboxWaitRetries  = 50 // polls for a link to be moved into a sandbox
+	sandboxWaitInterval = 100 * time.Millisecond
 )
 
+// netlinkRcvBufSize is applied to every netlink handle the driver opens, zero keeps the kernel default
+var netlinkRcvBufSize int
+
+// setNetlinkRcvBuf sizes the receive buffer of a netlink handle. The kernel caps
+// SO_RCVBUF at net.core.rmem_max, SO_RCVBUFFORCE lifts the cap but needs
+// CAP_NET_ADMIN, so the forced variant is tried first.
+func setNetlinkRcvBuf(h *netlink.Handle) {
+	if netlinkRcvBufSize <= 0 {
+		return
+	}
+	if err := h.SetSocketReceiveBufferSize(netlinkRcvBufSize, true); err == nil {
+		return
+	}
+	if err := h.SetSocketReceiveBufferSize(netlinkRcvBufSize, false); err != nil {
+		logrus.Warnf("Failed to set the netlink socket receive buffer to %d bytes: %v", netlinkRcvBufSize, err)
+		return
+	}
+	logrus.Warnf("Netlink socket receive buffer is capped by net.core.rmem_max, raise it to use %d bytes", netlinkRcvBufSize)
+}
+
 // Create the macvlan slave specifying the source name
-func createMacVlan(containerIfName, parent, macvlanMode string) (string, error) {
+func createMacVlan(containerIfName, parent, macvlanMode string, mtu int) (string, error) {
+	return createMacVlanQueues(containerIfName, parent, macvlanMode, mtu, 0, 0)
+}
+
+// createMacVlanQueues creates a macvlan slave with rx and tx queue counts, the
+// kernel default when zero, clamped to the queues of the parent
+func createMacVlanQueues(containerIfName, parent, macvlanMode string, mtu, rxQueues, txQueues int) (string, error) {
 	logrus.Infof("Handling createmacvlan %s(%s) mode %s", containerIfName, parent, macvlanMode)
 	// Set the macvlan mode. Default is bridge mode
 	mode, err := setMacVlanMode(macvlanMode)
@@ -31,22 +75,180 @@ func createMacVlan(containerIfName, parent, macvlanMode string) (string, error)
 	if err != nil {
 		return "", fmt.Errorf("error occurred looking up the %s parent iface %s error: %s", macvlanType, parent, err)
 	}
+	// the kernel refuses a macvlan over a bridge port, the bridge itself has to be used
+	if err := validateMacvlanParent(parentLink); err != nil {
+		return "", err
+	}
 	// Create a macvlan link
 	macvlan := &netlink.Macvlan{
 		LinkAttrs: netlink.LinkAttrs{
 			Name:        containerIfName,
 			ParentIndex: parentLink.Attrs().Index,
+			MTU:         mtu,
+			NumRxQueues: clampQueues("rx", rxQueues, parentLink.Attrs().NumRxQueues, parent),
+			NumTxQueues: clampQueues("tx", txQueues, parentLink.Attrs().NumTxQueues, parent),
 		},
 		Mode: mode,
 	}
 	if err := ns.NlHandle().LinkAdd(macvlan); err != nil {
 		// If a user creates a macvlan and ipvlan on same parent, only one slave iface can be active at a time.
-		return "", fmt.Errorf("failed to create the %s port: %v", macvlanType, err)
+		return "", linkAddError(fmt.Sprintf("create the %s port %s on %s", macvlanType, containerIfName, parent),
+			fmt.Sprintf("mode=%s mtu=%d parent mtu=%d", macvlanMode, mtu, parentLink.Attrs().MTU), "macvlan", err)
 	}
 
 	return macvlan.Attrs().Name, nil
 }
 
+// setLinkAlias sets the ifalias of a link, truncated to the kernel limit
+func setLinkAlias(linkName, alias string) error {
+	link, err := ns.NlHandle().LinkByName(linkName)
+	if err != nil {
+		return err
+	}
+	if len(alias) > maxAliasLen {
+		alias = alias[:maxAliasLen]
+	}
+
+	return ns.NlHandle().LinkSetAlias(link, alias)
+}
+
+// linkError wraps a netlink failure with the link parameters and, when the
+// errno is a known one, a hint at what the kernel is objecting to
+func linkError(action, params string, err error) error {
+	if hint := kernelHint(err); hint != "" {
+		return fmt.Errorf("failed to %s (%s): %s: %v", action, params, hint, err)
+	}
+
+	return fmt.Errorf("failed to %s (%s): %v", action, params, err)
+}
+
+// linkAddError is linkError for a link creation, naming the kernel module of
+// the link type when the kernel doesn't support the type and the module is not loaded
+func linkAddError(action, params, module string, err error) error {
+	if errno, ok := err.(syscall.Errno); ok && errno == syscall.EOPNOTSUPP && !moduleLoaded(module) {
+		return fmt.Errorf("failed to %s (%s): load the %s kernel module (modprobe %s): %v", action, params, module, module, err)
+	}
+
+	return linkError(action, params, err)
+}
+
+// moduleLoaded tells whether a kernel module is loaded or built in, both show in /sys/module
+func moduleLoaded(module string) bool {
+	_, err := os.Stat(filepath.Join("/sys/module", module))
+
+	return err == nil
+}
+
+// kernelHint translates the errnos netlink commonly returns for link changes
+func kernelHint(err error) string {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return ""
+	}
+	switch errno {
+	case syscall.EINVAL:
+		return "parent may not support this link type or a parameter is out of range"
+	case syscall.EBUSY:
+		return "parent is already claimed by another device type (bridge port or ipvlan)"
+	case syscall.EEXIST:
+		return "an interface with this name already exists"
+	case syscall.EOPNOTSUPP:
+		return "the kernel module for this link type may not be loaded"
+	case syscall.ENODEV:
+		return "the parent device disappeared"
+	case syscall.EPERM:
+		return "the plugin lacks CAP_NET_ADMIN"
+	default:
+		return ""
+	}
+}
+
+// supported -o iface_flags values
+const (
+	flagNoARP     = "noarp"
+	flagAllMulti  = "allmulti"
+	flagPromisc   = "promisc"
+	flagSeparator = ","
+)
+
+// parseIfaceFlags validates a comma separated -o iface_flags value
+func parseIfaceFlags(value string) ([]string, error) {
+	var flags []string
+	for _, flag := range strings.Split(value, flagSeparator) {
+		flag = strings.ToLower(strings.TrimSpace(flag))
+		switch flag {
+		case "":
+			continue
+		case flagNoARP, flagAllMulti, flagPromisc:
+			flags = append(flags, flag)
+		default:
+			return nil, fmt.Errorf("unsupported interface flag %q, supported flags are %s, %s and %s", flag, flagNoARP, flagAllMulti, flagPromisc)
+		}
+	}
+
+	return flags, nil
+}
+
+// setLinkFlags sets the validated -o iface_flags on a link
+func setLinkFlags(linkName string, flags []string) error {
+	link, err := ns.NlHandle().LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s to set flags on: %v", linkName, err)
+	}
+	for _, flag := range flags {
+		switch flag {
+		case flagNoARP:
+			err = ns.NlHandle().LinkSetARPOff(link)
+		case flagAllMulti:
+			err = ns.NlHandle().LinkSetAllmulticastOn(link)
+		case flagPromisc:
+			err = ns.NlHandle().SetPromiscOn(link)
+		}
+		if err != nil {
+			return linkError(fmt.Sprintf("set flag %s on %s", flag, linkName), "iface_flags="+strings.Join(flags, flagSeparator), err)
+		}
+	}
+
+	return nil
+}
+
+// setLinkMac sets the hardware address of a host link
+func setLinkMac(linkName string, mac net.HardwareAddr) error {
+	link, err := ns.NlHandle().LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s to set the mac on: %v", linkName, err)
+	}
+	if err := ns.NlHandle().LinkSetHardwareAddr(link, mac); err != nil {
+		return linkError(fmt.Sprintf("set mac %s on %s", mac, linkName), "stable_mac=true", err)
+	}
+
+	return nil
+}
+
+// setLinkDown sets a host link down, the -o leave_action=down of a left child
+func setLinkDown(linkName string) error {
+	link, err := ns.NlHandle().LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s to set down: %v", linkName, err)
+	}
+	if err := ns.NlHandle().LinkSetDown(link); err != nil {
+		return linkError(fmt.Sprintf("set %s down", linkName), "leave_action=down", err)
+	}
+
+	return nil
+}
+
+// delLink deletes a link by name, used to roll back a partially set up endpoint
+func delLink(linkName string) {
+	link, err := ns.NlHandle().LinkByName(linkName)
+	if err != nil {
+		return
+	}
+	if err := ns.NlHandle().LinkDel(link); err != nil {
+		logrus.WithError(err).Warnf("Failed to delete interface %s on rollback", linkName)
+	}
+}
+
 // setMacVlanMode setter for one of the four macvlan port types
 func setMacVlanMode(mode string) (netlink.MacvlanMode, error) {
 	switch mode {
@@ -63,6 +265,90 @@ func setMacVlanMode(mode string) (netlink.MacvlanMode, error) {
 	}
 }
 
+// validateMacvlanParent rejects parents the kernel will not attach a macvlan to
+func validateMacvlanParent(parentLink netlink.Link) error {
+	masterIndex := parentLink.Attrs().MasterIndex
+	if masterIndex == 0 {
+		return nil
+	}
+	master, err := ns.NlHandle().LinkByIndex(masterIndex)
+	if err != nil {
+		return fmt.Errorf("failed to look up the master of parent interface %s: %v", parentLink.Attrs().Name, err)
+	}
+	if _, ok := master.(*netlink.Bridge); ok {
+		return fmt.Errorf("parent interface %s is a port of bridge %s, use %s or a vlan sub-interface of it (ex. %s.10) as the macvlan parent",
+			parentLink.Attrs().Name, master.Attrs().Name, master.Attrs().Name, master.Attrs().Name)
+	}
+
+	return nil
+}
+
+// validateBridgeVlan verifies a vlan filtering bridge carries the vlan on its own port
+func validateBridgeVlan(bridge *netlink.Bridge, vid int) error {
+	if bridge.VlanFiltering == nil || !*bridge.VlanFiltering {
+		return nil
+	}
+	if err := requireKernel(featureVlanFiltering); err != nil {
+		return err
+	}
+	vlans, err := ns.NlHandle().BridgeVlanList()
+	if err != nil {
+		return fmt.Errorf("failed to read the vlan table of bridge %s: %v", bridge.Name, err)
+	}
+	for _, info := range vlans[int32(bridge.Index)] {
+		if int(info.Vid) == vid {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("bridge %s has vlan filtering enabled but vlan %d is not configured on the bridge itself, add it with 'bridge vlan add dev %s vid %d self'",
+		bridge.Name, vid, bridge.Name, vid)
+}
+
+// parentCarrier reports whether the parent has a physical carrier, a link
+// that is up without a cable plugged in has no IFF_LOWER_UP
+func parentCarrier(parent string) (bool, error) {
+	link, err := ns.NlHandle().LinkByName(parent)
+	if err != nil {
+		return false, fmt.Errorf("failed to find parent interface %s: %v", parent, err)
+	}
+	attrs := link.Attrs()
+	if attrs.RawFlags&unix.IFF_LOWER_UP == 0 || attrs.OperState == netlink.OperDown || attrs.OperState == netlink.OperLowerLayerDown {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// isWireless reports whether the interface is a wifi device, which has a
+// wireless directory in sysfs
+func isWireless(iface string) bool {
+	_, err := os.Stat(filepath.Join("/sys/class/net", iface, "wireless"))
+
+	return err == nil
+}
+
+// parentChildren lists the host links stacked on the parent, such as macvlan
+// children, that would break if the parent were deleted
+func parentChildren(parent string) ([]string, error) {
+	parentLink, err := ns.NlHandle().LinkByName(parent)
+	if err != nil {
+		return nil, nil
+	}
+	links, err := ns.NlHandle().LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host interfaces: %v", err)
+	}
+	var children []string
+	for _, link := range links {
+		if link.Attrs().ParentIndex == parentLink.Attrs().Index {
+			children = append(children, link.Attrs().Name)
+		}
+	}
+
+	return children, nil
+}
+
 // parentExists checks if the specified interface exists in the default namespace
 func parentExists(ifaceStr string) bool {
 	_, err := ns.NlHandle().LinkByName(ifaceStr)
@@ -73,6 +359,43 @@ func parentExists(ifaceStr string) bool {
 	return true
 }
 
+// parentIPv4 returns the first ipv4 address of the parent, nil when it has none
+func parentIPv4(parent string) (net.IP, error) {
+	link, err := ns.NlHandle().LinkByName(parent)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ns.NlHandle().AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	return addrs[0].IP, nil
+}
+
+// defaultRouteParent returns the interface of the ipv4 default route
+func defaultRouteParent() (string, error) {
+	routes, err := ns.NlHandle().RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+	for _, route := range routes {
+		if route.Dst != nil || route.LinkIndex == 0 {
+			continue
+		}
+		link, err := ns.NlHandle().LinkByIndex(route.LinkIndex)
+		if err != nil {
+			return "", err
+		}
+		return link.Attrs().Name, nil
+	}
+
+	return "", fmt.Errorf("the host has no ipv4 default route")
+}
+
 // createVlanLink parses sub-interfaces and vlan id for creation
 func createVlanLink(parentName string) error {
 	logrus.Infof("Handling createVlanLink %s", parentName)
@@ -90,6 +413,12 @@ func createVlanLink(parentName string) error {
 		if err != nil {
 			return fmt.Errorf("failed to find master interface %s on the Docker host: %v", parent, err)
 		}
+		// a vlan filtering bridge drops tagged frames for vlans the bridge is not a member of
+		if bridge, ok := parentLink.(*netlink.Bridge); ok {
+			if err := validateBridgeVlan(bridge, vidInt); err != nil {
+				return err
+			}
+		}
 		vlanLink := &netlink.Vlan{
 			LinkAttrs: netlink.LinkAttrs{
 				Name:        parentName,
@@ -99,11 +428,11 @@ func createVlanLink(parentName string) error {
 		}
 		// create the subinterface
 		if err := ns.NlHandle().LinkAdd(vlanLink); err != nil {
-			return fmt.Errorf("failed to create %s vlan link: %v", vlanLink.Name, err)
+			return linkAddError(fmt.Sprintf("create vlan link %s on %s", vlanLink.Name, parent), fmt.Sprintf("vlan=%d", vidInt), "8021q", err)
 		}
 		// Bring the new netlink iface up
 		if err := ns.NlHandle().LinkSetUp(vlanLink); err != nil {
-			return fmt.Errorf("failed to enable %s the macvlan parent link %v", vlanLink.Name, err)
+			return linkError(fmt.Sprintf("enable the macvlan parent link %s", vlanLink.Name), fmt.Sprintf("vlan=%d", vidInt), err)
 		}
 		logrus.Debugf("Added a vlan tagged netlink subinterface: %s with a vlan id: %d", parentName, vidInt)
 		return nil
@@ -131,7 +460,7 @@ func delVlanLink(linkName string) error {
 		}
 		// delete the macvlan slave device
 		if err := ns.NlHandle().LinkDel(vlanLink); err != nil {
-			return fmt.Errorf("failed to delete  %s link: %v", linkName, err)
+			return linkError(fmt.Sprintf("delete vlan link %s", linkName), fmt.Sprintf("parent index=%d", vlanLink.Attrs().ParentIndex), err)
 		}
 		logrus.Debugf("Deleted a vlan tagged netlink subinterface: %s", linkName)
 	}
@@ -161,6 +490,26 @@ func parseVlan(linkName string) (string, int, error) {
 	return parent, vidInt, nil
 }
 
+// vlanKey names the physical parent and vlan of a parent interface, lower.vid
+// for a vlan link, existing or to be created, and the parent itself otherwise
+func vlanKey(parent string) string {
+	if link, err := ns.NlHandle().LinkByName(parent); err == nil {
+		vlan, ok := link.(*netlink.Vlan)
+		if !ok {
+			return parent
+		}
+		if lower, err := ns.NlHandle().LinkByIndex(vlan.ParentIndex); err == nil {
+			return fmt.Sprintf("%s.%d", lower.Attrs().Name, vlan.VlanId)
+		}
+		return parent
+	}
+	if lower, vid, err := parseVlan(parent); err == nil {
+		return fmt.Sprintf("%s.%d", lower, vid)
+	}
+
+	return parent
+}
+
 // createDummyLink creates a dummy0 parent link
 func createDummyLink(dummyName, truncNetID string) error {
 	logrus.Infof("Handling createDummyLink %s", dummyName)
@@ -171,7 +520,7 @@ func createDummyLink(dummyName, truncNetID string) error {
 		},
 	}
 	if err := ns.NlHandle().LinkAdd(parent); err != nil {
-		return err
+		return linkAddError(fmt.Sprintf("create dummy parent link %s", dummyName), "type=dummy", "dummy", err)
 	}
 	parentDummyLink, err := ns.NlHandle().LinkByName(dummyName)
 	if err != nil {
@@ -179,7 +528,7 @@ func createDummyLink(dummyName, truncNetID string) error {
 	}
 	// bring the new netlink iface up
 	if err := ns.NlHandle().LinkSetUp(parentDummyLink); err != nil {
-		return fmt.Errorf("failed to enable %s the macvlan parent link: %v", dummyName, err)
+		return linkError(fmt.Sprintf("enable the macvlan parent link %s", dummyName), "type=dummy", err)
 	}
 
 	return nil
@@ -198,14 +547,193 @@ func delDummyLink(linkName string) error {
 	}
 	// delete the macvlan dummy device
 	if err := ns.NlHandle().LinkDel(dummyLink); err != nil {
-		return fmt.Errorf("failed to delete the dummy %s link: %v", linkName, err)
+		return linkError(fmt.Sprintf("delete the dummy link %s", linkName), "type=dummy", err)
 	}
 	logrus.Debugf("Deleted a dummy parent link: %s", linkName)
 
 	return nil
 }
 
+// validateSandboxKey checks that sandboxKey names a network namespace docker can
+// move a link into, so Join fails before creating a child that would be stranded
+func validateSandboxKey(sandboxKey string) error {
+	if sandboxKey == "" {
+		return fmt.Errorf("empty sandbox key")
+	}
+	if !filepath.IsAbs(sandboxKey) {
+		return fmt.Errorf("sandbox key %q is not an absolute path", sandboxKey)
+	}
+	var fs unix.Statfs_t
+	if err := unix.Statfs(sandboxKey, &fs); err != nil {
+		return fmt.Errorf("sandbox %s is not accessible: %v", sandboxKey, err)
+	}
+	// namespace files are on nsfs, or on procfs before linux 3.19
+	if fs.Type != unix.NSFS_MAGIC && fs.Type != unix.PROC_SUPER_MAGIC {
+		return fmt.Errorf("sandbox %s is not a network namespace", sandboxKey)
+	}
+	nsh, err := netns.GetFromPath(sandboxKey)
+	if err != nil {
+		return fmt.Errorf("sandbox %s is not a network namespace: %v", sandboxKey, err)
+	}
+	nsh.Close()
+
+	return nil
+}
+
+// sandboxHandle returns a netlink handle in the container namespace at sandboxKey
+func sandboxHandle(sandboxKey string) (*netlink.Handle, error) {
+	nsh, err := netns.GetFromPath(sandboxKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sandbox %s: %v", sandboxKey, err)
+	}
+	defer nsh.Close()
+	h, err := netlink.NewHandleAt(nsh)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a netlink handle in sandbox %s: %v", sandboxKey, err)
+	}
+	setNetlinkRcvBuf(h)
+
+	return h, nil
+}
+
+// inSandbox runs fn with the calling thread switched into the container namespace at sandboxKey
+func inSandbox(sandboxKey string, fn func() error) error {
+	target, err := netns.GetFromPath(sandboxKey)
+	if err != nil {
+		return fmt.Errorf("failed to open sandbox %s: %v", sandboxKey, err)
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to get the current namespace: %v", err)
+	}
+	defer origin.Close()
+	if err := netns.Set(target); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter sandbox %s: %v", sandboxKey, err)
+	}
+	fnErr := fn()
+	if err := netns.Set(origin); err != nil {
+		// leave the thread locked so the runtime discards it rather than reusing it in the sandbox
+		return fmt.Errorf("failed to return from sandbox %s: %v", sandboxKey, err)
+	}
+	runtime.UnlockOSThread()
+
+	return fnErr
+}
+
+// waitSandboxLink waits for docker to move the macvlan child with the given MAC
+// into the sandbox and returns its name there
+func waitSandboxLink(sandboxKey string, mac net.HardwareAddr) (string, bool) {
+	for i := 0; i < sandboxWaitRetries; i++ {
+		time.Sleep(sandboxWaitInterval)
+		h, err := sandboxHandle(sandboxKey)
+		if err != nil {
+			continue
+		}
+		links, err := h.LinkList()
+		h.Delete()
+		if err != nil {
+			continue
+		}
+		for _, link := range links {
+			if bytes.Equal(link.Attrs().HardwareAddr, mac) {
+				return link.Attrs().Name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// waitHostLink waits for docker to move a child out of its sandbox back to the host
+func waitHostLink(name string) bool {
+	for i := 0; i < sandboxWaitRetries; i++ {
+		time.Sleep(sandboxWaitInterval)
+		if parentExists(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// disableSandboxIPv6 waits for docker to move the macvlan child with the given MAC
+// into the sandbox and sets net.ipv6.conf.<iface>.disable_ipv6 on it there
+func disableSandboxIPv6(sandboxKey string, mac net.HardwareAddr) {
+	name, ok := waitSandboxLink(sandboxKey, mac)
+	if !ok {
+		logrus.Warnf("Interface with MAC %s did not appear in sandbox %s, ipv6 was not disabled", mac, sandboxKey)
+		return
+	}
+	err := inSandbox(sandboxKey, func() error {
+		return ioutil.WriteFile(filepath.Join("/proc/sys/net/ipv6/conf", name, "disable_ipv6"), []byte("1"), 0644)
+	})
+	if err != nil {
+		logrus.Warnf("Failed to disable ipv6 on %s in sandbox %s: %v", name, sandboxKey, err)
+		return
+	}
+	logrus.Debugf("Disabled ipv6 on %s in sandbox %s", name, sandboxKey)
+}
+
 // getDummyName returns the name of a dummy parent with truncated net ID and driver prefix
 func getDummyName(netID string) string {
 	return dummyPrefix + netID
 }
+
+// dummyPrefixes are the dummy parent name prefixes by network id length, a
+// longer id gets a shorter prefix to still fit IFNAMSIZ
+var dummyPrefixes = map[int]string{12: dummyPrefix, 13: "dm", 14: "d"}
+
+// dummy parent id lengths -dummy-id-len accepts, the 12 character id docker shows by default
+const (
+	minDummyIDLen = 12
+	maxDummyIDLen = 14
+)
+
+// dummyIDLen is the network id length of new dummy parent names, set with -dummy-id-len
+var dummyIDLen = minDummyIDLen
+
+// dummyNameLen returns the dummy parent name of a network with n id characters
+func dummyNameLen(netID string, n int) string {
+	if n == minDummyIDLen {
+		return getDummyName(stringid.TruncateID(netID))
+	}
+	if len(netID) > n {
+		netID = netID[:n]
+	}
+
+	return dummyPrefixes[n] + netID
+}
+
+// dummyNameFor returns the dummy parent name of a new network
+func dummyNameFor(netID string) string {
+	return dummyNameLen(netID, dummyIDLen)
+}
+
+// isDummyNameFor tells whether name is a dummy parent name of the network, of
+// any id length so parents named before a -dummy-id-len change still match
+func isDummyNameFor(name, netID string) bool {
+	for n := minDummyIDLen; n <= maxDummyIDLen; n++ {
+		if name == dummyNameLen(netID, n) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isDummyName tells whether name has the form of a dummy parent name
+func isDummyName(name string) bool {
+	for n, prefix := range dummyPrefixes {
+		id := strings.TrimPrefix(name, prefix)
+		if id != name && len(id) == n && strings.Trim(id, "0123456789abcdef") == "" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/docker/libnetwork/types"
+)
+
+func TestParseIfaceFlags(t *testing.T) {
+	flags, err := parseIfaceFlags(" NoARP,allmulti,,promisc ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{flagNoARP, flagAllMulti, flagPromisc}; !reflect.DeepEqual(flags, want) {
+		t.Errorf("got %v, want %v", flags, want)
+	}
+	if flags, err := parseIfaceFlags(""); err != nil || len(flags) != 0 {
+		t.Errorf("empty value: got %v, %v", flags, err)
+	}
+	if _, err := parseIfaceFlags("noarp,multicast"); err == nil {
+		t.Error("unsupported flag accepted")
+	}
+}
+
+func TestIsDummyNameFor(t *testing.T) {
+	id := "2f1c1e8a9b7d4c3e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e"
+	name := dummyNameFor(id)
+	if len(name) > maxIfaceNameLen {
+		t.Errorf("dummy name %s is longer than %d characters", name, maxIfaceNameLen)
+	}
+	if !isDummyNameFor(name, id) {
+		t.Errorf("%s is not the dummy name of its network", name)
+	}
+	// a network whose id shares the shorter prefix has another dummy parent
+	for _, other := range []string{dummyPrefix + id[:7], dummyPrefix + id[:11], "eth0"} {
+		if isDummyNameFor(other, id) {
+			t.Errorf("%s matched network %.12s", other, id)
+		}
+	}
+
+	// longer ids get a shorter prefix, parents named with another length still match
+	defer func() { dummyIDLen = minDummyIDLen }()
+	for n := minDummyIDLen; n <= maxDummyIDLen; n++ {
+		dummyIDLen = n
+		long := dummyNameFor(id)
+		if len(long) != maxIfaceNameLen {
+			t.Errorf("dummy name %s with %d id characters is %d characters long, want %d", long, n, len(long), maxIfaceNameLen)
+		}
+		if !isDummyNameFor(name, id) || !isDummyNameFor(long, id) || !isDummyName(long) {
+			t.Errorf("%d id characters: %s or %s is not a dummy name of its network", n, name, long)
+		}
+	}
+	if isDummyName("dummy0") || isDummyName("docker0") {
+		t.Error("a host dummy link was taken for a dummy parent")
+	}
+}
+
+func TestValidateSandboxKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sandbox")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "var/run/docker/netns/1a2b", "/nonexistent/netns", file} {
+		if err := validateSandboxKey(key); err == nil {
+			t.Errorf("sandbox key %q accepted", key)
+		}
+	}
+	if err := validateSandboxKey("/proc/self/ns/net"); err != nil {
+		t.Errorf("namespace path rejected: %v", err)
+	}
+}
+
+func TestIfaceFlagsOptionError(t *testing.T) {
+	err := (&configuration{}).fromOptions(map[string]string{ifaceFlagsOpt: "noarp,multicast"})
+	if _, ok := err.(types.BadRequestError); !ok {
+		t.Errorf("got %T %v, want a bad request error", err, err)
+	}
+}
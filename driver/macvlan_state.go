@@ -51,6 +51,19 @@ func (n *network) endpoint(eid string) *endpoint {
 	return n.endpoints[eid]
 }
 
+// getEndpoints Safely returns a slice of the network's endpoints
+func (n *network) getEndpoints() []*endpoint {
+	n.Lock()
+	defer n.Unlock()
+
+	ls := make([]*endpoint, 0, len(n.endpoints))
+	for _, ep := range n.endpoints {
+		ls = append(ls, ep)
+	}
+
+	return ls
+}
+
 func (n *network) addEndpoint(ep *endpoint) {
 	n.Lock()
 	n.endpoints[ep.id] = ep
@@ -76,6 +89,17 @@ func (n *network) getEndpoint(eid string) (*endpoint, error) {
 	return nil, nil
 }
 
+// findEndpoint looks up an endpoint by id across all networks
+func (d *driver) findEndpoint(eid string) (*network, *endpoint) {
+	for _, n := range d.getNetworks() {
+		if ep := n.endpoint(eid); ep != nil {
+			return n, ep
+		}
+	}
+
+	return nil, nil
+}
+
 func validateID(nid, eid string) error {
 	if nid == "" {
 		return fmt.Errorf("invalid network id")
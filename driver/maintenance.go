@@ -0,0 +1,34 @@
+package driver
+
+import (
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maintenanceState is the /maintenance view
+type maintenanceState struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+// inMaintenance tells whether background repairs of host links are paused,
+// plugin api calls are served either way
+func (d *driver) inMaintenance() bool {
+	return atomic.LoadInt32(&d.maintenance) == 1
+}
+
+// setMaintenance pauses or resumes background repairs
+func (d *driver) setMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&d.maintenance, v) == v {
+		return
+	}
+	if on {
+		logrus.Warnf("Entering maintenance mode, host links are not repaired until it is turned off")
+	} else {
+		logrus.Infof("Leaving maintenance mode, resuming host link repairs")
+	}
+}
@@ -0,0 +1,141 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	networkapi "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/sirupsen/logrus"
+)
+
+// manifestNetwork is a network declared in the -networks-manifest file, the
+// options are the docker network create -o options
+type manifestNetwork struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Parent   string            `json:"parent"`
+	Mode     string            `json:"mode"`
+	Internal bool              `json:"internal"`
+	Options  map[string]string `json:"options"`
+}
+
+// manifestResult is the outcome of the last manifest reconcile, served on /manifest
+type manifestResult struct {
+	Path    string              `json:"path"`
+	Created []string            `json:"created,omitempty"`
+	InSync  []string            `json:"in_sync,omitempty"`
+	Drift   map[string][]string `json:"drift,omitempty"`
+	Failed  map[string]string   `json:"failed,omitempty"`
+}
+
+// networkID is the declared id, or one derived from the name so the same
+// manifest entry always maps to the same network
+func (m *manifestNetwork) networkID() string {
+	if m.ID != "" {
+		return m.ID
+	}
+	sum := sha256.Sum256([]byte("macvlan-noipam/" + m.Name))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// labels returns the entry as the -o options of docker network create
+func (m *manifestNetwork) labels() map[string]string {
+	labels := make(map[string]string, len(m.Options)+2)
+	for k, v := range m.Options {
+		labels[k] = v
+	}
+	if m.Parent != "" {
+		labels[parentOpt] = m.Parent
+	}
+	if m.Mode != "" {
+		labels[driverModeOpt] = m.Mode
+	}
+
+	return labels
+}
+
+// loadManifest reads a json list of networks
+func loadManifest(path string) ([]*manifestNetwork, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read networks manifest: %v", err)
+	}
+	var networks []*manifestNetwork
+	if err := json.Unmarshal(b, &networks); err != nil {
+		return nil, fmt.Errorf("failed to parse networks manifest %s: %v", path, err)
+	}
+	seen := make(map[string]bool)
+	for i, m := range networks {
+		if m.ID == "" && m.Name == "" {
+			return nil, fmt.Errorf("network %d of manifest %s has neither an id nor a name", i, path)
+		}
+		if seen[m.networkID()] {
+			return nil, fmt.Errorf("network %s is declared twice in manifest %s", m.networkID(), path)
+		}
+		seen[m.networkID()] = true
+	}
+
+	return networks, nil
+}
+
+// applyManifest creates the declared networks missing from the store and
+// reports those whose stored options drifted from the manifest. Drifted
+// networks are left alone, recreating them would cut off their containers.
+// The networks exist in the plugin store only and docker never learns about
+// them, they set up and hold their parent but containers can't join them.
+func (d *driver) applyManifest(path string) (*manifestResult, error) {
+	networks, err := loadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	result := &manifestResult{Path: path, Drift: make(map[string][]string), Failed: make(map[string]string)}
+	for _, m := range networks {
+		id := m.networkID()
+		config, err := parseNetworkOptions(id, map[string]interface{}{netlabel.GenericData: m.labels()})
+		if err == nil {
+			config.ID = id
+			config.Internal = m.Internal
+			err = d.validateNetworkConfig(config)
+		}
+		if err != nil {
+			result.Failed[id] = err.Error()
+			continue
+		}
+		if n, err := d.getNetwork(id); err == nil {
+			if diff := configDiff(n.config, config); len(diff) > 0 {
+				result.Drift[id] = diff
+				logrus.Warnf("Network %.7s drifted from manifest %s: %s", id, path, strings.Join(diff, ", "))
+			} else {
+				result.InSync = append(result.InSync, id)
+			}
+			continue
+		}
+		req := &networkapi.CreateNetworkRequest{
+			NetworkID: id,
+			Options: map[string]interface{}{
+				netlabel.GenericData: m.labels(),
+				netlabel.Internal:    m.Internal,
+			},
+		}
+		if err := d.CreateNetwork(req); err != nil {
+			result.Failed[id] = err.Error()
+			logrus.Errorf("Failed to create network %.7s from manifest %s: %v", id, path, err)
+			continue
+		}
+		result.Created = append(result.Created, id)
+		logrus.Infof("Created network %.7s from manifest %s", id, path)
+	}
+	sort.Strings(result.Created)
+	sort.Strings(result.InSync)
+	logrus.Infof("Applied networks manifest %s: %d created, %d in sync, %d drifted, %d failed",
+		path, len(result.Created), len(result.InSync), len(result.Drift), len(result.Failed))
+
+	return result, nil
+}
@@ -0,0 +1,74 @@
+package driver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// netStatsTTL is how long aggregated network stats are served from cache
+const netStatsTTL = 5 * time.Second
+
+// networkStats sums the interface counters of a network's endpoints
+type networkStats struct {
+	Label     string `json:"label,omitempty"`
+	Endpoints int    `json:"endpoints"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	TxPackets uint64 `json:"tx_packets"`
+	RxDropped uint64 `json:"rx_dropped"`
+	TxDropped uint64 `json:"tx_dropped"`
+	// Unreadable counts endpoints without a live interface to read
+	Unreadable int `json:"unreadable"`
+}
+
+// netStatsCache holds the last aggregation so admin polling doesn't walk
+// every container namespace on each request
+type netStatsCache struct {
+	sync.Mutex
+	at    time.Time
+	stats map[string]*networkStats
+}
+
+// networkStats returns the per network traffic totals keyed by network id,
+// recomputed from netlink at most once per netStatsTTL
+func (d *driver) networkStats() map[string]*networkStats {
+	d.netStats.Lock()
+	defer d.netStats.Unlock()
+	if d.netStats.stats != nil && time.Since(d.netStats.at) < netStatsTTL {
+		return d.netStats.stats
+	}
+	all := make(map[string]*networkStats)
+	for _, n := range d.getNetworks() {
+		stats := &networkStats{Label: n.config.Label}
+		for _, ep := range n.getEndpoints() {
+			stats.Endpoints++
+			if ep.srcName == "" {
+				stats.Unreadable++
+				continue
+			}
+			_, link, release, err := endpointLink(ep)
+			if err != nil {
+				logrus.Debugf("Skipping endpoint %.7s in network stats: %v", ep.id, err)
+				stats.Unreadable++
+				continue
+			}
+			release()
+			if s := link.Attrs().Statistics; s != nil {
+				stats.RxBytes += s.RxBytes
+				stats.TxBytes += s.TxBytes
+				stats.RxPackets += s.RxPackets
+				stats.TxPackets += s.TxPackets
+				stats.RxDropped += s.RxDropped
+				stats.TxDropped += s.TxDropped
+			}
+		}
+		all[n.id] = stats
+	}
+	d.netStats.stats = all
+	d.netStats.at = time.Now()
+
+	return all
+}
@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// opCounters counts successful network and endpoint operations since start
+type opCounters struct {
+	networksCreated  int64
+	networksDeleted  int64
+	endpointsCreated int64
+	endpointsDeleted int64
+}
+
+// driverStats is the uptime and operation count view served on /stats
+type driverStats struct {
+	Uptime           string  `json:"uptime"`
+	UptimeSeconds    float64 `json:"uptime_seconds"`
+	Networks         int     `json:"networks"`
+	Endpoints        int     `json:"endpoints"`
+	NetworksCreated  int64   `json:"networks_created"`
+	NetworksDeleted  int64   `json:"networks_deleted"`
+	EndpointsCreated int64   `json:"endpoints_created"`
+	EndpointsDeleted int64   `json:"endpoints_deleted"`
+	// Latency is keyed by plugin api call, ex. CreateEndpoint
+	Latency map[string]opLatency `json:"latency,omitempty"`
+}
+
+// opLatency sums the handling time of one plugin api call
+type opLatency struct {
+	Count   int64   `json:"count"`
+	TotalMs float64 `json:"total_ms"`
+	MaxMs   float64 `json:"max_ms"`
+}
+
+// opLatencies records the latency of every plugin api call, read by /stats and -statsd-addr
+type opLatencies struct {
+	sync.Mutex
+	ops map[string]*opLatency
+}
+
+// observeOp records the time a plugin api call took since start
+func (d *driver) observeOp(op string, start time.Time) {
+	ms := float64(time.Since(start)) / float64(time.Millisecond)
+	d.latency.Lock()
+	defer d.latency.Unlock()
+	l, ok := d.latency.ops[op]
+	if !ok {
+		l = &opLatency{}
+		d.latency.ops[op] = l
+	}
+	l.Count++
+	l.TotalMs += ms
+	if ms > l.MaxMs {
+		l.MaxMs = ms
+	}
+}
+
+// latencies returns a copy of the per call latencies
+func (d *driver) latencies() map[string]opLatency {
+	d.latency.Lock()
+	defer d.latency.Unlock()
+	ops := make(map[string]opLatency, len(d.latency.ops))
+	for op, l := range d.latency.ops {
+		ops[op] = *l
+	}
+
+	return ops
+}
+
+func (d *driver) stats() *driverStats {
+	uptime := time.Since(d.started)
+	stats := &driverStats{
+		Uptime:           uptime.Round(time.Second).String(),
+		UptimeSeconds:    uptime.Seconds(),
+		NetworksCreated:  atomic.LoadInt64(&d.counters.networksCreated),
+		NetworksDeleted:  atomic.LoadInt64(&d.counters.networksDeleted),
+		EndpointsCreated: atomic.LoadInt64(&d.counters.endpointsCreated),
+		EndpointsDeleted: atomic.LoadInt64(&d.counters.endpointsDeleted),
+		Latency:          d.latencies(),
+	}
+	for _, n := range d.getNetworks() {
+		stats.Networks++
+		stats.Endpoints += len(n.getEndpoints())
+	}
+
+	return stats
+}
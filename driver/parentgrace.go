@@ -0,0 +1,74 @@
+package driver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// parentGrace holds the driver created parents whose deletion is delayed by
+// -parent-delete-grace, a network recreated on one of them in time keeps it
+type parentGrace struct {
+	sync.Mutex
+	pending map[string]*pendingParent
+}
+
+// pendingParent is a parent waiting for deletion and the link type the
+// driver created it as, handed to the network reclaiming it
+type pendingParent struct {
+	timer    *time.Timer
+	linkType string
+}
+
+func newParentGrace() *parentGrace {
+	return &parentGrace{pending: make(map[string]*pendingParent)}
+}
+
+// deleteParentLater deletes a driver created vlan parent after the grace
+// period, or right away without one. A dummy parent is named after its network
+// id, no new network can reuse it, so it is deleted right away too. A pending
+// deletion is lost on a plugin restart, the parent then shows as an orphan on
+// /links.
+func (d *driver) deleteParentLater(config *configuration) {
+	linkType := config.parentLinkType()
+	if d.opts.ParentDeleteGrace <= 0 || linkType != parentLinkVlan {
+		delParentLink(config)
+		return
+	}
+	d.grace.Lock()
+	defer d.grace.Unlock()
+	if p, ok := d.grace.pending[config.Parent]; ok {
+		p.timer.Stop()
+	}
+	logrus.Debugf("Deleting parent %s in %s unless a network is created on it", config.Parent, d.opts.ParentDeleteGrace)
+	p := &pendingParent{linkType: linkType}
+	d.grace.pending[config.Parent] = p
+	p.timer = time.AfterFunc(d.opts.ParentDeleteGrace, func() {
+		d.grace.Lock()
+		if d.grace.pending[config.Parent] == p {
+			delete(d.grace.pending, config.Parent)
+		}
+		d.grace.Unlock()
+		if users := d.parentUsers(config); len(users) > 0 {
+			logrus.Debugf("Keeping parent %s, network %.7s was created on it", config.Parent, users[0].id)
+			return
+		}
+		delParentLink(config)
+	})
+}
+
+// reclaimParent cancels the pending deletion of a parent, returning the
+// recorded link type the new network owns it as, empty when nothing was reclaimed
+func (d *driver) reclaimParent(parent string) string {
+	d.grace.Lock()
+	defer d.grace.Unlock()
+	p, ok := d.grace.pending[parent]
+	if !ok || p.linkType == "" || !p.timer.Stop() {
+		return ""
+	}
+	delete(d.grace.pending, parent)
+	logrus.Infof("Reusing parent %s pending deletion", parent)
+
+	return p.linkType
+}
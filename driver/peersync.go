@@ -0,0 +1,131 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/docker/libnetwork/datastore"
+	"github.com/sirupsen/logrus"
+)
+
+// storeSnapshot is the full persistent state served on /store-sync to standby instances
+type storeSnapshot struct {
+	Networks  []*configuration `json:"networks"`
+	Endpoints []*endpoint      `json:"endpoints"`
+}
+
+// snapshotStore reads every network and endpoint record from the store
+func (d *driver) snapshotStore() (*storeSnapshot, error) {
+	snap := &storeSnapshot{Networks: []*configuration{}, Endpoints: []*endpoint{}}
+	if d.store == nil {
+		return snap, nil
+	}
+	d.FlushStore()
+	kvol, err := d.store.List(datastore.Key(macvlanNetworkPrefix), &configuration{})
+	if err != nil && err != datastore.ErrKeyNotFound {
+		return nil, fmt.Errorf("failed to get macvlan network configurations from store: %v", err)
+	}
+	for _, kvo := range kvol {
+		snap.Networks = append(snap.Networks, kvo.(*configuration))
+	}
+	kvol, err = d.store.List(datastore.Key(macvlanEndpointPrefix), &endpoint{})
+	if err != nil && err != datastore.ErrKeyNotFound {
+		return nil, fmt.Errorf("failed to get macvlan endpoints from store: %v", err)
+	}
+	for _, kvo := range kvol {
+		snap.Endpoints = append(snap.Endpoints, kvo.(*endpoint))
+	}
+
+	return snap, nil
+}
+
+// restoreSnapshot makes the local store an exact copy of a peer snapshot. Only
+// the store is written, links are recreated from it when this instance restarts
+// as the primary. The writes go through the store helpers, a synced record
+// takes the index of the local one it replaces.
+func (d *driver) restoreSnapshot(snap *storeSnapshot) error {
+	if d.store == nil {
+		return fmt.Errorf("macvlan store not initialized")
+	}
+	local, err := d.snapshotStore()
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]datastore.KVObject, len(local.Networks)+len(local.Endpoints))
+	for _, config := range local.Networks {
+		stored[datastore.Key(config.Key()...)] = config
+	}
+	for _, ep := range local.Endpoints {
+		stored[datastore.Key(ep.Key()...)] = ep
+	}
+	keep := make(map[string]bool, len(snap.Networks)+len(snap.Endpoints))
+	for _, config := range snap.Networks {
+		key := datastore.Key(config.Key()...)
+		keep[key] = true
+		if old, ok := stored[key]; ok {
+			config.SetIndex(old.Index())
+		}
+		if err := d.storeUpdate(config); err != nil {
+			return fmt.Errorf("failed to store synced network %.7s: %v", config.ID, err)
+		}
+	}
+	for _, ep := range snap.Endpoints {
+		key := datastore.Key(ep.Key()...)
+		keep[key] = true
+		if old, ok := stored[key]; ok {
+			ep.SetIndex(old.Index())
+		}
+		if err := d.storeUpdate(ep); err != nil {
+			return fmt.Errorf("failed to store synced endpoint %.7s: %v", ep.id, err)
+		}
+	}
+	for key, obj := range stored {
+		if keep[key] {
+			continue
+		}
+		if err := d.storeDelete(obj); err != nil {
+			logrus.Warnf("Failed to remove store record %s missing from the peer snapshot: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// syncFromPeer fetches and restores a single snapshot from the primary
+func (d *driver) syncFromPeer(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned %s", resp.Status)
+	}
+	snap := &storeSnapshot{}
+	if err := json.NewDecoder(resp.Body).Decode(snap); err != nil {
+		return fmt.Errorf("failed to decode peer snapshot: %v", err)
+	}
+	if err := d.restoreSnapshot(snap); err != nil {
+		return err
+	}
+	logrus.Debugf("Synced %d networks and %d endpoints from peer %s", len(snap.Networks), len(snap.Endpoints), url)
+
+	return nil
+}
+
+// runPeerSync keeps the local store a read-only replica of the primary's /store-sync
+func (d *driver) runPeerSync(url string, interval time.Duration) {
+	client := &http.Client{Timeout: interval}
+	if d.opts.PeerSyncTLS != nil {
+		client.Transport = &http.Transport{TLSClientConfig: d.opts.PeerSyncTLS}
+	}
+	logrus.Infof("Warm standby, syncing the store from %s every %s", url, interval)
+	for {
+		if err := d.syncFromPeer(client, url); err != nil {
+			logrus.Warnf("Failed to sync the store from peer %s: %v", url, err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,73 @@
+package driver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	networkapi "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/types"
+)
+
+func TestRestoreSnapshot(t *testing.T) {
+	withTestStorage(t)
+	d := newTestDriver(Options{})
+	if err := d.initStore(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.store.Close()
+	for _, config := range []*configuration{
+		{ID: "n1", Parent: "eth0", MacvlanMode: modeBridge},
+		{ID: "n2", Parent: "eth1", MacvlanMode: modeBridge},
+	} {
+		if err := d.storeUpdate(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.storeUpdate(&endpoint{id: "e2", nid: "n2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := &storeSnapshot{
+		Networks:  []*configuration{{ID: "n1", Parent: "eth0", MacvlanMode: modeVepa}, {ID: "n3", Parent: "eth3", MacvlanMode: modeBridge}},
+		Endpoints: []*endpoint{{id: "e3", nid: "n3"}},
+	}
+	// the second sync replaces records the first one wrote
+	for i := 0; i < 2; i++ {
+		if err := d.restoreSnapshot(snap); err != nil {
+			t.Fatalf("sync %d: %v", i, err)
+		}
+	}
+	configs, err := d.listNetworkConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes := map[string]string{}
+	for _, config := range configs {
+		modes[config.ID] = config.MacvlanMode
+	}
+	if len(modes) != 2 || modes["n1"] != modeVepa || modes["n3"] != modeBridge {
+		t.Errorf("store holds networks %v after the sync, want n1 in vepa mode and n3", modes)
+	}
+	eps, err := d.listEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eps) != 1 || eps[0].id != "e3" {
+		t.Errorf("store holds %d endpoints after the sync, want only e3", len(eps))
+	}
+}
+
+func TestStandbyRefusesChanges(t *testing.T) {
+	d := newTestDriver(Options{PeerSync: "http://primary:9000/store-sync", AdminWrite: true})
+	err := d.PluginDriver().CreateNetwork(&networkapi.CreateNetworkRequest{NetworkID: "n1"})
+	if _, ok := err.(types.ForbiddenError); !ok {
+		t.Errorf("CreateNetwork on a warm standby: got %v, want a forbidden error", err)
+	}
+	rec := httptest.NewRecorder()
+	d.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/maintenance", strings.NewReader(`{"maintenance":true}`)))
+	if rec.Code != http.StatusForbidden || d.inMaintenance() {
+		t.Errorf("POST /maintenance on a warm standby: got %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,118 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/docker/libnetwork/types"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// pingTimeout bounds a single endpoint reachability check
+const pingTimeout = 2 * time.Second
+
+// pingResult is the outcome of a reachability check from an endpoint
+type pingResult struct {
+	EndpointID string  `json:"endpoint_id"`
+	Target     string  `json:"target"`
+	Method     string  `json:"method"`
+	OK         bool    `json:"ok"`
+	LatencyMs  float64 `json:"latency_ms,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// pingEndpoint checks from inside the endpoint's sandbox that target answers
+// an ICMP echo, or accepts a TCP connection when port is set
+func (d *driver) pingEndpoint(eid, target string, port int) (*pingResult, error) {
+	if !d.opts.AdminPing {
+		return nil, types.ForbiddenErrorf("endpoint ping is disabled, restart the plugin with -admin-ping")
+	}
+	_, ep := d.findEndpoint(eid)
+	if ep == nil {
+		return nil, types.NotFoundErrorf("endpoint id %s not found", eid)
+	}
+	if ep.sandboxKey == "" {
+		return nil, types.BadRequestErrorf("endpoint %.7s is not joined to a container", eid)
+	}
+	ip := net.ParseIP(target)
+	if ip == nil || ip.To4() == nil {
+		return nil, types.BadRequestErrorf("invalid ping target %q, expected an ipv4 address", target)
+	}
+	result := &pingResult{EndpointID: eid, Target: target, Method: "icmp"}
+	if port != 0 {
+		result.Method = "tcp"
+	}
+	var latency time.Duration
+	err := inSandbox(ep.sandboxKey, func() error {
+		var err error
+		if port != 0 {
+			latency, err = tcpPing(ip, port)
+		} else {
+			latency, err = icmpPing(ip)
+		}
+		return err
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	result.OK = true
+	result.LatencyMs = float64(latency.Microseconds()) / 1000
+
+	return result, nil
+}
+
+// tcpPing times a tcp connect, the socket is created in the calling thread's namespace
+func tcpPing(ip net.IP, port int) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp4", net.JoinHostPort(ip.String(), strconv.Itoa(port)), pingTimeout)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+
+	return time.Since(start), nil
+}
+
+// icmpPing times an ICMP echo round trip
+func icmpPing(ip net.IP) (time.Duration, error) {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to open an icmp socket: %v", err)
+	}
+	defer conn.Close()
+	id := os.Getpid() & 0xffff
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: 1, Data: []byte(driverPrefix)},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if _, err := conn.WriteTo(b, &net.IPAddr{IP: ip}); err != nil {
+		return 0, fmt.Errorf("failed to send icmp echo: %v", err)
+	}
+	if err := conn.SetReadDeadline(start.Add(pingTimeout)); err != nil {
+		return 0, err
+	}
+	reply := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(reply)
+		if err != nil {
+			return 0, fmt.Errorf("no icmp echo reply from %s: %v", ip, err)
+		}
+		rm, err := icmp.ParseMessage(1, reply[:n])
+		if err != nil || rm.Type != ipv4.ICMPTypeEchoReply || peer.String() != ip.String() {
+			continue
+		}
+		if echo, ok := rm.Body.(*icmp.Echo); ok && echo.ID == id {
+			return time.Since(start), nil
+		}
+	}
+}
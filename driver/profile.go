@@ -0,0 +1,79 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/libnetwork/types"
+	"github.com/sirupsen/logrus"
+)
+
+// profileOpt selects a network profile, passed with docker network create -o profile=
+const profileOpt = "profile"
+
+// profiles are the network option defaults loaded from -profile-dir, by name
+var profiles = map[string]map[string]string{}
+
+// loadProfiles reads every <name>.json file in dir as a profile holding
+// driver option defaults, ex. {"macvlan_mode": "bridge", "macvlan_mtu": 1400}
+func loadProfiles(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("failed to list profiles in %s: %v", dir, err)
+	}
+	loaded := make(map[string]map[string]string, len(files))
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read profile %s: %v", file, err)
+		}
+		var raw map[string]interface{}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return fmt.Errorf("failed to parse profile %s: %v", file, err)
+		}
+		labels := make(map[string]string, len(raw))
+		for label, value := range raw {
+			if label == profileOpt {
+				return fmt.Errorf("profile %s can't reference another profile", file)
+			}
+			labels[label] = fmt.Sprintf("%v", value)
+		}
+		// reject bad values at startup rather than on the first network using them
+		if err := (&configuration{}).fromOptions(labels); err != nil {
+			return fmt.Errorf("invalid profile %s: %v", file, err)
+		}
+		loaded[name] = labels
+	}
+	profiles = loaded
+	logrus.Infof("Loaded %d network profiles from %s", len(loaded), dir)
+
+	return nil
+}
+
+// withProfile merges the defaults of the -o profile named in labels under the
+// explicit options, an explicit option wins over the profile
+func withProfile(labels map[string]string) (map[string]string, error) {
+	name, ok := labels[profileOpt]
+	if !ok {
+		return labels, nil
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, types.BadRequestErrorf("unknown network profile %q for -o %s", name, profileOpt)
+	}
+	merged := make(map[string]string, len(profile)+len(labels))
+	for label, value := range profile {
+		merged[label] = value
+	}
+	for label, value := range labels {
+		if label != profileOpt {
+			merged[label] = value
+		}
+	}
+
+	return merged, nil
+}
@@ -0,0 +1,54 @@
+package driver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/docker/libnetwork/types"
+)
+
+// withTestProfiles replaces the loaded profiles for the test
+func withTestProfiles(t *testing.T, loaded map[string]map[string]string) {
+	previous := profiles
+	profiles = loaded
+	t.Cleanup(func() { profiles = previous })
+}
+
+func TestWithProfile(t *testing.T) {
+	withTestProfiles(t, map[string]map[string]string{
+		"jumbo": {driverModeOpt: modeVepa, mtuOpt: "9000"},
+	})
+
+	merged, err := withProfile(map[string]string{profileOpt: "jumbo", mtuOpt: "1500", parentOpt: "eth0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{driverModeOpt: modeVepa, mtuOpt: "1500", parentOpt: "eth0"}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("got %v, want %v", merged, want)
+	}
+
+	labels := map[string]string{parentOpt: "eth0"}
+	if merged, err := withProfile(labels); err != nil || !reflect.DeepEqual(merged, labels) {
+		t.Errorf("labels without a profile: got %v, %v", merged, err)
+	}
+
+	if _, err := withProfile(map[string]string{profileOpt: "missing"}); err == nil {
+		t.Error("unknown profile accepted")
+	} else if _, ok := err.(types.BadRequestError); !ok {
+		t.Errorf("got %T, want a bad request error", err)
+	}
+}
+
+func TestLoadProfilesRejectsBadValues(t *testing.T) {
+	withTestProfiles(t, map[string]map[string]string{})
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "bad.json"), []byte(`{"macvlan_mtu": "jumbo"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadProfiles(dir); err == nil {
+		t.Error("profile with an invalid mtu loaded")
+	}
+}
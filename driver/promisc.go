@@ -0,0 +1,98 @@
+package driver
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/docker/libnetwork/ns"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// promiscMu serializes the promiscuous refcount checks of parents shared by networks
+var promiscMu sync.Mutex
+
+// promiscOwners returns the networks other than nid that hold promiscuous
+// mode the driver set on parent, the refcount of that setting
+func (d *driver) promiscOwners(parent, nid string) int {
+	owners := 0
+	for _, n := range d.getNetworks() {
+		if n.id != nid && n.config.Parent == parent && n.config.PromiscSet {
+			owners++
+		}
+	}
+
+	return owners
+}
+
+// acquirePromisc turns on promiscuous mode on the parent for -o parent_promisc,
+// recording in PromiscSet whether the driver owns the setting. A parent made
+// promiscuous by someone else is left alone and never cleared by the driver.
+func (d *driver) acquirePromisc(config *configuration) error {
+	promiscMu.Lock()
+	defer promiscMu.Unlock()
+	if d.promiscOwners(config.Parent, config.ID) > 0 {
+		config.PromiscSet = true
+		return nil
+	}
+	link, err := ns.NlHandle().LinkByName(config.Parent)
+	if err != nil {
+		return fmt.Errorf("failed to find parent interface %s: %v", config.Parent, err)
+	}
+	if link.Attrs().RawFlags&unix.IFF_PROMISC != 0 {
+		logrus.Debugf("Parent %s is already promiscuous, not taking ownership", config.Parent)
+		return nil
+	}
+	if err := ns.NlHandle().SetPromiscOn(link); err != nil {
+		return linkError("set promiscuous mode on parent", config.Parent, err)
+	}
+	config.PromiscSet = true
+	logrus.Infof("Enabled promiscuous mode on parent %s for network %.7s", config.Parent, config.ID)
+
+	return nil
+}
+
+// releasePromisc clears promiscuous mode on the parent when the driver set it
+// and no other network still holds it
+func (d *driver) releasePromisc(config *configuration) {
+	if !config.PromiscSet {
+		return
+	}
+	promiscMu.Lock()
+	defer promiscMu.Unlock()
+	if owners := d.promiscOwners(config.Parent, config.ID); owners > 0 {
+		logrus.Debugf("Keeping promiscuous mode on parent %s, still used by %d networks", config.Parent, owners)
+		return
+	}
+	link, err := ns.NlHandle().LinkByName(config.Parent)
+	if err != nil {
+		logrus.Debugf("Parent %s is gone, nothing to clear: %v", config.Parent, err)
+		return
+	}
+	if err := ns.NlHandle().SetPromiscOff(link); err != nil {
+		logrus.Warnf("Failed to clear promiscuous mode on parent %s: %v", config.Parent, err)
+		return
+	}
+	logrus.Infof("Cleared promiscuous mode on parent %s", config.Parent)
+}
+
+// restorePromisc re-applies promiscuous mode owned by a network restored from
+// the store when the parent lost it, ex. after a reboot recreated the parent
+func restorePromisc(config *configuration) {
+	if !config.PromiscSet {
+		return
+	}
+	link, err := ns.NlHandle().LinkByName(config.Parent)
+	if err != nil {
+		logrus.Warnf("Failed to find parent %s to restore promiscuous mode: %v", config.Parent, err)
+		return
+	}
+	if link.Attrs().RawFlags&unix.IFF_PROMISC != 0 {
+		return
+	}
+	if err := ns.NlHandle().SetPromiscOn(link); err != nil {
+		logrus.Warnf("Failed to restore promiscuous mode on parent %s: %v", config.Parent, err)
+		return
+	}
+	logrus.Infof("Restored promiscuous mode on parent %s for network %.7s", config.Parent, config.ID)
+}
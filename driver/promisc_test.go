@@ -0,0 +1,70 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/docker/libnetwork/ns"
+	"golang.org/x/sys/unix"
+)
+
+// promiscuous tells whether a link in the test namespace is promiscuous
+func promiscuous(t testing.TB, name string) bool {
+	link, err := ns.NlHandle().LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return link.Attrs().RawFlags&unix.IFF_PROMISC != 0
+}
+
+func TestPromiscSharedParent(t *testing.T) {
+	withTestNetns(t, "mvtest0")
+	c1 := &configuration{ID: "n1", Parent: "mvtest0", MacvlanMode: modeBridge, ParentPromisc: true}
+	c2 := &configuration{ID: "n2", Parent: "mvtest0", MacvlanMode: modeBridge, ParentPromisc: true}
+	d := newTestDriver(Options{}, c1, c2)
+
+	for _, config := range []*configuration{c1, c2} {
+		if err := d.acquirePromisc(config); err != nil {
+			t.Fatal(err)
+		}
+		if !config.PromiscSet {
+			t.Errorf("network %s does not hold the promiscuous mode", config.ID)
+		}
+	}
+	if !promiscuous(t, "mvtest0") {
+		t.Fatal("parent is not promiscuous")
+	}
+	d.releasePromisc(c1)
+	d.deleteNetwork(c1.ID)
+	if !promiscuous(t, "mvtest0") {
+		t.Error("promiscuous mode cleared while another network holds it")
+	}
+	d.releasePromisc(c2)
+	if promiscuous(t, "mvtest0") {
+		t.Error("promiscuous mode left after the last network released it")
+	}
+}
+
+func TestPromiscSetByOthers(t *testing.T) {
+	withTestNetns(t, "mvtest0")
+	link, err := ns.NlHandle().LinkByName("mvtest0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.NlHandle().SetPromiscOn(link); err != nil {
+		t.Fatal(err)
+	}
+	config := &configuration{ID: "n1", Parent: "mvtest0", MacvlanMode: modeBridge, ParentPromisc: true}
+	d := newTestDriver(Options{}, config)
+
+	if err := d.acquirePromisc(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.PromiscSet {
+		t.Error("driver took ownership of a promiscuous mode it didn't set")
+	}
+	d.releasePromisc(config)
+	if !promiscuous(t, "mvtest0") {
+		t.Error("driver cleared a promiscuous mode it didn't set")
+	}
+}
@@ -0,0 +1,134 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// parentSysctl is a per-interface sysctl the driver turns on for a parent,
+// along with the configuration fields that request and own the setting
+type parentSysctl struct {
+	name      string
+	format    string
+	requested func(*configuration) bool
+	owned     func(*configuration) *bool
+}
+
+var (
+	proxyARP = parentSysctl{
+		name:      "proxy_arp",
+		format:    "/proc/sys/net/ipv4/conf/%s/proxy_arp",
+		requested: func(c *configuration) bool { return c.ProxyARP },
+		owned:     func(c *configuration) *bool { return &c.ProxyARPSet },
+	}
+	proxyNDP = parentSysctl{
+		name:      "proxy_ndp",
+		format:    "/proc/sys/net/ipv6/conf/%s/proxy_ndp",
+		requested: func(c *configuration) bool { return c.ProxyNDP },
+		owned:     func(c *configuration) *bool { return &c.ProxyNDPSet },
+	}
+	parentSysctls = []parentSysctl{proxyARP, proxyNDP}
+)
+
+// sysctlMu serializes the refcount checks of parent sysctls shared by networks
+var sysctlMu sync.Mutex
+
+// owners counts the networks other than nid that own the setting on parent
+func (s parentSysctl) owners(d *driver, parent, nid string) int {
+	owners := 0
+	for _, n := range d.getNetworks() {
+		if n.id != nid && n.config.Parent == parent && *s.owned(n.config) {
+			owners++
+		}
+	}
+
+	return owners
+}
+
+// acquireParentSysctls turns on the requested parent sysctls, recording which
+// ones the driver owns. A sysctl already on is left alone and never cleared.
+func (d *driver) acquireParentSysctls(config *configuration) error {
+	sysctlMu.Lock()
+	defer sysctlMu.Unlock()
+	for _, s := range parentSysctls {
+		if !s.requested(config) {
+			continue
+		}
+		if s.owners(d, config.Parent, config.ID) > 0 {
+			*s.owned(config) = true
+			continue
+		}
+		path := fmt.Sprintf(s.format, config.Parent)
+		current, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("%s is not available on parent %s, missing %s", s.name, config.Parent, path)
+			}
+			return fmt.Errorf("failed to read %s of parent %s: %v", s.name, config.Parent, err)
+		}
+		if strings.TrimSpace(string(current)) != "0" {
+			logrus.Debugf("%s is already enabled on parent %s, not taking ownership", s.name, config.Parent)
+			continue
+		}
+		if err := ioutil.WriteFile(path, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("failed to enable %s on parent %s: %v", s.name, config.Parent, err)
+		}
+		*s.owned(config) = true
+		logrus.Infof("Enabled %s on parent %s for network %.7s", s.name, config.Parent, config.ID)
+	}
+
+	return nil
+}
+
+// releaseParentSysctls turns off the parent sysctls the driver enabled for the
+// network unless another network on the parent still holds them
+func (d *driver) releaseParentSysctls(config *configuration) {
+	sysctlMu.Lock()
+	defer sysctlMu.Unlock()
+	for _, s := range parentSysctls {
+		if !*s.owned(config) {
+			continue
+		}
+		if owners := s.owners(d, config.Parent, config.ID); owners > 0 {
+			logrus.Debugf("Keeping %s on parent %s, still used by %d networks", s.name, config.Parent, owners)
+			continue
+		}
+		path := fmt.Sprintf(s.format, config.Parent)
+		if err := ioutil.WriteFile(path, []byte("0"), 0644); err != nil {
+			if !os.IsNotExist(err) {
+				logrus.Warnf("Failed to disable %s on parent %s: %v", s.name, config.Parent, err)
+			}
+			continue
+		}
+		logrus.Infof("Disabled %s on parent %s", s.name, config.Parent)
+	}
+}
+
+// restoreParentSysctls re-applies the parent sysctls owned by a network restored
+// from the store when the parent lost them
+func restoreParentSysctls(config *configuration) {
+	for _, s := range parentSysctls {
+		if !*s.owned(config) {
+			continue
+		}
+		path := fmt.Sprintf(s.format, config.Parent)
+		current, err := ioutil.ReadFile(path)
+		if err != nil {
+			logrus.Warnf("Failed to read %s of parent %s to restore it: %v", s.name, config.Parent, err)
+			continue
+		}
+		if strings.TrimSpace(string(current)) != "0" {
+			continue
+		}
+		if err := ioutil.WriteFile(path, []byte("1"), 0644); err != nil {
+			logrus.Warnf("Failed to restore %s on parent %s: %v", s.name, config.Parent, err)
+			continue
+		}
+		logrus.Infof("Restored %s on parent %s for network %.7s", s.name, config.Parent, config.ID)
+	}
+}
@@ -0,0 +1,222 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/docker/libnetwork/ns"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// qos options of the container traffic, passed with docker network create -o
+const (
+	priorityOpt = "priority" // skb priority set on the traffic the containers send
+	dscpOpt     = "dscp"     // dscp written into the ip header of the traffic the containers send
+	maxDscp     = 63
+)
+
+// egress filter priorities on the clsact qdisc of a child, the skb priority
+// filter continues to the dscp filter of the packet's protocol
+const (
+	qosPrioSkb  = 1
+	qosPrioDscp = 2
+)
+
+// pedit and csum action attributes and flags, from linux/tc_act/tc_pedit.h
+// and tc_csum.h which the netlink library has no encoding for
+const (
+	tcaPeditParms     = 2
+	tcaCsumParms      = 1
+	csumUpdateIPv4Hdr = 1
+)
+
+// parsePriority validates a -o priority value
+func parsePriority(value string) (uint32, error) {
+	priority, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || priority == 0 {
+		return 0, fmt.Errorf("invalid value %q for -o %s, expected a priority between 1 and %d", value, priorityOpt, uint32(1<<32-1))
+	}
+
+	return uint32(priority), nil
+}
+
+// parseDscp validates a -o dscp value, kept as text since 0 is a valid codepoint
+func parseDscp(value string) (string, error) {
+	dscp, err := strconv.Atoi(value)
+	if err != nil || dscp < 0 || dscp > maxDscp {
+		return "", fmt.Errorf("invalid value %q for -o %s, expected a codepoint between 0 and %d", value, dscpOpt, maxDscp)
+	}
+
+	return strconv.Itoa(dscp), nil
+}
+
+// hasQoS tells whether the network marks the traffic of its containers
+func (config *configuration) hasQoS() bool {
+	return config.Priority != 0 || config.Dscp != ""
+}
+
+// applySandboxQoS waits for docker to move the child with the given MAC into
+// the sandbox and marks its egress traffic there. The link is moved after Join
+// returns and a namespace move drops its qdiscs, so the marking can't be set
+// on the host. It goes away with the link when the container leaves.
+func applySandboxQoS(sandboxKey string, mac net.HardwareAddr, config *configuration) {
+	name, ok := waitSandboxLink(sandboxKey, mac)
+	if !ok {
+		logrus.Warnf("Interface with MAC %s did not appear in sandbox %s, -o %s and -o %s were not applied", mac, sandboxKey, priorityOpt, dscpOpt)
+		return
+	}
+	err := inSandbox(sandboxKey, func() error {
+		return setQoS(name, config.Priority, config.Dscp)
+	})
+	if err != nil {
+		logrus.Warnf("Failed to mark the traffic of %s in sandbox %s: %v", name, sandboxKey, err)
+		return
+	}
+	logrus.Debugf("Applied qos priority=%d dscp=%s on %s in sandbox %s", config.Priority, config.Dscp, name, sandboxKey)
+}
+
+// setQoS adds a clsact qdisc to a link of the current namespace with the
+// egress filters setting the skb priority and rewriting the dscp
+func setQoS(linkName string, priority uint32, dscp string) error {
+	h, err := netlink.NewHandle()
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	link, err := h.LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %v", linkName, err)
+	}
+	index := link.Attrs().Index
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := h.QdiscAdd(qdisc); err != nil {
+		return linkError(fmt.Sprintf("add clsact qdisc to %s", linkName), fmt.Sprintf("%s=%d,%s=%s", priorityOpt, priority, dscpOpt, dscp), err)
+	}
+	if priority != 0 {
+		skbedit := netlink.NewSkbEditAction()
+		skbedit.Priority = &priority
+		// continue on to the dscp filters
+		skbedit.Action = netlink.TC_ACT_UNSPEC
+		filter := &netlink.MatchAll{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: index,
+				Parent:    netlink.HANDLE_MIN_EGRESS,
+				Priority:  qosPrioSkb,
+				Protocol:  unix.ETH_P_ALL,
+			},
+			Actions: []netlink.Action{skbedit},
+		}
+		if err := h.FilterAdd(filter); err != nil {
+			return linkError(fmt.Sprintf("add priority filter to %s", linkName), fmt.Sprintf("%s=%d", priorityOpt, priority), err)
+		}
+	}
+	if dscp != "" {
+		value, _ := strconv.Atoi(dscp)
+		params := fmt.Sprintf("%s=%s", dscpOpt, dscp)
+		if err := addDscpFilter(index, unix.ETH_P_IP, uint32(value)); err != nil {
+			return linkError(fmt.Sprintf("add ipv4 dscp filter to %s", linkName), params, err)
+		}
+		if err := addDscpFilter(index, unix.ETH_P_IPV6, uint32(value)); err != nil {
+			return linkError(fmt.Sprintf("add ipv6 dscp filter to %s", linkName), params, err)
+		}
+	}
+
+	return nil
+}
+
+// addDscpFilter adds an egress matchall filter rewriting the dscp bits of the
+// first word of the ipv4 or ipv6 header, the ipv4 header checksum is updated
+func addDscpFilter(index int, proto uint16, dscp uint32) error {
+	// ipv4 has the dscp above the ecn bits of the tos byte, ipv6 in the
+	// traffic class after the version nibble
+	shift := uint32(18)
+	if proto == unix.ETH_P_IPV6 {
+		shift = 22
+	}
+	req := nl.NewNetlinkRequest(unix.RTM_NEWTFILTER, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(index),
+		Parent:  netlink.HANDLE_MIN_EGRESS,
+		Info:    netlink.MakeHandle(qosPrioDscp, nl.Swap16(proto)),
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("matchall")))
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	actions := options.AddRtAttr(nl.TCA_MATCHALL_ACT, nil)
+	pedit := actions.AddRtAttr(nl.TCA_ACT_TAB, nil)
+	pedit.AddRtAttr(nl.TCA_ACT_KIND, nl.ZeroTerminated("pedit"))
+	last := netlink.TC_ACT_OK
+	if proto == unix.ETH_P_IP {
+		last = netlink.TC_ACT_PIPE
+	}
+	pedit.AddRtAttr(nl.TCA_ACT_OPTIONS, nil).AddRtAttr(tcaPeditParms,
+		peditWord(int32(last), ^uint32(maxDscp<<shift), dscp<<shift))
+	if proto == unix.ETH_P_IP {
+		csum := actions.AddRtAttr(nl.TCA_ACT_TAB+1, nil)
+		csum.AddRtAttr(nl.TCA_ACT_KIND, nl.ZeroTerminated("csum"))
+		csum.AddRtAttr(nl.TCA_ACT_OPTIONS, nil).AddRtAttr(tcaCsumParms, csumParms(int32(netlink.TC_ACT_OK), csumUpdateIPv4Hdr))
+	}
+	req.AddData(options)
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+
+	return err
+}
+
+// peditWord encodes a tc_pedit_sel with one key rewriting the first 32 bits
+// of the network header, mask keeps the bits set in it and val is xored in.
+// Both are in network byte order like the packet they are applied to.
+func peditWord(action int32, mask, val uint32) []byte {
+	native := nl.NativeEndian()
+	var b bytes.Buffer
+	binary.Write(&b, native, &nl.TcGen{Action: action})
+	// nkeys, flags and the padding before the keys
+	b.Write([]byte{1, 0, 0, 0})
+	binary.Write(&b, binary.BigEndian, mask)
+	binary.Write(&b, binary.BigEndian, val)
+	// off, at, offmask and shift
+	binary.Write(&b, native, [4]uint32{})
+
+	return b.Bytes()
+}
+
+// csumParms encodes a tc_csum
+func csumParms(action int32, flags uint32) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, nl.NativeEndian(), &nl.TcGen{Action: action})
+	binary.Write(&b, nl.NativeEndian(), flags)
+
+	return b.Bytes()
+}
+
+// clearQoS removes the clsact qdisc of a host link, and the filters with it,
+// for a child kept on the host by -o leave_action
+func clearQoS(linkName string) {
+	link, err := ns.NlHandle().LinkByName(linkName)
+	if err != nil {
+		return
+	}
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := ns.NlHandle().QdiscDel(qdisc); err != nil && err != unix.ENOENT && err != unix.EINVAL {
+		logrus.Debugf("Failed to remove the qos qdisc of %s: %v", linkName, err)
+	}
+}
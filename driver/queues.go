@@ -0,0 +1,70 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// queue options of the macvlan children, passed with docker network create -o
+const (
+	rxQueuesOpt = "rx_queues" // rx queues of the macvlan children
+	txQueuesOpt = "tx_queues" // tx queues of the macvlan children
+	rpsCpusOpt  = "rps_cpus"  // hex cpu mask steering the rx queues of the children
+)
+
+// maxQueues is the most queues a child can be given, the kernel limit is 4096
+// but a macvlan never benefits from more queues than its parent has
+const maxQueues = 4096
+
+// rpsMaskPattern matches the comma grouped hex cpu masks of rps_cpus
+var rpsMaskPattern = regexp.MustCompile(`^[0-9a-fA-F]+(,[0-9a-fA-F]+)*$`)
+
+// parseQueues validates a -o rx_queues or tx_queues value
+func parseQueues(opt, value string) (int, error) {
+	queues, err := strconv.Atoi(value)
+	if err != nil || queues < 1 || queues > maxQueues {
+		return 0, fmt.Errorf("invalid value %q for -o %s, expected a queue count between 1 and %d", value, opt, maxQueues)
+	}
+
+	return queues, nil
+}
+
+// parseRpsCpus validates a -o rps_cpus value
+func parseRpsCpus(value string) (string, error) {
+	if !rpsMaskPattern.MatchString(value) {
+		return "", fmt.Errorf("invalid value %q for -o %s, expected a hex cpu mask such as f or ff,00000000", value, rpsCpusOpt)
+	}
+
+	return value, nil
+}
+
+// clampQueues lowers a requested queue count to what the parent has, the
+// kernel would accept more but the extra queues carry no traffic
+func clampQueues(kind string, requested, parentQueues int, parent string) int {
+	if requested == 0 || parentQueues == 0 || requested <= parentQueues {
+		return requested
+	}
+	logrus.Debugf("Parent %s has %d %s queues, creating the child with %d instead of %d", parent, parentQueues, kind, parentQueues, requested)
+
+	return parentQueues
+}
+
+// setRpsCpus writes the rps cpu mask of every rx queue of a host link,
+// kernels without rps or links without rx queue directories are skipped
+func setRpsCpus(linkName, mask string) {
+	queues, err := filepath.Glob(filepath.Join("/sys/class/net", linkName, "queues", "rx-*", "rps_cpus"))
+	if err != nil || len(queues) == 0 {
+		logrus.Debugf("Interface %s has no rps capable rx queues, ignoring -o %s", linkName, rpsCpusOpt)
+		return
+	}
+	for _, path := range queues {
+		if err := ioutil.WriteFile(path, []byte(mask), 0644); err != nil {
+			logrus.Warnf("Failed to set the rps cpus of %s: %v", path, err)
+		}
+	}
+}
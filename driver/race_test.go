@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package driver
+
+// raceEnabled is set when the tests run with -race, which also turns on the
+// checkptr checks boltdb v1.3.1 fails when it writes a bucket
+const raceEnabled = true
@@ -0,0 +1,126 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/libnetwork/types"
+)
+
+// endpointRateOpt limits CreateEndpoint on a network, ex. -o endpoint_rate=10/s
+const endpointRateOpt = "endpoint_rate"
+
+// rateUnits are the periods an -o endpoint_rate may be given per
+var rateUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// parseEndpointRate validates an -o endpoint_rate value of the form count/unit
+func parseEndpointRate(value string) (string, error) {
+	if _, _, err := splitRate(value); err != nil {
+		return "", fmt.Errorf("invalid value %q for -o %s, expected a count per s, m or h such as 10/s: %v", value, endpointRateOpt, err)
+	}
+
+	return value, nil
+}
+
+// splitRate returns the count and period of a count/unit rate
+func splitRate(value string) (int, time.Duration, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("missing /unit")
+	}
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count < 1 {
+		return 0, 0, fmt.Errorf("count must be a positive integer")
+	}
+	period, ok := rateUnits[parts[1]]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown unit %q", parts[1])
+	}
+
+	return count, period, nil
+}
+
+// tokenBucket allows a burst of size requests, refilled at size per period
+type tokenBucket struct {
+	sync.Mutex
+	size   float64
+	period time.Duration
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(size int, period time.Duration) *tokenBucket {
+	return &tokenBucket{
+		size:   float64(size),
+		period: period,
+		tokens: float64(size),
+		last:   time.Now(),
+	}
+}
+
+// take consumes a token, returning how long until one is available when empty
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	b.tokens += b.size * float64(now.Sub(b.last)) / float64(b.period)
+	if b.tokens > b.size {
+		b.tokens = b.size
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) * float64(b.period) / b.size)
+
+	return false, wait
+}
+
+// put gives back a token taken by a request that failed
+func (b *tokenBucket) put() {
+	b.Lock()
+	defer b.Unlock()
+	if b.tokens++; b.tokens > b.size {
+		b.tokens = b.size
+	}
+}
+
+// checkEndpointRate enforces the -o endpoint_rate of a network, the bucket is
+// kept in memory and starts full after a restart
+func (n *network) checkEndpointRate() error {
+	if n.config.EndpointRate == "" {
+		return nil
+	}
+	n.Lock()
+	if n.rate == nil {
+		// validated when the network was created
+		count, period, _ := splitRate(n.config.EndpointRate)
+		n.rate = newTokenBucket(count, period)
+	}
+	bucket := n.rate
+	n.Unlock()
+	if ok, wait := bucket.take(); !ok {
+		return types.RetryErrorf("endpoint creation on network %.7s is rate limited to %s by -o %s, retry in %s",
+			n.id, n.config.EndpointRate, endpointRateOpt, wait.Round(time.Millisecond))
+	}
+
+	return nil
+}
+
+// returnEndpointRate gives back the -o endpoint_rate token of a failed endpoint creation
+func (n *network) returnEndpointRate() {
+	n.Lock()
+	bucket := n.rate
+	n.Unlock()
+	if bucket != nil {
+		bucket.put()
+	}
+}
@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/libnetwork/types"
+	"github.com/sirupsen/logrus"
+)
+
+// what plugin api calls do before the store is restored, set with -not-ready
+const (
+	notReadyQueue  = "queue"  // wait up to readyWait for the restore
+	notReadyReject = "reject" // fail at once with a retryable error
+)
+
+// readyWait bounds how long a queued call waits for the restore
+const readyWait = 30 * time.Second
+
+// readiness is closed once the startup restore of the store completed
+type readiness struct {
+	done chan struct{}
+	once sync.Once
+}
+
+func newReadiness() *readiness {
+	return &readiness{done: make(chan struct{})}
+}
+
+func (r *readiness) set() {
+	r.once.Do(func() { close(r.done) })
+}
+
+func (r *readiness) isSet() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// validateNotReady checks a -not-ready value, queue when empty
+func validateNotReady(mode string) error {
+	switch mode {
+	case "", notReadyQueue, notReadyReject:
+		return nil
+	}
+
+	return fmt.Errorf("invalid not ready mode %q, expected %s or %s", mode, notReadyQueue, notReadyReject)
+}
+
+// gateChange is gate for the plugin api calls that change state, a -peer-sync
+// warm standby refuses them as each sync overwrites its store with the primary's
+func (d *driver) gateChange(op string) error {
+	if d.opts.PeerSync != "" {
+		return types.ForbiddenErrorf("%s driver is a warm standby of %s, %s is served by the primary", networkType, d.opts.PeerSync, op)
+	}
+
+	return d.gate(op)
+}
+
+// gate holds back a plugin api call until the store is restored, so docker
+// can't race the restore with creates and deletes while -async-restore runs it
+func (d *driver) gate(op string) error {
+	if d.ready.isSet() {
+		return nil
+	}
+	if d.opts.NotReady == notReadyReject {
+		logrus.Debugf("Rejecting %s, the store is still being restored", op)
+		return types.RetryErrorf("%s driver is restoring its state, retry %s", networkType, op)
+	}
+	logrus.Debugf("Queueing %s until the store is restored", op)
+	select {
+	case <-d.ready.done:
+		return nil
+	case <-time.After(readyWait):
+		return types.RetryErrorf("%s driver is still restoring its state after %s, retry %s", networkType, readyWait, op)
+	}
+}
@@ -0,0 +1,278 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/types"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// rehomeMu serializes re-homes, a network is moved by one request at a time
+var rehomeMu sync.Mutex
+
+// rehomeResult is the outcome of moving a network to a new parent, served on
+// POST /networks/{id}/rehome
+type rehomeResult struct {
+	NetworkID string            `json:"network_id"`
+	OldParent string            `json:"old_parent"`
+	NewParent string            `json:"new_parent"`
+	Endpoints []*rehomeEndpoint `json:"endpoints"`
+}
+
+// rehomeEndpoint is the outcome for one endpoint of a re-homed network
+type rehomeEndpoint struct {
+	ID string `json:"id"`
+	// Moved is set when a joined child was recreated on the new parent,
+	// endpoints that are not joined move on their next join
+	Moved bool   `json:"moved"`
+	Error string `json:"error,omitempty"`
+}
+
+// rehomeNetwork moves a network to a new parent. Each joined child is
+// recreated on the new parent with its MAC and host name, moved into the
+// container next to the old one, which is then deleted and its name,
+// addresses and routes given to the new child. The network's parent is
+// updated first so new joins already use the new one.
+func (d *driver) rehomeNetwork(nid, parent string) (*rehomeResult, error) {
+	if !d.opts.AllowRehome {
+		return nil, types.ForbiddenErrorf("re-homing networks is disabled, start the plugin with -allow-rehome")
+	}
+	rehomeMu.Lock()
+	defer rehomeMu.Unlock()
+	n, err := d.getNetwork(nid)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkRehome(n.config, parent); err != nil {
+		return nil, err
+	}
+	n.Lock()
+	result := &rehomeResult{NetworkID: n.id, OldParent: n.config.Parent, NewParent: parent}
+	oldRequested := n.config.RequestedParent
+	n.config.Parent = parent
+	n.config.RequestedParent = parent
+	err = d.storeUpdate(n.config)
+	if err != nil {
+		n.config.Parent = result.OldParent
+		n.config.RequestedParent = oldRequested
+	}
+	n.Unlock()
+	if err != nil {
+		return nil, types.InternalErrorf("failed to save the new parent of network %.7s: %v", n.id, err)
+	}
+	logrus.Infof("Re-homing network %.7s from parent %s to %s", n.id, result.OldParent, parent)
+	for _, ep := range n.getEndpoints() {
+		res := &rehomeEndpoint{ID: ep.id}
+		result.Endpoints = append(result.Endpoints, res)
+		if err := d.rehomeJoined(n, ep, res); err != nil {
+			logrus.Errorf("Failed to re-home endpoint %.7s to parent %s: %v", ep.id, parent, err)
+			res.Error = err.Error()
+		}
+	}
+
+	return result, nil
+}
+
+// rehomeJoined moves the child of a joined endpoint, holding the endpoint so
+// Join, Leave and auto heal don't act on it halfway
+func (d *driver) rehomeJoined(n *network, ep *endpoint, res *rehomeEndpoint) error {
+	ep.Lock()
+	defer ep.Unlock()
+	if ep.leaving || ep.sandboxKey == "" || ep.srcName == "" || ep.sandboxGone() {
+		return nil
+	}
+	if err := d.rehomeEndpoint(n, ep); err != nil {
+		return err
+	}
+	res.Moved = true
+
+	return nil
+}
+
+// checkRehome validates the new parent of a network like network create does
+func (d *driver) checkRehome(config *configuration, parent string) error {
+	if parent == "" || parent == config.Parent {
+		return types.BadRequestErrorf("new parent %q must name an interface other than the current parent %s", parent, config.Parent)
+	}
+	// a driver owned parent or parent setting would be left behind on the old parent
+	if config.CreatedSlaveLink {
+		return types.ForbiddenErrorf("parent %s of network %.7s was created by the driver, only user supplied parents can be re-homed", config.Parent, config.ID)
+	}
+	if config.PromiscSet || config.ProxyARPSet || config.ProxyNDPSet {
+		return types.ForbiddenErrorf("network %.7s changed settings of parent %s, recreate it to move it to %s", config.ID, config.Parent, parent)
+	}
+	if !parentExists(parent) {
+		return types.NotFoundErrorf("parent interface %s does not exist", parent)
+	}
+	if err := d.checkReservedParent(parent); err != nil {
+		return err
+	}
+	if err := d.checkWireless(parent); err != nil {
+		return err
+	}
+	candidate := *config
+	candidate.Parent = parent
+	if _, err := d.findParentConflict(&candidate); err != nil {
+		return err
+	}
+
+	return d.checkVlanMTU(&candidate)
+}
+
+// rehomeEndpoint swaps the joined child of an endpoint for one on the
+// network's current parent. The new child is created under the host name of
+// the old one, free on the host while the old child is in the container, so
+// docker finds it under the name Join returned when it moves it back.
+func (d *driver) rehomeEndpoint(n *network, ep *endpoint) error {
+	mtu, err := d.childMTU(n.config)
+	if err != nil {
+		return err
+	}
+	name := ep.srcName
+	if parentExists(name) {
+		return fmt.Errorf("host interface name %s of endpoint %.7s is in use", name, ep.id)
+	}
+	if _, err := createMacVlanQueues(name, n.config.Parent, n.config.MacvlanMode, mtu, n.config.RxQueues, n.config.TxQueues); err != nil {
+		return err
+	}
+	if err := setLinkMac(name, ep.mac); err != nil {
+		delLink(name)
+		return err
+	}
+	if len(n.config.IfaceFlags) > 0 {
+		if err := setLinkFlags(name, n.config.IfaceFlags); err != nil {
+			delLink(name)
+			return err
+		}
+	}
+	if n.config.RpsCpus != "" {
+		setRpsCpus(name, n.config.RpsCpus)
+	}
+	if err := setLinkAlias(name, ep.alias()); err != nil {
+		logrus.Warnf("Failed to set the alias of interface %s for endpoint %.7s: %v", name, ep.id, err)
+	}
+	h, old, release, err := endpointLink(ep)
+	if err != nil {
+		delLink(name)
+		return err
+	}
+	defer release()
+	nsh, err := netns.GetFromPath(ep.sandboxKey)
+	if err != nil {
+		delLink(name)
+		return fmt.Errorf("failed to open sandbox %s: %v", ep.sandboxKey, err)
+	}
+	defer nsh.Close()
+	link, err := ns.NlHandle().LinkByName(name)
+	if err != nil {
+		delLink(name)
+		return fmt.Errorf("failed to find interface %s: %v", name, err)
+	}
+	if err := ns.NlHandle().LinkSetNsFd(link, int(nsh)); err != nil {
+		delLink(name)
+		return fmt.Errorf("failed to move interface %s into sandbox %s: %v", name, ep.sandboxKey, err)
+	}
+	if err := swapSandboxLink(h, old, name); err != nil {
+		return err
+	}
+	// the settings made in the sandbox went with the old child
+	if d.opts.DisableIPv6 || n.config.DisableIPv6 {
+		disableSandboxIPv6(ep.sandboxKey, ep.mac)
+	}
+	if n.config.hasQoS() {
+		applySandboxQoS(ep.sandboxKey, ep.mac, n.config)
+	}
+	if err := d.checkAuxIfaces(n, ep); err != nil {
+		return err
+	}
+
+	return d.storeUpdate(ep)
+}
+
+// checkAuxIfaces recreates the auxiliary interfaces of a joined endpoint when
+// one is missing from its sandbox
+func (d *driver) checkAuxIfaces(n *network, ep *endpoint) error {
+	if len(ep.auxNames) == 0 {
+		return nil
+	}
+	h, err := sandboxHandle(ep.sandboxKey)
+	if err != nil {
+		return err
+	}
+	missing := false
+	for _, name := range ep.auxNames {
+		if _, err := h.LinkByName(name); err != nil {
+			missing = true
+		}
+	}
+	h.Delete()
+	if !missing {
+		return nil
+	}
+	logrus.Infof("Recreating the auxiliary interfaces of endpoint %.7s in sandbox %s", ep.id, ep.sandboxKey)
+	d.leaveAuxIfaces(ep.auxNames, ep.sandboxKey)
+	ep.auxNames = nil
+
+	return d.joinAuxIfaces(n, ep, ep.sandboxKey)
+}
+
+// swapSandboxLink replaces the old child with the new one already in the
+// sandbox, carrying over the interface name, addresses and static routes
+func swapSandboxLink(h *netlink.Handle, old netlink.Link, name string) error {
+	link, err := h.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s in the sandbox: %v", name, err)
+	}
+	addrs, err := h.AddrList(old, netlink.FAMILY_ALL)
+	if err != nil {
+		h.LinkDel(link)
+		return fmt.Errorf("failed to read the addresses of %s: %v", old.Attrs().Name, err)
+	}
+	routes, err := h.RouteList(old, netlink.FAMILY_ALL)
+	if err != nil {
+		h.LinkDel(link)
+		return fmt.Errorf("failed to read the routes of %s: %v", old.Attrs().Name, err)
+	}
+	oldName := old.Attrs().Name
+	// from here on the container is without its interface until the swap completes
+	if err := h.LinkDel(old); err != nil {
+		h.LinkDel(link)
+		return fmt.Errorf("failed to delete the old interface %s: %v", oldName, err)
+	}
+	var failed []string
+	if err := h.LinkSetName(link, oldName); err != nil {
+		failed = append(failed, fmt.Sprintf("rename %s to %s: %v", name, oldName, err))
+	}
+	if err := h.LinkSetUp(link); err != nil {
+		failed = append(failed, fmt.Sprintf("bring up %s: %v", oldName, err))
+	}
+	for i := range addrs {
+		addr := addrs[i]
+		addr.Label = ""
+		if err := h.AddrAdd(link, &addr); err != nil && err != unix.EEXIST {
+			failed = append(failed, fmt.Sprintf("add address %s: %v", addr.IPNet, err))
+		}
+	}
+	for i := range routes {
+		route := routes[i]
+		// the kernel adds the prefix routes of the addresses itself
+		if route.Protocol == unix.RTPROT_KERNEL {
+			continue
+		}
+		route.LinkIndex = link.Attrs().Index
+		if err := h.RouteAdd(&route); err != nil && err != unix.EEXIST {
+			failed = append(failed, fmt.Sprintf("add route %s: %v", route, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("interface %s replaced but not fully configured: %s", oldName, strings.Join(failed, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package driver
+
+import (
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logRequest dumps a plugin api request as json when -log-requests is set
+func (d *driver) logRequest(op string, req interface{}) {
+	if !d.opts.LogRequests || !logrus.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		logrus.Debugf("%s request could not be encoded: %v", op, err)
+		return
+	}
+	logrus.Debugf("%s request: %s", op, b)
+}
+
+// logResponse dumps a plugin api response, or its error, as json when -log-requests is set
+func (d *driver) logResponse(op string, resp interface{}, err error) {
+	if !d.opts.LogRequests || !logrus.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	if err != nil {
+		logrus.Debugf("%s error: %v", op, err)
+		return
+	}
+	b, mErr := json.Marshal(resp)
+	if mErr != nil {
+		logrus.Debugf("%s response could not be encoded: %v", op, mErr)
+		return
+	}
+	logrus.Debugf("%s response: %s", op, b)
+}
@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	statsdInterval = 10 * time.Second  // how often -statsd-addr is sent the metrics
+	statsdPrefix   = "macvlan_noipam." // statsd metric name prefix
+)
+
+// runStatsd pushes the /stats gauges, counters and call latencies to a statsd
+// server over udp. An unreachable server only costs a debug log per push.
+func (d *driver) runStatsd(addr string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var (
+		conn net.Conn
+		last = &driverStats{}
+		err  error
+	)
+	for range ticker.C {
+		if conn == nil {
+			if conn, err = net.Dial("udp", addr); err != nil {
+				logrus.Warnf("Failed to resolve statsd server %s: %v", addr, err)
+				conn = nil
+				continue
+			}
+		}
+		stats := d.stats()
+		if _, err := conn.Write(statsdPayload(stats, last)); err != nil {
+			logrus.Debugf("Failed to push metrics to statsd server %s: %v", addr, err)
+		}
+		last = stats
+	}
+}
+
+// statsdPayload formats the gauges, the counter increments and the mean call
+// latencies since the previous push as newline separated statsd lines
+func statsdPayload(stats, last *driverStats) []byte {
+	var b bytes.Buffer
+	gauge := func(name string, v float64) {
+		fmt.Fprintf(&b, "%s%s:%g|g\n", statsdPrefix, name, v)
+	}
+	count := func(name string, v, prev int64) {
+		fmt.Fprintf(&b, "%s%s:%d|c\n", statsdPrefix, name, v-prev)
+	}
+	gauge("networks", float64(stats.Networks))
+	gauge("endpoints", float64(stats.Endpoints))
+	gauge("uptime_seconds", stats.UptimeSeconds)
+	count("networks_created", stats.NetworksCreated, last.NetworksCreated)
+	count("networks_deleted", stats.NetworksDeleted, last.NetworksDeleted)
+	count("endpoints_created", stats.EndpointsCreated, last.EndpointsCreated)
+	count("endpoints_deleted", stats.EndpointsDeleted, last.EndpointsDeleted)
+	for op, l := range stats.Latency {
+		prev := last.Latency[op]
+		calls := l.Count - prev.Count
+		if calls == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "%s%s.calls:%d|c\n", statsdPrefix, op, calls)
+		fmt.Fprintf(&b, "%s%s.latency:%g|ms\n", statsdPrefix, op, (l.TotalMs-prev.TotalMs)/float64(calls))
+	}
+
+	return b.Bytes()
+}
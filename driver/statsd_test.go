@@ -0,0 +1,41 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStatsdPayload(t *testing.T) {
+	last := &driverStats{
+		NetworksCreated: 2,
+		Latency:         map[string]opLatency{"Join": {Count: 4, TotalMs: 40}, "Leave": {Count: 1, TotalMs: 5}},
+	}
+	stats := &driverStats{
+		Networks:        3,
+		Endpoints:       7,
+		NetworksCreated: 5,
+		Latency:         map[string]opLatency{"Join": {Count: 6, TotalMs: 70}, "Leave": {Count: 1, TotalMs: 5}},
+	}
+	lines := strings.Split(strings.TrimSuffix(string(statsdPayload(stats, last)), "\n"), "\n")
+	got := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		got[line] = true
+	}
+	for _, want := range []string{
+		"macvlan_noipam.networks:3|g",
+		"macvlan_noipam.endpoints:7|g",
+		"macvlan_noipam.networks_created:3|c",
+		"macvlan_noipam.endpoints_deleted:0|c",
+		"macvlan_noipam.Join.calls:2|c",
+		"macvlan_noipam.Join.latency:15|ms",
+	} {
+		if !got[want] {
+			t.Errorf("payload is missing %q: %v", want, lines)
+		}
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "macvlan_noipam.Leave.") {
+			t.Errorf("call without new calls pushed: %q", line)
+		}
+	}
+}
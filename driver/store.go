@@ -2,9 +2,14 @@ package driver
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/docker/libkv/store"
 	"github.com/docker/libkv/store/boltdb"
 	"github.com/docker/libnetwork/datastore"
@@ -16,9 +21,14 @@ const (
 	driverPrefix          = "macvlan-noipam"
 	macvlanNetworkPrefix  = driverPrefix + "/network"
 	macvlanEndpointPrefix = driverPrefix + "/endpoint"
-	storage               = "/var/lib/docker/network/files/macvlan-noipam.db"
+	storeBucket           = "macvlandb"
+	storeRecoverFail      = "fail"  // refuse to start on an unreadable store
+	storeRecoverReset     = "reset" // back up an unreadable store and start empty
 )
 
+// storage is the boltdb file of the driver's data store
+var storage = "/var/lib/docker/network/files/macvlan-noipam.db"
+
 // networkConfiguration for this driver's network specific configuration
 type configuration struct {
 	ID               string
@@ -29,79 +39,455 @@ type configuration struct {
 	Parent           string
 	MacvlanMode      string
 	CreatedSlaveLink bool
+	DisableIPv6      bool
+	Gateway          string
+	IfaceFlags       []string
+	DstPrefix        string
+	ParentPromisc    bool
+	DetachOnly       bool
+	ProxyARP         bool
+	ProxyNDP         bool
+	RequireMac       bool
+	AuxParents       []string
+	StableMac        bool
+	RequestedParent  string
+	RxQueues         int
+	TxQueues         int
+	RpsCpus          string
+	MacAllowlist     []string
+	Scope            string
+	DisableGwService string
+	LeaveAction      string
+	EndpointRate     string
+	Label            string
+	Priority         uint32
+	Dscp             string
+	ChildIndex       int
+	CreatedLinkType  string
+	// PromiscSet records that the driver, not the host, made the parent promiscuous
+	PromiscSet bool
+	// ProxyARPSet and ProxyNDPSet record the parent sysctls the driver enabled
+	ProxyARPSet bool
+	ProxyNDPSet bool
+	// unknownOpts are the -o keys the driver ignored, refused by -strict-options
+	unknownOpts []string
 }
 
 // initStore drivers are responsible for caching their own persistent state
 func (d *driver) initStore() error {
-	var err error
 	boltdb.Register()
-	d.store, err = datastore.NewDataStore(datastore.LocalScope, &datastore.ScopeCfg{
+	err := d.loadStore()
+	if err == nil {
+		d.restore.ok = true
+		return nil
+	}
+	d.restore.err = err.Error()
+	// a store that could not be read at all, locked by another instance or
+	// not accessible, is healthy and never reset
+	if !storeCorrupt(err) {
+		return types.InternalErrorf("macvlan driver failed to load data store %s: %v", storage, err)
+	}
+	if d.opts.StoreRecover != storeRecoverReset {
+		return types.InternalErrorf("macvlan driver failed to load data store %s, restart with -store-recover=%s to back it up and start empty: %v",
+			storage, storeRecoverReset, err)
+	}
+	logrus.Errorf("macvlan data store %s is unreadable, starting with an empty store: %v", storage, err)
+	if _, statErr := os.Stat(storage); statErr == nil {
+		backup := fmt.Sprintf("%s.corrupt-%d", storage, time.Now().Unix())
+		if err := os.Rename(storage, backup); err != nil {
+			return types.InternalErrorf("failed to back up unreadable data store %s: %v", storage, err)
+		}
+		logrus.Warnf("Backed up the unreadable macvlan data store to %s", backup)
+	}
+	// the records are all decoded before the host is touched, nothing was
+	// restored from the unreadable store
+	d.restore.reset, d.restore.failed = true, 0
+	err = d.loadStore()
+	d.restore.ok = err == nil
+
+	return err
+}
+
+// loadStore opens the data store and restores networks and endpoints from it.
+// Every record is decoded before the host is touched, so a corrupt store fails
+// without leaving restored parents or parent settings behind.
+func (d *driver) loadStore() error {
+	var err error
+	if d.store, err = openStore(); err != nil {
+		return err
+	}
+	// If empty it simply means no macvlan networks have been created yet
+	configs, err := d.listNetworkConfigs()
+	if err != nil {
+		return err
+	}
+	eps, err := d.listEndpoints()
+	if err != nil {
+		return err
+	}
+
+	// the stale records found while restoring are deleted in one flush at the end
+	start := time.Now()
+	d.batchStoreWrites(func() error {
+		d.populateNetworks(configs)
+		d.populateEndpoints(eps)
+		return nil
+	})
+	d.restore.took = time.Since(start).Round(time.Millisecond)
+	logrus.Infof("Restored macvlan networks from store in %s", d.restore.took)
+	return nil
+}
+
+// corruptStoreError is a load error caused by a record that doesn't decode
+type corruptStoreError struct {
+	err error
+}
+
+func (e *corruptStoreError) Error() string {
+	return e.err.Error()
+}
+
+func (e *corruptStoreError) Unwrap() error {
+	return e.err
+}
+
+// corruptMarkers are the messages of the boltdb and json errors a damaged
+// store fails with, matched as text since the libnetwork store cache flattens
+// the errors it returns
+var corruptMarkers = []string{
+	bolt.ErrInvalid.Error(),
+	bolt.ErrVersionMismatch.Error(),
+	bolt.ErrChecksum.Error(),
+	"file size too small",
+	"unexpected end of JSON input",
+	"invalid character",
+	"json: cannot unmarshal",
+}
+
+// storeCorrupt tells whether a load error comes from the content of the store,
+// an undecodable record or a damaged boltdb file, rather than from reaching it
+func storeCorrupt(err error) bool {
+	var corrupt *corruptStoreError
+	if errors.As(err, &corrupt) {
+		return true
+	}
+	for _, marker := range corruptMarkers {
+		if strings.Contains(err.Error(), marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// restoreStatus is the outcome of restoring the store at startup
+type restoreStatus struct {
+	ok   bool
+	err  string
+	took time.Duration
+	// reset is set when an unreadable store was backed up and started empty
+	reset bool
+	// failed counts the stored networks that could not be recreated
+	failed int
+}
+
+// storeInfo describes the data store backend for /config
+type storeInfo struct {
+	Backend string `json:"backend"`
+	Path    string `json:"path,omitempty"`
+	Bucket  string `json:"bucket,omitempty"`
+	Scope   string `json:"scope"`
+	// Restored is whether the startup restore read the store without error
+	Restored       bool   `json:"restored"`
+	RestoreError   string `json:"restore_error,omitempty"`
+	RestoreReset   bool   `json:"restore_reset,omitempty"`
+	RestoreTime    string `json:"restore_time,omitempty"`
+	FailedNetworks int    `json:"failed_networks,omitempty"`
+}
+
+// storeInfo reports the backend in use, none when the driver runs without a store
+func (d *driver) storeInfo() *storeInfo {
+	info := &storeInfo{
+		Backend:        "none",
+		Scope:          driverScope,
+		Restored:       d.restore.ok,
+		RestoreError:   d.restore.err,
+		RestoreReset:   d.restore.reset,
+		FailedNetworks: d.restore.failed,
+	}
+	if d.store != nil {
+		info.Backend = string(store.BOLTDB)
+		info.Path = storage
+		info.Bucket = storeBucket
+		info.Scope = d.store.Scope()
+	}
+	if d.restore.took > 0 {
+		info.RestoreTime = d.restore.took.String()
+	}
+
+	return info
+}
+
+// openStore opens the boltdb data store of the driver
+func openStore() (datastore.DataStore, error) {
+	ds, err := datastore.NewDataStore(datastore.LocalScope, &datastore.ScopeCfg{
 		Client: datastore.ScopeClientCfg{
 			Provider: string(store.BOLTDB),
 			Address:  storage,
 			Config: &store.Config{
-				Bucket: "macvlandb",
+				Bucket: storeBucket,
 			},
 		},
 	})
 	if err != nil {
-		return types.InternalErrorf("macvlan driver failed to initialize data store: %v", err)
+		return nil, types.InternalErrorf("macvlan driver failed to initialize data store: %v", err)
 	}
 
-	err = d.populateNetworks()
-	if err != nil {
-		return err
-	}
-	err = d.populateEndpoints()
-	if err != nil {
-		return err
+	return ds, nil
+}
+
+// recoverCorrupt turns a panic while decoding store records, a record of the
+// wrong shape failing a type assertion, into a corruptStoreError
+func recoverCorrupt(err *error) {
+	if r := recover(); r != nil {
+		*err = &corruptStoreError{fmt.Errorf("corrupt record in data store: %v", r)}
 	}
-	return nil
 }
 
-// populateNetworks is invoked at driver init to recreate persistently stored networks
-func (d *driver) populateNetworks() error {
+// listNetworkConfigs reads every network record, none when the store is empty
+func (d *driver) listNetworkConfigs() (_ []*configuration, err error) {
+	defer recoverCorrupt(&err)
 	kvol, err := d.store.List(datastore.Key(driverPrefix), &configuration{})
 	if err != nil && err != datastore.ErrKeyNotFound {
-		return fmt.Errorf("failed to get macvlan network configurations from store: %v", err)
-	}
-	// If empty it simply means no macvlan networks have been created yet
-	if err == datastore.ErrKeyNotFound {
-		return nil
+		return nil, fmt.Errorf("failed to get macvlan network configurations from store: %w", err)
 	}
+	configs := make([]*configuration, 0, len(kvol))
 	for _, kvo := range kvol {
-		config := kvo.(*configuration)
-		if _, err = d.createNetwork(config); err != nil {
-			logrus.Warnf("Could not create macvlan network for id %s from persistent state", config.ID)
-		}
+		configs = append(configs, kvo.(*configuration))
 	}
 
-	return nil
+	return configs, nil
 }
 
-func (d *driver) populateEndpoints() error {
+// listEndpoints reads every endpoint record, none when the store is empty
+func (d *driver) listEndpoints() (_ []*endpoint, err error) {
+	defer recoverCorrupt(&err)
 	kvol, err := d.store.List(datastore.Key(macvlanEndpointPrefix), &endpoint{})
 	if err != nil && err != datastore.ErrKeyNotFound {
-		return fmt.Errorf("failed to get macvlan endpoints from store: %v", err)
+		return nil, fmt.Errorf("failed to get macvlan endpoints from store: %w", err)
 	}
+	eps := make([]*endpoint, 0, len(kvol))
+	for _, kvo := range kvol {
+		eps = append(eps, kvo.(*endpoint))
+	}
+
+	return eps, nil
+}
 
-	if err == datastore.ErrKeyNotFound {
+// populateNetworks is invoked at driver init to recreate persistently stored networks
+func (d *driver) populateNetworks(configs []*configuration) {
+	for _, config := range configs {
+		if err := d.restoreNetwork(config); err != nil {
+			d.restore.failed++
+			logrus.Warnf("Could not create macvlan network for id %s from persistent state", config.ID)
+			continue
+		}
+	}
+}
+
+// restoreNetwork recreates a stored network with its parent and parent
+// settings. In maintenance mode the host is left alone, the network is only
+// restored in memory and a resync after maintenance recreates a missing parent.
+func (d *driver) restoreNetwork(config *configuration) error {
+	if !d.inMaintenance() {
+		if _, err := d.createNetwork(config); err != nil {
+			return err
+		}
+		restoreHostMods(config)
 		return nil
 	}
+	if _, err := d.findParentConflict(config); err != nil {
+		return err
+	}
+	if !parentExists(config.Parent) {
+		logrus.Warnf("Parent %s of network %.7s is missing, not recreated in maintenance mode", config.Parent, config.ID)
+	}
+	d.addNetwork(&network{
+		id:        config.ID,
+		driver:    d,
+		endpoints: endpointTable{},
+		config:    config,
+	})
 
-	for _, kvo := range kvol {
-		ep := kvo.(*endpoint)
-		n, ok := d.networks[ep.nid]
-		if !ok {
-			logrus.Debugf("Network (%.7s) not found for restored macvlan endpoint (%.7s)", ep.nid, ep.id)
-			logrus.Debugf("Deleting stale macvlan endpoint (%.7s) from store", ep.id)
-			if err := d.storeDelete(ep); err != nil {
-				logrus.Debugf("Failed to delete stale macvlan endpoint (%.7s) from store", ep.id)
-			}
+	return nil
+}
+
+// restoreHostMods brings back the parent changes a restored network owns. The
+// ownership flags are persisted with the network, so the refcounts shared by
+// networks on one parent are rebuilt from the restored networks themselves and
+// a restart neither applies a change twice nor forgets to undo it.
+func restoreHostMods(config *configuration) {
+	restorePromisc(config)
+	restoreParentSysctls(config)
+}
+
+func (d *driver) populateEndpoints(eps []*endpoint) {
+	for _, ep := range eps {
+		d.restoreEndpoint(ep)
+	}
+}
+
+// restoreEndpoint attaches a stored endpoint to its network, deleting it when the network is gone
+func (d *driver) restoreEndpoint(ep *endpoint) {
+	n, err := d.getNetwork(ep.nid)
+	if err != nil {
+		logrus.Debugf("Network (%.7s) not found for restored macvlan endpoint (%.7s)", ep.nid, ep.id)
+		logrus.Debugf("Deleting stale macvlan endpoint (%.7s) from store", ep.id)
+		if err := d.storeDelete(ep); err != nil {
+			logrus.Debugf("Failed to delete stale macvlan endpoint (%.7s) from store", ep.id)
+		}
+		return
+	}
+	// an endpoint saved after a failed counter write must not share its index
+	n.Lock()
+	if ep.childIndex > n.config.ChildIndex {
+		n.config.ChildIndex = ep.childIndex
+	}
+	n.Unlock()
+	n.addEndpoint(ep)
+	logrus.Debugf("Endpoint (%.7s) restored to network (%.7s)", ep.id, ep.nid)
+}
+
+// resyncResult reports what a single network resync restored
+type resyncResult struct {
+	NetworkID       string `json:"network_id"`
+	Parent          string `json:"parent"`
+	ParentRecreated bool   `json:"parent_recreated"`
+	Endpoints       int    `json:"endpoints"`
+	// RecreatedLinks are the endpoint children that were missing and recreated,
+	// MissingLinks the ones that could not be
+	RecreatedLinks []string `json:"recreated_links,omitempty"`
+	MissingLinks   []string `json:"missing_links,omitempty"`
+}
+
+// resyncNetwork reloads one network and its endpoints from the store and
+// recreates a missing driver created parent and missing endpoint children. The
+// in-memory network is only replaced once the stored one is rebuilt, a failed
+// resync leaves it as it was. In maintenance mode nothing is recreated, the
+// missing links are only reported.
+func (d *driver) resyncNetwork(nid string) (*resyncResult, error) {
+	if d.store == nil {
+		return nil, types.InternalErrorf("macvlan store not initialized")
+	}
+	d.FlushStore()
+	config := &configuration{ID: nid}
+	if err := d.store.GetObject(datastore.Key(config.Key()...), config); err != nil {
+		if err == datastore.ErrKeyNotFound {
+			return nil, types.NotFoundErrorf("network %s not found in store", nid)
+		}
+		return nil, fmt.Errorf("failed to get macvlan network %s from store: %v", nid, err)
+	}
+	eps, err := d.listEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	maintenance := d.inMaintenance()
+	result := &resyncResult{NetworkID: nid, Parent: config.Parent}
+	if _, err := d.findParentConflict(config); err != nil {
+		return nil, fmt.Errorf("failed to recreate network %s from store: %v", nid, err)
+	}
+	if !parentExists(config.Parent) {
+		if maintenance {
+			result.MissingLinks = append(result.MissingLinks, config.Parent)
+		} else if err := createParentLink(config); err != nil {
+			return nil, fmt.Errorf("failed to recreate network %s from store: %v", nid, err)
+		} else {
+			result.ParentRecreated = true
+		}
+	}
+	n := &network{
+		id:        nid,
+		driver:    d,
+		endpoints: endpointTable{},
+		config:    config,
+	}
+	for _, ep := range eps {
+		if ep.nid != nid {
 			continue
 		}
+		if ep.childIndex > config.ChildIndex {
+			config.ChildIndex = ep.childIndex
+		}
 		n.endpoints[ep.id] = ep
-		logrus.Debugf("Endpoint (%.7s) restored to network (%.7s)", ep.id, ep.nid)
+		result.Endpoints++
+		if !ep.linkMissing(config) {
+			continue
+		}
+		if maintenance {
+			result.MissingLinks = append(result.MissingLinks, ep.srcName)
+			continue
+		}
+		if err := d.recreateEndpointLink(n, ep); err != nil {
+			logrus.Warnf("Failed to recreate interface %s of endpoint %.7s: %v", ep.srcName, ep.id, err)
+			result.MissingLinks = append(result.MissingLinks, ep.srcName)
+			continue
+		}
+		result.RecreatedLinks = append(result.RecreatedLinks, ep.srcName)
+	}
+	d.addNetwork(n)
+	if !maintenance {
+		restoreHostMods(config)
+	}
+	logrus.Infof("Resynced network %.7s from store with %d endpoints", nid, result.Endpoints)
+
+	return result, nil
+}
+
+// linkMissing tells whether the child of an endpoint should exist but doesn't,
+// one kept on the host by -o leave_action or one joined to a live sandbox
+func (ep *endpoint) linkMissing(config *configuration) bool {
+	if ep.srcName == "" || parentExists(ep.srcName) {
+		return false
+	}
+	if ep.sandboxKey == "" {
+		return config.LeaveAction != leaveDelete
+	}
+	if ep.sandboxGone() {
+		return false
+	}
+	_, _, release, err := endpointLink(ep)
+	if err == nil {
+		release()
+	}
+
+	return err != nil
+}
+
+// recreateEndpointLink recreates the missing child of an endpoint, in its
+// sandbox when joined or on the host under its stored name when kept by leave
+func (d *driver) recreateEndpointLink(n *network, ep *endpoint) error {
+	if ep.sandboxKey != "" {
+		return d.healEndpoint(n, ep)
+	}
+	mtu, err := d.childMTU(n.config)
+	if err != nil {
+		return err
+	}
+	if _, err := createMacVlanQueues(ep.srcName, n.config.Parent, n.config.MacvlanMode, mtu, n.config.RxQueues, n.config.TxQueues); err != nil {
+		return err
+	}
+	if err := setLinkMac(ep.srcName, ep.mac); err != nil {
+		delLink(ep.srcName)
+		return err
+	}
+	if len(n.config.IfaceFlags) > 0 {
+		if err := setLinkFlags(ep.srcName, n.config.IfaceFlags); err != nil {
+			delLink(ep.srcName)
+			return err
+		}
+	}
+	if err := setLinkAlias(ep.srcName, ep.alias()); err != nil {
+		logrus.Warnf("Failed to set the alias of interface %s for endpoint %.7s: %v", ep.srcName, ep.id, err)
 	}
 
 	return nil
@@ -109,6 +495,15 @@ func (d *driver) populateEndpoints() error {
 
 // storeUpdate used to update persistent macvlan network records as they are created
 func (d *driver) storeUpdate(kvObject datastore.KVObject) error {
+	if d.queueStoreWrite(kvObject, false) {
+		return nil
+	}
+
+	return d.storeUpdateNow(kvObject)
+}
+
+// storeUpdateNow writes a record to the store, bypassing -store-sync=false batching
+func (d *driver) storeUpdateNow(kvObject datastore.KVObject) error {
 	if d.store == nil {
 		logrus.Warnf("macvlan store not initialized. kv object %s is not added to the store", datastore.Key(kvObject.Key()...))
 		return nil
@@ -122,6 +517,15 @@ func (d *driver) storeUpdate(kvObject datastore.KVObject) error {
 
 // storeDelete used to delete macvlan records from persistent cache as they are deleted
 func (d *driver) storeDelete(kvObject datastore.KVObject) error {
+	if d.queueStoreWrite(kvObject, true) {
+		return nil
+	}
+
+	return d.storeDeleteNow(kvObject)
+}
+
+// storeDeleteNow deletes a record from the store, bypassing -store-sync=false batching
+func (d *driver) storeDeleteNow(kvObject datastore.KVObject) error {
 	if d.store == nil {
 		logrus.Debugf("macvlan store not initialized. kv object %s is not deleted from store", datastore.Key(kvObject.Key()...))
 		return nil
@@ -140,6 +544,37 @@ retry:
 	return nil
 }
 
+// storeDeleteNetwork removes any remaining records of a network no longer in memory
+func (d *driver) storeDeleteNetwork(nid string) error {
+	if d.store == nil {
+		return nil
+	}
+	d.FlushStore()
+	kvol, err := d.store.List(datastore.Key(macvlanEndpointPrefix), &endpoint{})
+	if err != nil && err != datastore.ErrKeyNotFound {
+		return fmt.Errorf("failed to get macvlan endpoints from store: %v", err)
+	}
+	for _, kvo := range kvol {
+		if ep := kvo.(*endpoint); ep.nid == nid {
+			if err := d.storeDelete(ep); err != nil {
+				return fmt.Errorf("failed to remove macvlan endpoint %.7s from store: %v", ep.id, err)
+			}
+		}
+	}
+	config := &configuration{ID: nid}
+	if err := d.store.GetObject(datastore.Key(config.Key()...), config); err != nil {
+		if err == datastore.ErrKeyNotFound {
+			return nil
+		}
+		return fmt.Errorf("failed to get macvlan network %s from store: %v", nid, err)
+	}
+	if err := d.storeDelete(config); err != nil {
+		return fmt.Errorf("error deleting deleting id %s from datastore: %v", nid, err)
+	}
+
+	return nil
+}
+
 func (config *configuration) MarshalJSON() ([]byte, error) {
 	nMap := make(map[string]interface{})
 	nMap["ID"] = config.ID
@@ -148,6 +583,42 @@ func (config *configuration) MarshalJSON() ([]byte, error) {
 	nMap["MacvlanMode"] = config.MacvlanMode
 	nMap["Internal"] = config.Internal
 	nMap["CreatedSubIface"] = config.CreatedSlaveLink
+	nMap["DisableIPv6"] = config.DisableIPv6
+	nMap["Gateway"] = config.Gateway
+	if len(config.IfaceFlags) > 0 {
+		nMap["IfaceFlags"] = config.IfaceFlags
+	}
+	if config.DstPrefix != "" {
+		nMap["DstPrefix"] = config.DstPrefix
+	}
+	nMap["ParentPromisc"] = config.ParentPromisc
+	nMap["PromiscSet"] = config.PromiscSet
+	nMap["DetachOnly"] = config.DetachOnly
+	nMap["ProxyARP"] = config.ProxyARP
+	nMap["ProxyNDP"] = config.ProxyNDP
+	nMap["RequireMac"] = config.RequireMac
+	nMap["StableMac"] = config.StableMac
+	nMap["RequestedParent"] = config.RequestedParent
+	nMap["RxQueues"] = config.RxQueues
+	nMap["TxQueues"] = config.TxQueues
+	nMap["RpsCpus"] = config.RpsCpus
+	nMap["Scope"] = config.Scope
+	nMap["DisableGwService"] = config.DisableGwService
+	nMap["LeaveAction"] = config.LeaveAction
+	nMap["EndpointRate"] = config.EndpointRate
+	nMap["Label"] = config.Label
+	nMap["Priority"] = config.Priority
+	nMap["Dscp"] = config.Dscp
+	nMap["ChildIndex"] = config.ChildIndex
+	nMap["CreatedLinkType"] = config.CreatedLinkType
+	if len(config.MacAllowlist) > 0 {
+		nMap["MacAllowlist"] = config.MacAllowlist
+	}
+	if len(config.AuxParents) > 0 {
+		nMap["AuxParents"] = config.AuxParents
+	}
+	nMap["ProxyARPSet"] = config.ProxyARPSet
+	nMap["ProxyNDPSet"] = config.ProxyNDPSet
 
 	return json.Marshal(nMap)
 }
@@ -167,6 +638,104 @@ func (config *configuration) UnmarshalJSON(b []byte) error {
 	config.MacvlanMode = nMap["MacvlanMode"].(string)
 	config.Internal = nMap["Internal"].(bool)
 	config.CreatedSlaveLink = nMap["CreatedSubIface"].(bool)
+	if v, ok := nMap["DisableIPv6"]; ok {
+		config.DisableIPv6 = v.(bool)
+	}
+	if v, ok := nMap["Gateway"]; ok {
+		config.Gateway = v.(string)
+	}
+	if v, ok := nMap["IfaceFlags"]; ok {
+		for _, flag := range v.([]interface{}) {
+			config.IfaceFlags = append(config.IfaceFlags, flag.(string))
+		}
+	}
+	if v, ok := nMap["DstPrefix"]; ok {
+		config.DstPrefix = v.(string)
+	}
+	if v, ok := nMap["ParentPromisc"]; ok {
+		config.ParentPromisc = v.(bool)
+	}
+	if v, ok := nMap["PromiscSet"]; ok {
+		config.PromiscSet = v.(bool)
+	}
+	if v, ok := nMap["DetachOnly"]; ok {
+		config.DetachOnly = v.(bool)
+	}
+	if v, ok := nMap["ProxyARP"]; ok {
+		config.ProxyARP = v.(bool)
+	}
+	if v, ok := nMap["ProxyNDP"]; ok {
+		config.ProxyNDP = v.(bool)
+	}
+	if v, ok := nMap["RequireMac"]; ok {
+		config.RequireMac = v.(bool)
+	}
+	if v, ok := nMap["RequestedParent"]; ok {
+		config.RequestedParent = v.(string)
+	} else {
+		// written before the requested parent was recorded
+		config.RequestedParent = config.Parent
+	}
+	if v, ok := nMap["RxQueues"]; ok {
+		config.RxQueues = int(v.(float64))
+	}
+	if v, ok := nMap["TxQueues"]; ok {
+		config.TxQueues = int(v.(float64))
+	}
+	if v, ok := nMap["RpsCpus"]; ok {
+		config.RpsCpus = v.(string)
+	}
+	if v, ok := nMap["DisableGwService"]; ok {
+		config.DisableGwService = v.(string)
+	}
+	if v, ok := nMap["Priority"]; ok {
+		config.Priority = uint32(v.(float64))
+	}
+	if v, ok := nMap["ChildIndex"]; ok {
+		config.ChildIndex = int(v.(float64))
+	}
+	if v, ok := nMap["CreatedLinkType"]; ok {
+		config.CreatedLinkType = v.(string)
+	}
+	if v, ok := nMap["Dscp"]; ok {
+		config.Dscp = v.(string)
+	}
+	if v, ok := nMap["Label"]; ok {
+		config.Label = v.(string)
+	}
+	if v, ok := nMap["EndpointRate"]; ok {
+		config.EndpointRate = v.(string)
+	}
+	if v, ok := nMap["LeaveAction"]; ok {
+		config.LeaveAction = v.(string)
+	} else {
+		config.LeaveAction = leaveDelete
+	}
+	if v, ok := nMap["Scope"]; ok {
+		config.Scope = v.(string)
+	} else {
+		// written before networks recorded a scope
+		config.Scope = driverScope
+	}
+	if v, ok := nMap["MacAllowlist"]; ok {
+		for _, mac := range v.([]interface{}) {
+			config.MacAllowlist = append(config.MacAllowlist, mac.(string))
+		}
+	}
+	if v, ok := nMap["StableMac"]; ok {
+		config.StableMac = v.(bool)
+	}
+	if v, ok := nMap["AuxParents"]; ok {
+		for _, parent := range v.([]interface{}) {
+			config.AuxParents = append(config.AuxParents, parent.(string))
+		}
+	}
+	if v, ok := nMap["ProxyARPSet"]; ok {
+		config.ProxyARPSet = v.(bool)
+	}
+	if v, ok := nMap["ProxyNDPSet"]; ok {
+		config.ProxyNDPSet = v.(bool)
+	}
 
 	return nil
 }
@@ -229,9 +798,27 @@ func (ep *endpoint) MarshalJSON() ([]byte, error) {
 	epMap["id"] = ep.id
 	epMap["nid"] = ep.nid
 	epMap["SrcName"] = ep.srcName
+	if ep.containerName != "" {
+		epMap["ContainerName"] = ep.containerName
+	}
 	if len(ep.mac) != 0 {
 		epMap["MacAddress"] = ep.mac.String()
 	}
+	if ep.sandboxKey != "" {
+		epMap["SandboxKey"] = ep.sandboxKey
+	}
+	if len(ep.auxNames) > 0 {
+		epMap["AuxNames"] = ep.auxNames
+	}
+	if ep.childIndex != 0 {
+		epMap["ChildIndex"] = ep.childIndex
+	}
+	if !ep.joinedAt.IsZero() {
+		epMap["JoinedAt"] = ep.joinedAt.Format(time.RFC3339Nano)
+	}
+	if !ep.leftAt.IsZero() {
+		epMap["LeftAt"] = ep.leftAt.Format(time.RFC3339Nano)
+	}
 
 	return json.Marshal(epMap)
 }
@@ -255,6 +842,30 @@ func (ep *endpoint) UnmarshalJSON(b []byte) error {
 	ep.id = epMap["id"].(string)
 	ep.nid = epMap["nid"].(string)
 	ep.srcName = epMap["SrcName"].(string)
+	if v, ok := epMap["ContainerName"]; ok {
+		ep.containerName = v.(string)
+	}
+	if v, ok := epMap["SandboxKey"]; ok {
+		ep.sandboxKey = v.(string)
+	}
+	if v, ok := epMap["AuxNames"]; ok {
+		for _, name := range v.([]interface{}) {
+			ep.auxNames = append(ep.auxNames, name.(string))
+		}
+	}
+	if v, ok := epMap["ChildIndex"]; ok {
+		ep.childIndex = int(v.(float64))
+	}
+	if v, ok := epMap["JoinedAt"]; ok {
+		if ep.joinedAt, err = time.Parse(time.RFC3339Nano, v.(string)); err != nil {
+			return types.InternalErrorf("failed to decode macvlan endpoint join time (%s) after json unmarshal: %v", v.(string), err)
+		}
+	}
+	if v, ok := epMap["LeftAt"]; ok {
+		if ep.leftAt, err = time.Parse(time.RFC3339Nano, v.(string)); err != nil {
+			return types.InternalErrorf("failed to decode macvlan endpoint leave time (%s) after json unmarshal: %v", v.(string), err)
+		}
+	}
 
 	return nil
 }
@@ -302,7 +913,12 @@ func (ep *endpoint) New() datastore.KVObject {
 
 func (ep *endpoint) CopyTo(o datastore.KVObject) error {
 	dstEp := o.(*endpoint)
-	*dstEp = *ep
+	// field by field, the endpoint lock is not copied
+	dstEp.id, dstEp.nid, dstEp.mac = ep.id, ep.nid, ep.mac
+	dstEp.srcName, dstEp.auxNames, dstEp.childIndex = ep.srcName, ep.auxNames, ep.childIndex
+	dstEp.sandboxKey, dstEp.containerName = ep.sandboxKey, ep.containerName
+	dstEp.joinedAt, dstEp.leftAt, dstEp.leaving = ep.joinedAt, ep.leftAt, ep.leaving
+	dstEp.dbIndex, dstEp.dbExists = ep.dbIndex, ep.dbExists
 	return nil
 }
 
@@ -0,0 +1,349 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	networkapi "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/datastore"
+	"github.com/sirupsen/logrus"
+)
+
+// withTestStorage points the data store at a file in a temporary directory
+func withTestStorage(t testing.TB) string {
+	if raceEnabled {
+		t.Skip("boltdb v1.3.1 fails the checkptr checks of -race")
+	}
+	dir := t.TempDir()
+	previous := storage
+	storage = filepath.Join(dir, "macvlan-noipam.db")
+	t.Cleanup(func() { storage = previous })
+
+	return storage
+}
+
+func TestInitStoreResetsCorruptStore(t *testing.T) {
+	path := withTestStorage(t)
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte{0xff}, 8192), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestDriver(Options{StoreRecover: storeRecoverFail})
+	if err := d.initStore(); err == nil {
+		t.Fatal("corrupt store loaded with -store-recover=fail")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("-store-recover=fail moved the store: %v", err)
+	}
+
+	d = newTestDriver(Options{StoreRecover: storeRecoverReset})
+	if err := d.initStore(); err != nil {
+		t.Fatalf("corrupt store not reset: %v", err)
+	}
+	if !d.restore.reset || !d.restore.ok {
+		t.Errorf("restore status %+v, want a successful reset", d.restore)
+	}
+	backups, _ := filepath.Glob(path + ".corrupt-*")
+	if len(backups) != 1 {
+		t.Errorf("got backups %v, want one", backups)
+	}
+}
+
+func TestInitStoreKeepsUnreachableStore(t *testing.T) {
+	// a directory fails to open like a permission error does
+	path := withTestStorage(t)
+	storage = filepath.Dir(path)
+
+	d := newTestDriver(Options{StoreRecover: storeRecoverReset})
+	if err := d.initStore(); err == nil {
+		t.Fatal("directory loaded as a store")
+	}
+	if d.restore.reset {
+		t.Error("unreachable store was reset")
+	}
+}
+
+func TestStoreCorrupt(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{bolt.ErrInvalid, true},
+		{bolt.ErrChecksum, true},
+		{fmt.Errorf("failed to get macvlan endpoints from store: %w", bolt.ErrVersionMismatch), true},
+		{&corruptStoreError{fmt.Errorf("corrupt record in data store: bad type")}, true},
+		{fmt.Errorf("error while populating kmap: unexpected end of JSON input"), true},
+		{bolt.ErrTimeout, false},
+		{os.ErrPermission, false},
+	} {
+		if got := storeCorrupt(tc.err); got != tc.want {
+			t.Errorf("storeCorrupt(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestDeleteNetworkRetryCleansStore(t *testing.T) {
+	withTestStorage(t)
+	d := newTestDriver(Options{})
+	if err := d.initStore(); err != nil {
+		t.Fatal(err)
+	}
+	// records left by a delete that failed after removing the network from memory
+	if err := d.storeUpdate(&configuration{ID: "n1", Parent: "eth0", MacvlanMode: modeBridge}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.storeUpdate(&endpoint{id: "e1", nid: "n1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.storeUpdate(&endpoint{id: "e2", nid: "n2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.DeleteNetwork(&networkapi.DeleteNetworkRequest{NetworkID: "n1"}); err != nil {
+		t.Fatalf("retried DeleteNetwork: %v", err)
+	}
+	configs, err := d.listNetworkConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 0 {
+		t.Errorf("retried DeleteNetwork left %d network records", len(configs))
+	}
+	eps, err := d.listEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eps) != 1 || eps[0].id != "e2" {
+		t.Errorf("got endpoint records %v, want only the one of the other network", eps)
+	}
+	if err := d.DeleteNetwork(&networkapi.DeleteNetworkRequest{NetworkID: "n1"}); err != nil {
+		t.Errorf("DeleteNetwork of a network already gone: %v", err)
+	}
+}
+
+func TestRestoreOwnedPromisc(t *testing.T) {
+	withTestNetns(t, "mvtest0")
+	withTestStorage(t)
+	d := newTestDriver(Options{})
+	if err := d.initStore(); err != nil {
+		t.Fatal(err)
+	}
+	// the parent was recreated without the promiscuous mode the network owns
+	config := &configuration{ID: "n1", Parent: "mvtest0", RequestedParent: "mvtest0", MacvlanMode: modeBridge,
+		ParentPromisc: true, PromiscSet: true}
+	if err := d.storeUpdate(config); err != nil {
+		t.Fatal(err)
+	}
+	d.store.Close()
+
+	d = newTestDriver(Options{})
+	if err := d.initStore(); err != nil {
+		t.Fatal(err)
+	}
+	if !promiscuous(t, "mvtest0") {
+		t.Error("restored network didn't restore the promiscuous mode it owns")
+	}
+}
+
+func TestRestoreManyRecords(t *testing.T) {
+	const (
+		networks     = 20
+		endpointsPer = 10
+		stale        = 100
+	)
+	withTestStorage(t)
+	seedRestoreStore(t, networks, endpointsPer, stale)
+
+	// maintenance mode restores the networks without their missing parents
+	d := newTestDriver(Options{})
+	d.setMaintenance(true)
+	if err := d.initStore(); err != nil {
+		t.Fatal(err)
+	}
+	if d.batch != nil {
+		t.Error("store writes are still batched after the restore")
+	}
+	restored := 0
+	for _, n := range d.getNetworks() {
+		restored += len(n.getEndpoints())
+	}
+	if got := len(d.getNetworks()); got != networks {
+		t.Errorf("restored %d networks, want %d", got, networks)
+	}
+	if restored != networks*endpointsPer {
+		t.Errorf("restored %d endpoints, want %d", restored, networks*endpointsPer)
+	}
+	eps, err := d.listEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eps) != networks*endpointsPer {
+		t.Errorf("store holds %d endpoints after the restore, want the %d of restored networks", len(eps), networks*endpointsPer)
+	}
+}
+
+// seedRestoreStore fills the test store with networks on missing parents, their
+// endpoints and endpoint records of a network that is gone
+func seedRestoreStore(t testing.TB, networks, endpointsPer, stale int) {
+	d := newTestDriver(Options{})
+	if err := d.initStore(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.store.Close()
+	for i := 0; i < networks; i++ {
+		nid := fmt.Sprintf("n%d", i)
+		parent := fmt.Sprintf("mvp%d", i)
+		if err := d.storeUpdate(&configuration{ID: nid, Parent: parent, RequestedParent: parent, MacvlanMode: modeBridge}); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < endpointsPer; j++ {
+			if err := d.storeUpdate(&endpoint{id: fmt.Sprintf("%s-e%d", nid, j), nid: nid}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < stale; i++ {
+		if err := d.storeUpdate(&endpoint{id: fmt.Sprintf("stale-e%d", i), nid: "gone"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRestoreWrites compares the restore writing its store updates and
+// stale record deletions one by one against batching them into one flush
+func BenchmarkRestoreWrites(b *testing.B) {
+	path := withTestStorage(b)
+	seedRestoreStore(b, 20, 10, 100)
+	// the restore warns about every missing parent
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.ErrorLevel)
+	defer logrus.SetLevel(level)
+	seed, err := ioutil.ReadFile(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, batched := range []bool{false, true} {
+		name := "per-record"
+		if batched {
+			name = "batched"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if err := ioutil.WriteFile(path, seed, 0600); err != nil {
+					b.Fatal(err)
+				}
+				d := newTestDriver(Options{})
+				d.setMaintenance(true)
+				if d.store, err = openStore(); err != nil {
+					b.Fatal(err)
+				}
+				configs, err := d.listNetworkConfigs()
+				if err != nil {
+					b.Fatal(err)
+				}
+				eps, err := d.listEndpoints()
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				restore := func() error {
+					d.populateNetworks(configs)
+					d.populateEndpoints(eps)
+					return nil
+				}
+				if batched {
+					d.batchStoreWrites(restore)
+				} else {
+					restore()
+				}
+				b.StopTimer()
+				d.store.Close()
+			}
+		})
+	}
+}
+
+// wrongShapeRecord is a network record whose mtu is stored as a string
+type wrongShapeRecord struct {
+	*configuration
+}
+
+func (r wrongShapeRecord) Value() []byte {
+	return []byte(`{"ID":"` + r.ID + `","Mtu":"jumbo","Parent":"eth0","MacvlanMode":"bridge"}`)
+}
+
+// countingStore is a data store counting its writes
+type countingStore struct {
+	datastore.DataStore
+	sync.Mutex
+	puts int
+}
+
+func (s *countingStore) PutObjectAtomic(datastore.KVObject) error {
+	s.Lock()
+	defer s.Unlock()
+	s.puts++
+
+	return nil
+}
+
+func TestBatchStoreWritesConcurrently(t *testing.T) {
+	d := newTestDriver(Options{})
+	store := &countingStore{}
+	d.store = store
+	const writes = 100
+
+	// plugin and admin calls write and flush while the restore batches its writes
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < writes; i++ {
+			d.FlushStore()
+			if err := d.storeUpdate(&endpoint{id: fmt.Sprintf("e%d", i), nid: "n1"}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	d.batchStoreWrites(func() error {
+		for i := 0; i < writes; i++ {
+			d.storeUpdate(&endpoint{id: fmt.Sprintf("r%d", i), nid: "n1"})
+		}
+		return nil
+	})
+	wg.Wait()
+	d.FlushStore()
+	if store.puts != 2*writes {
+		t.Errorf("stored %d records, want %d", store.puts, 2*writes)
+	}
+}
+
+func TestInitStoreResetsWrongShapeRecord(t *testing.T) {
+	withTestStorage(t)
+	d := newTestDriver(Options{})
+	if err := d.initStore(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.storeUpdate(wrongShapeRecord{&configuration{ID: "n1"}}); err != nil {
+		t.Fatal(err)
+	}
+	d.store.Close()
+
+	d = newTestDriver(Options{StoreRecover: storeRecoverReset})
+	if err := d.initStore(); err != nil {
+		t.Fatalf("store with a record of the wrong shape not reset: %v", err)
+	}
+	if !d.restore.reset {
+		t.Errorf("restore status %+v, want a reset", d.restore)
+	}
+	if networks := d.getNetworks(); len(networks) != 0 {
+		t.Errorf("reset store restored %d networks", len(networks))
+	}
+}
@@ -0,0 +1,129 @@
+package driver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/docker/libnetwork/datastore"
+	"github.com/sirupsen/logrus"
+)
+
+// storeBatch holds the store writes deferred by -store-sync=false until the
+// next flush, keyed by record so only the latest write of a record is kept
+type storeBatch struct {
+	sync.Mutex
+	pending map[string]*batchOp
+	// flushing serializes flushes so writes of a record land in order
+	flushing sync.Mutex
+}
+
+// batchOp is a deferred put, or delete when del is set, of a store record
+type batchOp struct {
+	obj datastore.KVObject
+	del bool
+}
+
+func newStoreBatch() *storeBatch {
+	return &storeBatch{pending: make(map[string]*batchOp)}
+}
+
+// queue records a write, superseding any pending write of the same record
+func (b *storeBatch) queue(kvObject datastore.KVObject, del bool) {
+	key := datastore.Key(kvObject.Key()...)
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.pending[key]; ok && del && !kvObject.Exists() {
+		// created and deleted within one interval, never reaches the disk
+		delete(b.pending, key)
+		return
+	}
+	b.pending[key] = &batchOp{obj: kvObject, del: del}
+}
+
+// take empties the batch and returns its writes
+func (b *storeBatch) take() map[string]*batchOp {
+	b.Lock()
+	defer b.Unlock()
+	ops := b.pending
+	b.pending = make(map[string]*batchOp)
+
+	return ops
+}
+
+// queueStoreWrite queues a write to the current batch and tells whether it
+// did, writes go straight to the store when there is no batch
+func (d *driver) queueStoreWrite(kvObject datastore.KVObject, del bool) bool {
+	d.batchMu.Lock()
+	defer d.batchMu.Unlock()
+	if d.batch == nil || d.store == nil {
+		return false
+	}
+	d.batch.queue(kvObject, del)
+
+	return true
+}
+
+// FlushStore writes out the store writes batched by -store-sync=false, it is
+// a no-op when writes are synchronous
+func (d *driver) FlushStore() {
+	d.batchMu.Lock()
+	b := d.batch
+	d.batchMu.Unlock()
+	if b != nil {
+		d.flushBatch(b)
+	}
+}
+
+// flushBatch writes out the pending writes of a batch
+func (d *driver) flushBatch(b *storeBatch) {
+	b.flushing.Lock()
+	defer b.flushing.Unlock()
+	ops := b.take()
+	for key, op := range ops {
+		var err error
+		if op.del {
+			err = d.storeDeleteNow(op.obj)
+		} else {
+			err = d.storeUpdateNow(op.obj)
+		}
+		if err != nil {
+			logrus.Errorf("Failed to flush macvlan store record %s: %v", key, err)
+		}
+	}
+	if len(ops) > 0 {
+		logrus.Debugf("Flushed %d macvlan store writes", len(ops))
+	}
+}
+
+// batchStoreWrites runs fn with its store writes queued and flushes them once
+// it returns, they join the pending batch when writes are already batched.
+// The boltdb backend has no multi record transaction, the flush still writes
+// record by record but only the last write of each.
+func (d *driver) batchStoreWrites(fn func() error) error {
+	d.batchMu.Lock()
+	if d.batch != nil {
+		d.batchMu.Unlock()
+		return fn()
+	}
+	b := newStoreBatch()
+	d.batch = b
+	d.batchMu.Unlock()
+	defer func() {
+		// writes made meanwhile wait for the flush, then go straight to the store
+		d.batchMu.Lock()
+		defer d.batchMu.Unlock()
+		d.flushBatch(b)
+		d.batch = nil
+	}()
+
+	return fn()
+}
+
+// runStoreFlush periodically persists batched store writes
+func (d *driver) runStoreFlush(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.FlushStore()
+	}
+}
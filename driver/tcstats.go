@@ -0,0 +1,127 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// shapingQdiscs are the root qdisc kinds that indicate a bandwidth limit
+var shapingQdiscs = map[string]bool{
+	"tbf":  true,
+	"htb":  true,
+	"hfsc": true,
+	"cake": true,
+}
+
+// qdiscStats are the counters of the rate limiting root qdisc of an endpoint interface
+type qdiscStats struct {
+	Kind       string `json:"kind"`
+	Bytes      uint64 `json:"bytes"`
+	Packets    uint32 `json:"packets"`
+	Drops      uint32 `json:"drops"`
+	Overlimits uint32 `json:"overlimits"`
+	Backlog    uint32 `json:"backlog"`
+}
+
+// infoValues renders the stats into EndpointInfo value map keys
+func (s *qdiscStats) infoValues(value map[string]string) {
+	value["tc_qdisc"] = s.Kind
+	value["tc_bytes"] = strconv.FormatUint(s.Bytes, 10)
+	value["tc_packets"] = strconv.FormatUint(uint64(s.Packets), 10)
+	value["tc_drops"] = strconv.FormatUint(uint64(s.Drops), 10)
+	value["tc_overlimits"] = strconv.FormatUint(uint64(s.Overlimits), 10)
+}
+
+// endpointQdiscStats reads the root qdisc counters of an endpoint's interface,
+// nil when the interface has no rate limiting qdisc
+func endpointQdiscStats(ep *endpoint) (*qdiscStats, error) {
+	if ep.srcName == "" {
+		return nil, nil
+	}
+	_, link, release, err := endpointLink(ep)
+	if err != nil {
+		return nil, err
+	}
+	release()
+	index := link.Attrs().Index
+	if ep.sandboxKey == "" {
+		return rootQdiscStats(index)
+	}
+	var stats *qdiscStats
+	err = inSandbox(ep.sandboxKey, func() error {
+		stats, err = rootQdiscStats(index)
+		return err
+	})
+
+	return stats, err
+}
+
+// rootQdiscStats dumps the qdiscs of the current namespace and parses the
+// TCA_STATS2 counters of the root qdisc on the interface, which the netlink
+// library does not expose for qdiscs
+func rootQdiscStats(index int) (*qdiscStats, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETQDISC, unix.NLM_F_DUMP)
+	req.AddData(&nl.TcMsg{Family: nl.FAMILY_ALL, Ifindex: int32(index)})
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWQDISC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump qdiscs: %v", err)
+	}
+	for _, m := range msgs {
+		msg := nl.DeserializeTcMsg(m)
+		if int(msg.Ifindex) != index || msg.Parent != netlink.HANDLE_ROOT {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+		stats := &qdiscStats{}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case nl.TCA_KIND:
+				stats.Kind = string(bytes.TrimRight(attr.Value, "\x00"))
+			case nl.TCA_STATS2:
+				if err := parseQdiscStats2(attr.Value, stats); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if !shapingQdiscs[stats.Kind] {
+			return nil, nil
+		}
+		return stats, nil
+	}
+
+	return nil, nil
+}
+
+func parseQdiscStats2(data []byte, stats *qdiscStats) error {
+	attrs, err := nl.ParseRouteAttr(data)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case nl.TCA_STATS_BASIC:
+			basic := netlink.GnetStatsBasic{}
+			if err := binary.Read(bytes.NewReader(attr.Value), nl.NativeEndian(), &basic); err != nil {
+				return fmt.Errorf("failed to parse qdisc basic stats: %v", err)
+			}
+			stats.Bytes, stats.Packets = basic.Bytes, basic.Packets
+		case nl.TCA_STATS_QUEUE:
+			queue := netlink.GnetStatsQueue{}
+			if err := binary.Read(bytes.NewReader(attr.Value), nl.NativeEndian(), &queue); err != nil {
+				return fmt.Errorf("failed to parse qdisc queue stats: %v", err)
+			}
+			stats.Drops, stats.Overlimits, stats.Backlog = queue.Drops, queue.Overlimits, queue.Backlog
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/docker/libnetwork/ns"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// teardownWorkers bounds the concurrent link deletions of a network teardown
+const teardownWorkers = 8
+
+// deleteEndpointLinks deletes the host links of endpoints concurrently, each
+// worker on its own netlink socket, and returns the failures as one error
+func deleteEndpointLinks(eps []*endpoint) error {
+	work := make(chan *endpoint)
+	var (
+		mu     sync.Mutex
+		errs   []string
+		wg     sync.WaitGroup
+		nworks = teardownWorkers
+	)
+	if len(eps) < nworks {
+		nworks = len(eps)
+	}
+	for i := 0; i < nworks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h, err := netlink.NewHandle(unix.NETLINK_ROUTE)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("failed to open a netlink handle: %v", err))
+				mu.Unlock()
+				// drain so the other workers still get every endpoint
+				for range work {
+				}
+				return
+			}
+			defer h.Delete()
+			setNetlinkRcvBuf(h)
+			for ep := range work {
+				if err := deleteEndpointLink(h, ep); err != nil {
+					mu.Lock()
+					errs = append(errs, err.Error())
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, ep := range eps {
+		work <- ep
+	}
+	close(work)
+	wg.Wait()
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete %d endpoint links: %s", len(errs), strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// deleteEndpointLink deletes an endpoint's macvlan child if it is still on the host
+func deleteEndpointLink(h *netlink.Handle, ep *endpoint) error {
+	if ep.srcName == "" {
+		return nil
+	}
+	link, err := h.LinkByName(ep.srcName)
+	if err != nil {
+		// already gone or moved into a sandbox
+		return nil
+	}
+	if err := h.LinkDel(link); err != nil {
+		return fmt.Errorf("interface %s of endpoint %.7s: %v", ep.srcName, ep.id, err)
+	}
+	logrus.Debugf("Deleted interface %s of endpoint %.7s", ep.srcName, ep.id)
+
+	return nil
+}
+
+// foreignChildren returns the interfaces on a parent that are not the macvlan
+// children of the given endpoints
+func foreignChildren(parent string, eps []*endpoint) ([]string, error) {
+	children, err := parentChildren(parent)
+	if err != nil {
+		return nil, err
+	}
+	own := make(map[string]bool, len(eps))
+	for _, ep := range eps {
+		if ep.srcName != "" {
+			own[ep.srcName] = true
+		}
+	}
+	var foreign []string
+	for _, name := range children {
+		if !own[name] {
+			foreign = append(foreign, name)
+		}
+	}
+
+	return foreign, nil
+}
+
+// verifyTeardown checks that the links a teardown deleted are gone from the
+// host, retrying each remaining one once. What is still there after the retry
+// is reported as one error.
+func (d *driver) verifyTeardown(n *network, eps []*endpoint) error {
+	var errs []string
+	if remaining := hostEndpointLinks(eps); len(remaining) > 0 {
+		logrus.Debugf("Network %.7s teardown left %d endpoint links, retrying", n.id, len(remaining))
+		deleteEndpointLinks(remaining)
+		for _, ep := range hostEndpointLinks(remaining) {
+			errs = append(errs, fmt.Sprintf("interface %s of endpoint %.7s", ep.srcName, ep.id))
+		}
+	}
+	if d.parentDeletedNow(n.config) && parentExists(n.config.Parent) {
+		logrus.Debugf("Network %.7s teardown left parent %s, retrying", n.id, n.config.Parent)
+		delParentLink(n.config)
+		if parentExists(n.config.Parent) {
+			errs = append(errs, fmt.Sprintf("parent %s", n.config.Parent))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("network %.7s was removed but its links are still on the host: %s", n.id, strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// hostEndpointLinks returns the endpoints whose macvlan child is on the host
+func hostEndpointLinks(eps []*endpoint) []*endpoint {
+	var remaining []*endpoint
+	for _, ep := range eps {
+		if ep.srcName == "" {
+			continue
+		}
+		if _, err := ns.NlHandle().LinkByName(ep.srcName); err == nil {
+			remaining = append(remaining, ep)
+		}
+	}
+
+	return remaining
+}
+
+// parentDeletedNow tells whether teardown deleted the parent right away,
+// rather than keeping it for another network or the -parent-delete-grace
+func (d *driver) parentDeletedNow(config *configuration) bool {
+	if !config.CreatedSlaveLink || d.opts.ParentDeleteGrace > 0 || len(d.parentUsers(config)) > 0 {
+		return false
+	}
+	switch config.parentLinkType() {
+	case parentLinkDummy:
+		return true
+	case parentLinkVlan:
+		_, _, err := parseVlan(config.Parent)
+		return err == nil
+	}
+
+	return false
+}
@@ -0,0 +1,112 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	networkapi "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/types"
+	"github.com/vishvananda/netlink"
+)
+
+// addTestChild adds a macvlan child to a parent in the test namespace
+func addTestChild(t testing.TB, parent, name string) {
+	h := ns.NlHandle()
+	link, err := h.LinkByName(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := &netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: link.Attrs().Index}, Mode: netlink.MACVLAN_MODE_BRIDGE}
+	if err := h.LinkAdd(child); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTeardownForbiddenKeepsLinks(t *testing.T) {
+	withTestNetns(t, "mvtest0")
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "mvtest0", MacvlanMode: modeBridge,
+		CreatedSlaveLink: true, CreatedLinkType: parentLinkDummy})
+	n, _ := d.getNetwork("n1")
+	addTestChild(t, "mvtest0", "mvown0")
+	addTestChild(t, "mvtest0", "mvforeign0")
+	eps := []*endpoint{{id: "e1", nid: "n1", srcName: "mvown0"}}
+
+	err := d.teardownLinks(n, eps)
+	if _, ok := err.(types.ForbiddenError); !ok {
+		t.Fatalf("got %v, want a forbidden error", err)
+	}
+	if !parentExists("mvown0") {
+		t.Error("forbidden teardown deleted the endpoint link")
+	}
+	if !parentExists("mvtest0") {
+		t.Error("forbidden teardown deleted the parent")
+	}
+}
+
+func TestTeardownOwnChildrenOnly(t *testing.T) {
+	withTestNetns(t, "mvtest0")
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "mvtest0", MacvlanMode: modeBridge,
+		CreatedSlaveLink: true, CreatedLinkType: parentLinkDummy})
+	n, _ := d.getNetwork("n1")
+	addTestChild(t, "mvtest0", "mvown0")
+	eps := []*endpoint{{id: "e1", nid: "n1", srcName: "mvown0"}}
+
+	if err := d.teardownLinks(n, eps); err != nil {
+		t.Fatalf("teardown of a parent with only the network's own children: %v", err)
+	}
+	if parentExists("mvown0") {
+		t.Error("teardown left the endpoint link")
+	}
+}
+
+func TestDeleteNetworkLeftoverLink(t *testing.T) {
+	withTestNetns(t, "mvtest0")
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "mvtest0", MacvlanMode: modeBridge})
+	n, _ := d.getNetwork("n1")
+	// the loopback link can't be deleted, so it is still there after the retry
+	n.addEndpoint(&endpoint{id: "e1", nid: "n1", srcName: "lo"})
+
+	err := d.DeleteNetwork(&networkapi.DeleteNetworkRequest{NetworkID: "n1"})
+	if err == nil || !strings.Contains(err.Error(), "interface lo of endpoint e1") {
+		t.Fatalf("got %v, want the leftover interface reported", err)
+	}
+	if _, err := d.getNetwork("n1"); err == nil {
+		t.Error("network kept after a teardown that left links")
+	}
+}
+
+func TestVerifyTeardownRetries(t *testing.T) {
+	withTestNetns(t, "mvtest0")
+	d := newTestDriver(Options{}, &configuration{ID: "n1", Parent: "mvtest0", MacvlanMode: modeBridge})
+	n, _ := d.getNetwork("n1")
+	// a link the first teardown pass missed
+	addTestChild(t, "mvtest0", "mvchild0")
+
+	if err := d.verifyTeardown(n, []*endpoint{{id: "e1", nid: "n1", srcName: "mvchild0"}}); err != nil {
+		t.Fatalf("retry didn't delete the leftover link: %v", err)
+	}
+	if parentExists("mvchild0") {
+		t.Error("leftover link is still there")
+	}
+}
+
+func BenchmarkTeardown100Endpoints(b *testing.B) {
+	withTestNetns(b, "mvtest0")
+	eps := make([]*endpoint, 100)
+	for i := range eps {
+		eps[i] = &endpoint{id: fmt.Sprintf("e%d", i), nid: "n1", srcName: fmt.Sprintf("mvchild%d", i)}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for _, ep := range eps {
+			addTestChild(b, "mvtest0", ep.srcName)
+		}
+		b.StartTimer()
+		if err := deleteEndpointLinks(eps); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
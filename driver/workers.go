@@ -0,0 +1,236 @@
+package driver
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	networkapi "github.com/docker/go-plugins-helpers/network"
+	"github.com/sirupsen/logrus"
+)
+
+// workerPool bounds how many plugin api calls are handled concurrently
+type workerPool struct {
+	slots  chan struct{}
+	queued int64
+	busy   int64
+}
+
+// workerStats is the queue depth view of the worker pool served on /workers
+type workerStats struct {
+	Workers int   `json:"workers"`
+	Busy    int64 `json:"busy"`
+	Queued  int64 `json:"queued"`
+}
+
+// newWorkerPool sizes the pool to n workers, or GOMAXPROCS when n is not positive
+func newWorkerPool(n int) *workerPool {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+
+	return &workerPool{slots: make(chan struct{}, n)}
+}
+
+func (p *workerPool) acquire() {
+	atomic.AddInt64(&p.queued, 1)
+	p.slots <- struct{}{}
+	atomic.AddInt64(&p.queued, -1)
+	atomic.AddInt64(&p.busy, 1)
+}
+
+func (p *workerPool) release() {
+	atomic.AddInt64(&p.busy, -1)
+	<-p.slots
+}
+
+func (p *workerPool) stats() *workerStats {
+	return &workerStats{
+		Workers: cap(p.slots),
+		Busy:    atomic.LoadInt64(&p.busy),
+		Queued:  atomic.LoadInt64(&p.queued),
+	}
+}
+
+// pooledDriver runs every plugin api call through the driver's worker pool
+// and the -log-requests request log
+type pooledDriver struct {
+	d *driver
+}
+
+// PluginDriver returns the driver to register with the plugin handler
+func (d *driver) PluginDriver() networkapi.Driver {
+	return &pooledDriver{d: d}
+}
+
+func (p *pooledDriver) GetCapabilities() (*networkapi.CapabilitiesResponse, error) {
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("GetCapabilities", nil)
+	defer p.d.observeOp("GetCapabilities", time.Now())
+	resp, err := p.d.GetCapabilities()
+	p.d.logResponse("GetCapabilities", resp, err)
+	return resp, err
+}
+
+func (p *pooledDriver) CreateNetwork(req *networkapi.CreateNetworkRequest) error {
+	if err := p.d.gateChange("CreateNetwork"); err != nil {
+		return err
+	}
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("CreateNetwork", req)
+	defer p.d.observeOp("CreateNetwork", time.Now())
+	err := p.d.CreateNetwork(req)
+	// a coded failure is logged once, with its code
+	if code := errorCode(err); code != "" {
+		logrus.WithField("code", code).Errorf("Failed to create network %.7s: %v", req.NetworkID, err)
+	} else {
+		p.d.logResponse("CreateNetwork", nil, err)
+	}
+	return err
+}
+
+func (p *pooledDriver) AllocateNetwork(req *networkapi.AllocateNetworkRequest) (*networkapi.AllocateNetworkResponse, error) {
+	if err := p.d.gateChange("AllocateNetwork"); err != nil {
+		return nil, err
+	}
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("AllocateNetwork", req)
+	defer p.d.observeOp("AllocateNetwork", time.Now())
+	resp, err := p.d.AllocateNetwork(req)
+	p.d.logResponse("AllocateNetwork", resp, err)
+	return resp, err
+}
+
+func (p *pooledDriver) DeleteNetwork(req *networkapi.DeleteNetworkRequest) error {
+	if err := p.d.gateChange("DeleteNetwork"); err != nil {
+		return err
+	}
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("DeleteNetwork", req)
+	defer p.d.observeOp("DeleteNetwork", time.Now())
+	err := p.d.DeleteNetwork(req)
+	p.d.logResponse("DeleteNetwork", nil, err)
+	return err
+}
+
+func (p *pooledDriver) FreeNetwork(req *networkapi.FreeNetworkRequest) error {
+	if err := p.d.gateChange("FreeNetwork"); err != nil {
+		return err
+	}
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("FreeNetwork", req)
+	defer p.d.observeOp("FreeNetwork", time.Now())
+	err := p.d.FreeNetwork(req)
+	p.d.logResponse("FreeNetwork", nil, err)
+	return err
+}
+
+func (p *pooledDriver) CreateEndpoint(req *networkapi.CreateEndpointRequest) (*networkapi.CreateEndpointResponse, error) {
+	if err := p.d.gateChange("CreateEndpoint"); err != nil {
+		return nil, err
+	}
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("CreateEndpoint", req)
+	defer p.d.observeOp("CreateEndpoint", time.Now())
+	resp, err := p.d.CreateEndpoint(req)
+	p.d.logResponse("CreateEndpoint", resp, err)
+	return resp, err
+}
+
+func (p *pooledDriver) DeleteEndpoint(req *networkapi.DeleteEndpointRequest) error {
+	if err := p.d.gateChange("DeleteEndpoint"); err != nil {
+		return err
+	}
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("DeleteEndpoint", req)
+	defer p.d.observeOp("DeleteEndpoint", time.Now())
+	err := p.d.DeleteEndpoint(req)
+	p.d.logResponse("DeleteEndpoint", nil, err)
+	return err
+}
+
+func (p *pooledDriver) EndpointInfo(req *networkapi.InfoRequest) (*networkapi.InfoResponse, error) {
+	if err := p.d.gate("EndpointInfo"); err != nil {
+		return nil, err
+	}
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("EndpointInfo", req)
+	defer p.d.observeOp("EndpointInfo", time.Now())
+	resp, err := p.d.EndpointInfo(req)
+	p.d.logResponse("EndpointInfo", resp, err)
+	return resp, err
+}
+
+func (p *pooledDriver) Join(req *networkapi.JoinRequest) (*networkapi.JoinResponse, error) {
+	if err := p.d.gateChange("Join"); err != nil {
+		return nil, err
+	}
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("Join", req)
+	defer p.d.observeOp("Join", time.Now())
+	resp, err := p.d.Join(req)
+	p.d.logResponse("Join", resp, err)
+	return resp, err
+}
+
+func (p *pooledDriver) Leave(req *networkapi.LeaveRequest) error {
+	if err := p.d.gateChange("Leave"); err != nil {
+		return err
+	}
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("Leave", req)
+	defer p.d.observeOp("Leave", time.Now())
+	err := p.d.Leave(req)
+	p.d.logResponse("Leave", nil, err)
+	return err
+}
+
+func (p *pooledDriver) DiscoverNew(notif *networkapi.DiscoveryNotification) error {
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("DiscoverNew", notif)
+	defer p.d.observeOp("DiscoverNew", time.Now())
+	err := p.d.DiscoverNew(notif)
+	p.d.logResponse("DiscoverNew", nil, err)
+	return err
+}
+
+func (p *pooledDriver) DiscoverDelete(notif *networkapi.DiscoveryNotification) error {
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("DiscoverDelete", notif)
+	defer p.d.observeOp("DiscoverDelete", time.Now())
+	err := p.d.DiscoverDelete(notif)
+	p.d.logResponse("DiscoverDelete", nil, err)
+	return err
+}
+
+func (p *pooledDriver) ProgramExternalConnectivity(req *networkapi.ProgramExternalConnectivityRequest) error {
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("ProgramExternalConnectivity", req)
+	defer p.d.observeOp("ProgramExternalConnectivity", time.Now())
+	err := p.d.ProgramExternalConnectivity(req)
+	p.d.logResponse("ProgramExternalConnectivity", nil, err)
+	return err
+}
+
+func (p *pooledDriver) RevokeExternalConnectivity(req *networkapi.RevokeExternalConnectivityRequest) error {
+	p.d.workers.acquire()
+	defer p.d.workers.release()
+	p.d.logRequest("RevokeExternalConnectivity", req)
+	defer p.d.observeOp("RevokeExternalConnectivity", time.Now())
+	err := p.d.RevokeExternalConnectivity(req)
+	p.d.logResponse("RevokeExternalConnectivity", nil, err)
+	return err
+}